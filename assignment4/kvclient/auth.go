@@ -0,0 +1,73 @@
+package kvclient
+
+import (
+	"context"
+)
+
+//Permissions a role can have on keys, each allows the ones before it
+const (
+	PermRead  = "read"
+	PermWrite = "write"
+	PermAdmin = "admin" //Also allows granting permissions within the keys
+)
+
+//Add a user who logs in with password
+//Adding the user named root turns on authentication
+func (c *Client) AddUser(ctx context.Context, name, password string) error {
+	return c.accessCommand(ctx, false, "user", "add", name, password)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	return c.accessCommand(ctx, false, "user", "delete", name)
+}
+
+//Change password of a user, users can change their own
+func (c *Client) ChangePassword(ctx context.Context, name, password string) error {
+	return c.accessCommand(ctx, true, "user", "passwd", name, password)
+}
+
+func (c *Client) GrantRole(ctx context.Context, name, role string) error {
+	return c.accessCommand(ctx, true, "user", "grant", name, role)
+}
+
+func (c *Client) RevokeRole(ctx context.Context, name, role string) error {
+	return c.accessCommand(ctx, false, "user", "revoke", name, role)
+}
+
+func (c *Client) AddRole(ctx context.Context, role string) error {
+	return c.accessCommand(ctx, false, "role", "add", role)
+}
+
+func (c *Client) DeleteRole(ctx context.Context, role string) error {
+	return c.accessCommand(ctx, false, "role", "delete", role)
+}
+
+//Let role use key with permission, or all keys starting with key
+//without the * if it ends with *. Key is in the client's namespace
+func (c *Client) GrantPermission(ctx context.Context, role, permission, key string) error {
+	return c.accessCommand(ctx, true, "role", "grant", role, permission, key)
+}
+
+func (c *Client) RevokePermission(ctx context.Context, role, key string) error {
+	return c.accessCommand(ctx, false, "role", "revoke", role, key)
+}
+
+//Run a user or role command, which replies OK
+func (c *Client) accessCommand(ctx context.Context, idempotent bool, args ...string) error {
+	line := ""
+	for _, arg := range args {
+		if !validKey(arg) {
+			return ErrCommand
+		}
+		line += arg + " "
+	}
+
+	resp, err := c.do(ctx, line[:len(line)-1], nil, idempotent)
+	if err != nil {
+		return err
+	}
+	if resp.line != "OK" {
+		return responseError(resp.line)
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package kvclient
+
+import (
+	"assignment4/raft"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Client for the kvstore cluster
+//Finds the leader by following redirects, keeps a pool of connections
+//to servers and retries commands when it is safe to do so.
+//A client can be used by many go routines at a time.
+type Client struct {
+	MaxRetries  int           //Times a command is tried on other servers
+	MaxIdle     int           //Idle connections kept per server
+	DialTimeout time.Duration //Timeout for connecting to a server
+	RetryDelay  time.Duration //Wait between retries, grows with each retry
+
+	//Run set, cas and delete in sessions so that they are applied
+	//exactly once and can be retried when a connection breaks
+	Sessions    bool
+	SessionIdle time.Duration //Idle sessions older than this are not reused
+
+	//Namespace keys are in, empty for the default one, and user to
+	//log in as if the cluster needs it. Must be set before the
+	//client is used
+	Namespace      string
+	User, Password string
+
+	//Connect with TLS when set, as needed if ClientTLS is set in
+	//cluster config. Must be set before the client is used
+	TLSConfig *tls.Config
+
+	lock     sync.Mutex
+	sessions []*session         //Idle sessions
+	addrs    []string           //Client address of all servers
+	ids      map[int]string     //Server id to address, to follow redirects
+	leader   string             //Last known leader address
+	next     int                //Server to try next when leader is not known
+	idle     map[string][]*conn //Pool of connections per server
+}
+
+//A key with its meta data
+type Item struct {
+	Key        string
+	Value      []byte
+	Version    int64
+	ExpiryTime int64
+}
+
+//Client which knows only addresses (host:port) of servers
+//Redirects are followed by trying other servers in turn
+func New(addrs ...string) *Client {
+	return &Client{
+		MaxRetries:  10,
+		MaxIdle:     4,
+		DialTimeout: time.Second,
+		RetryDelay:  100 * time.Millisecond,
+		Sessions:    true,
+		SessionIdle: 10 * time.Minute,
+		addrs:       addrs,
+		ids:         make(map[int]string),
+		idle:        make(map[string][]*conn),
+	}
+}
+
+//Client for servers in cluster config
+//Redirects go straight to the leader since server ids are known
+func NewFromConfig(config *raft.ClusterConfig) *Client {
+	var addrs []string
+	for _, server := range config.Servers {
+		addrs = append(addrs, server.ClientAddress())
+	}
+
+	c := New(addrs...)
+	for i, server := range config.Servers {
+		c.ids[server.Id] = addrs[i]
+	}
+	return c
+}
+
+//TLS config which trusts servers with certificates of the CA in caFile
+func NewTLSConfig(caFile string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kvclient: no certificates in " + caFile)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+//Close idle sessions and connections
+func (c *Client) Close() {
+	c.closeSessions()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for addr, conns := range c.idle {
+		for _, cn := range conns {
+			cn.close()
+		}
+		delete(c.idle, addr)
+	}
+}
+
+//Store value of key, fails with ErrVersion if key already exists
+//Returns version of the new value
+func (c *Client) Set(ctx context.Context, key string, value []byte, exptime int64) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrCommand
+	}
+	line := fmt.Sprintf("set %s %d %d", key, exptime, len(value))
+	resp, err := c.doOnce(ctx, line, value)
+	if err != nil {
+		return 0, err
+	}
+	return parseVersion(resp)
+}
+
+//Replace value of key if its version still is version
+//Returns version of the new value
+func (c *Client) CAS(ctx context.Context, key string, version int64, value []byte, exptime int64) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrCommand
+	}
+	line := fmt.Sprintf("cas %s %d %d %d", key, exptime, version, len(value))
+	resp, err := c.doOnce(ctx, line, value)
+	if err != nil {
+		return 0, err
+	}
+	return parseVersion(resp)
+}
+
+//Value of key
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	if !validKey(key) {
+		return nil, ErrCommand
+	}
+	resp, err := c.do(ctx, "get "+key, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.data == nil {
+		return nil, responseError(resp.line)
+	}
+	return resp.data, nil
+}
+
+//Value of key with its version and expiry time
+func (c *Client) GetMeta(ctx context.Context, key string) (*Item, error) {
+	if !validKey(key) {
+		return nil, ErrCommand
+	}
+	resp, err := c.do(ctx, "getm "+key, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseItem(key, resp)
+}
+
+//VALUE <version> <exptime> <numbytes> response of getm
+func parseItem(key string, resp response) (*Item, error) {
+	item := &Item{Key: key, Value: resp.data}
+	var numbytes int64
+	_, err := fmt.Sscanf(resp.line, "VALUE %d %d %d", &item.Version, &item.ExpiryTime, &numbytes)
+	if err != nil || resp.data == nil {
+		return nil, responseError(resp.line)
+	}
+	return item, nil
+}
+
+//Remove key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrCommand
+	}
+	resp, err := c.doOnce(ctx, "delete "+key, nil)
+	if err != nil {
+		return err
+	}
+	if resp.line != "DELETED" {
+		return responseError(resp.line)
+	}
+	return nil
+}
+
+//Keys are sent as a word in command line
+func validKey(key string) bool {
+	return key != "" && strings.IndexAny(key, " \t\r\n") < 0
+}
+
+func parseVersion(resp response) (int64, error) {
+	if !strings.HasPrefix(resp.line, "OK ") {
+		return 0, responseError(resp.line)
+	}
+	version, err := strconv.ParseInt(resp.line[3:], 10, 64)
+	if err != nil {
+		return 0, &ServerError{resp.line}
+	}
+	return version, nil
+}
+
+//Run a command on the leader
+//Redirects and connection failures are retried on other servers.
+//If a command may have reached the server before its connection broke,
+//it is retried only if idempotent (or in a session), since it could be
+//applied twice otherwise.
+//Error responses other than redirect are returned as response.
+func (c *Client) do(ctx context.Context, line string, data []byte, idempotent bool) (response, error) {
+
+	lastErr := ErrNoLeader
+
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+
+		if attempt > 0 {
+			//Give some time for election to finish
+			select {
+			case <-time.After(time.Duration(attempt) * c.RetryDelay):
+			case <-ctx.Done():
+				return response{}, ctx.Err()
+			}
+		}
+
+		addr := c.leaderAddr()
+		cn, err := c.getConn(ctx, addr)
+		if err == ErrAuthFailed || err == ErrCommand {
+			return response{}, err //Other servers would refuse too
+		}
+		if err != nil {
+			//Nothing was sent, safe to try another server
+			c.forgetLeader(addr)
+			lastErr = err
+			if ctx.Err() != nil {
+				return response{}, ctx.Err()
+			}
+			continue
+		}
+
+		resp, err := cn.roundTrip(ctx, line, data)
+		if err != nil {
+			cn.close()
+			c.forgetLeader(addr)
+			if ctx.Err() != nil || !idempotent {
+				return response{}, err
+			}
+			lastErr = err
+			continue
+		}
+
+		c.putConn(cn)
+
+		if strings.HasPrefix(resp.line, "REDIRECT") {
+			//Not appended to log, so always safe to retry
+			redirect, ok := responseError(resp.line).(*RedirectError)
+			if !ok {
+				return response{}, &ServerError{resp.line}
+			}
+			c.followRedirect(addr, redirect)
+			lastErr = ErrNoLeader
+			continue
+		}
+
+		if resp.line == "ERR_NO_LEADER" {
+			//Election going on, not appended so safe to retry
+			lastErr = ErrNoLeader
+			continue
+		}
+
+		if resp.line == "ERR_NOT_LEADER" || strings.HasPrefix(resp.line, "ERR_TIMEOUT") {
+			//Appended but not known if it will be applied, like a broken connection
+			lastErr = responseError(resp.line)
+			if !idempotent {
+				return response{}, lastErr
+			}
+			if resp.line == "ERR_NOT_LEADER" {
+				c.forgetLeader(addr)
+			}
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return response{}, lastErr
+}
+
+//Address of the server commands should be sent to
+func (c *Client) leaderAddr() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.leader == "" {
+		c.leader = c.addrs[c.next%len(c.addrs)]
+		c.next++
+	}
+	return c.leader
+}
+
+//Leader at addr didn't work, try some other server next time
+func (c *Client) forgetLeader(addr string) {
+	c.lock.Lock()
+	if c.leader == addr {
+		c.leader = ""
+	}
+	c.lock.Unlock()
+}
+
+func (c *Client) followRedirect(from string, redirect *RedirectError) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if redirect.Address != "" {
+		c.leader = redirect.Address
+	} else if addr, ok := c.ids[redirect.LeaderID]; ok && addr != from {
+		c.leader = addr
+	} else if c.leader == from {
+		c.leader = "" //Don't know where leader is, try next
+	}
+}
+
+//Idle connection to addr from pool, or a new one
+func (c *Client) getConn(ctx context.Context, addr string) (*conn, error) {
+	c.lock.Lock()
+	conns := c.idle[addr]
+	if len(conns) > 0 {
+		cn := conns[len(conns)-1]
+		c.idle[addr] = conns[:len(conns)-1]
+		c.lock.Unlock()
+		return cn, nil
+	}
+	c.lock.Unlock()
+
+	return c.dial(ctx, addr)
+}
+
+//New connection to addr, logged in and in the client's namespace
+func (c *Client) dial(ctx context.Context, addr string) (*conn, error) {
+	if c.User != "" && (!validKey(c.User) || !validKey(c.Password)) {
+		return nil, ErrCommand
+	}
+
+	cn, err := dial(ctx, addr, c.DialTimeout, c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var setup []string
+	if c.User != "" {
+		setup = append(setup, "auth "+c.User+" "+c.Password)
+	}
+	if c.Namespace != "" {
+		setup = append(setup, "use "+c.Namespace)
+	}
+
+	for _, line := range setup {
+		resp, err := cn.roundTrip(ctx, line, nil)
+		if err == nil && resp.line != "OK" {
+			err = responseError(resp.line)
+		}
+		if err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+//Return connection to pool after use
+func (c *Client) putConn(cn *conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.idle[cn.addr]) >= c.MaxIdle {
+		cn.close()
+		return
+	}
+	c.idle[cn.addr] = append(c.idle[cn.addr], cn)
+}
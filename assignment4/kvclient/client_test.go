@@ -0,0 +1,225 @@
+package kvclient
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Server speaking the text protocol, answering with reply. A reply of ""
+//closes the connection without answering, as if it broke
+type fakeServer struct {
+	listener net.Listener
+	reply    func(line string) string
+
+	lock  sync.Mutex
+	lines []string //Commands received, in order
+}
+
+func newFakeServer(t *testing.T, reply func(line string) string) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: listener, reply: reply}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(netConn)
+	}
+}
+
+func (s *fakeServer) handle(netConn net.Conn) {
+	defer netConn.Close()
+	reader := bufio.NewReader(netConn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		//Data of set and cas, also in a session
+		fields := strings.Fields(line)
+		if len(fields) > 3 && fields[0] == "session" {
+			fields = fields[3:]
+		}
+		index := map[string]int{"set": 3, "cas": 4}[fields[0]]
+		if index > 0 && len(fields) > index {
+			length, _ := strconv.Atoi(fields[index])
+			if _, err := io.CopyN(ioutil.Discard, reader, int64(length)+2); err != nil {
+				return
+			}
+		}
+
+		s.lock.Lock()
+		s.lines = append(s.lines, line)
+		s.lock.Unlock()
+
+		response := s.reply(line)
+		if response == "" {
+			return
+		}
+		if _, err := netConn.Write([]byte(response + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func testClient(addrs ...string) *Client {
+	c := New(addrs...)
+	c.RetryDelay = time.Millisecond
+	return c
+}
+
+func TestRedirectWithAddress(t *testing.T) {
+	leader := newFakeServer(t, func(line string) string { return "VALUE 3 0 1\r\nv" })
+	follower := newFakeServer(t, func(line string) string { return "REDIRECT 1 " + leader.addr() })
+
+	c := testClient(follower.addr())
+	defer c.Close()
+	value, err := c.Get(context.Background(), "k")
+	if err != nil || string(value) != "v" {
+		t.Fatalf("got %q %v", value, err)
+	}
+	if len(follower.received()) != 1 || len(leader.received()) != 1 {
+		t.Errorf("follower got %q, leader got %q", follower.received(), leader.received())
+	}
+
+	//Leader is remembered
+	c.Get(context.Background(), "k")
+	if len(follower.received()) != 1 {
+		t.Errorf("follower asked again: %q", follower.received())
+	}
+}
+
+func TestRedirectWithoutAddress(t *testing.T) {
+	leader := newFakeServer(t, func(line string) string { return "VALUE 3 0 1\r\nv" })
+	follower := newFakeServer(t, func(line string) string { return "REDIRECT 2" })
+	other := newFakeServer(t, func(line string) string { return "REDIRECT 2" })
+
+	//Id of leader is known, so it is tried straight away
+	c := testClient(follower.addr(), other.addr(), leader.addr())
+	defer c.Close()
+	c.ids[2] = leader.addr()
+	if value, err := c.Get(context.Background(), "k"); err != nil || string(value) != "v" {
+		t.Fatalf("got %q %v", value, err)
+	}
+	if len(other.received()) != 0 {
+		t.Errorf("server other than leader tried: %q", other.received())
+	}
+
+	//Otherwise servers are tried in turn
+	c = testClient(follower.addr(), other.addr(), leader.addr())
+	defer c.Close()
+	if value, err := c.Get(context.Background(), "k"); err != nil || string(value) != "v" {
+		t.Fatalf("got %q %v", value, err)
+	}
+	if len(other.received()) != 1 {
+		t.Errorf("servers not tried in turn, other got %q", other.received())
+	}
+}
+
+func TestTimeoutNotRetried(t *testing.T) {
+	var lock sync.Mutex
+	timeouts := 0
+	server := newFakeServer(t, func(line string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		if timeouts < 1 {
+			timeouts++
+			return "ERR_TIMEOUT 100"
+		}
+		if strings.HasPrefix(line, "get") {
+			return "VALUE 3 0 1\r\nv"
+		}
+		return "OK 4"
+	})
+
+	//Set may have been applied, so it is not sent again
+	c := testClient(server.addr())
+	defer c.Close()
+	c.Sessions = false
+	if _, err := c.Set(context.Background(), "k", []byte("v"), 0); err != ErrTimeout {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	if got := server.received(); len(got) != 1 {
+		t.Errorf("set sent %d times: %q", len(got), got)
+	}
+
+	//Get is retried
+	lock.Lock()
+	timeouts = 0
+	lock.Unlock()
+	if value, err := c.Get(context.Background(), "k"); err != nil || string(value) != "v" {
+		t.Errorf("got %q %v", value, err)
+	}
+	if got := server.received(); len(got) != 3 {
+		t.Errorf("get not retried: %q", got)
+	}
+}
+
+func TestSessionRetry(t *testing.T) {
+	var lock sync.Mutex
+	broken := false
+	server := newFakeServer(t, func(line string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case line == "register":
+			return "SESSION 7"
+		case !broken:
+			broken = true
+			return "" //Connection breaks before the response
+		case strings.HasPrefix(line, "session 7 2 "):
+			return "ERR_SESSION_EXPIRED"
+		}
+		return "OK 4"
+	})
+
+	//Set in a session is sent again with the same sequence number
+	c := testClient(server.addr())
+	defer c.Close()
+	if version, err := c.Set(context.Background(), "k", []byte("v"), 0); err != nil || version != 4 {
+		t.Fatalf("got %d %v", version, err)
+	}
+	got := server.received()
+	if len(got) != 3 || got[1] != "session 7 1 set k 0 1" || got[2] != got[1] {
+		t.Errorf("got %q, want register and the set twice", got)
+	}
+
+	//Expired session is dropped, next command registers a new one
+	if _, err := c.Set(context.Background(), "k", []byte("v"), 0); err != ErrSessionExpired {
+		t.Errorf("got %v, want %v", err, ErrSessionExpired)
+	}
+	c.Set(context.Background(), "k", []byte("v"), 0)
+	got = server.received()
+	if got[len(got)-2] != "register" || got[len(got)-1] != "session 7 1 set k 0 1" {
+		t.Errorf("got %q, want a new session after expiry", got)
+	}
+}
@@ -0,0 +1,148 @@
+package kvclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A connection to one server, speaking the text protocol
+type conn struct {
+	addr    string
+	netConn net.Conn
+	reader  *bufio.Reader
+}
+
+//Response of one command. data is only set for VALUE responses (and put events)
+//and ops only for TXN and RANGE responses
+type response struct {
+	line string
+	data []byte
+	ops  []response
+}
+
+var errBadResponse = errors.New("kvclient: malformed response")
+
+func dial(ctx context.Context, addr string, timeout time.Duration, config *tls.Config) (*conn, error) {
+	var netConn net.Conn
+	var err error
+	dialer := net.Dialer{Timeout: timeout}
+	if config != nil {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config}
+		netConn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn{addr, netConn, bufio.NewReader(netConn)}, nil
+}
+
+//Send one command (and data if any) and read its response
+//Connection is interrupted if ctx is done before response comes
+func (c *conn) roundTrip(ctx context.Context, line string, data []byte) (response, error) {
+
+	deadline, _ := ctx.Deadline() //Zero time if none, clears old one
+	c.netConn.SetDeadline(deadline)
+
+	//Unblock read/write if ctx is cancelled
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.netConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	resp, err := c.exchange(line, data)
+	if err != nil && ctx.Err() != nil {
+		return resp, ctx.Err()
+	}
+	return resp, err
+}
+
+func (c *conn) exchange(line string, data []byte) (response, error) {
+
+	buf := []byte(line + "\r\n")
+	if data != nil {
+		buf = append(buf, data...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.netConn.Write(buf); err != nil {
+		return response{}, err
+	}
+
+	return c.readResponse()
+}
+
+func (c *conn) readResponse() (response, error) {
+
+	respLine, err := c.reader.ReadString('\n')
+	if err != nil {
+		return response{}, err
+	}
+	respLine = strings.TrimRight(respLine, "\r\n")
+
+	if strings.HasPrefix(respLine, "TXN ") || strings.HasPrefix(respLine, "RANGE ") {
+		return c.readListResponse(respLine)
+	}
+
+	fields := strings.Fields(respLine)
+	withData := strings.HasPrefix(respLine, "VALUE ") || strings.HasPrefix(respLine, "EVENT put ") ||
+		(len(fields) == 5 && fields[0] == "KEY")
+	if !withData {
+		return response{line: respLine}, nil
+	}
+
+	//VALUE ... <num_bytes> (or EVENT put ..., KEY ...) followed by data and \r\n
+	length, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil || length < 0 {
+		return response{}, errBadResponse
+	}
+
+	value := make([]byte, length+2)
+	if _, err = io.ReadFull(c.reader, value); err != nil {
+		return response{}, err
+	}
+	if string(value[length:]) != "\r\n" {
+		return response{}, errBadResponse
+	}
+
+	return response{line: respLine, data: value[:length]}, nil
+}
+
+//TXN SUCCESS|FAILURE <n> or RANGE <n> [<next>], followed by n responses
+func (c *conn) readListResponse(line string) (response, error) {
+	fields := strings.Fields(line)
+	count := fields[len(fields)-1]
+	if fields[0] == "RANGE" {
+		count = fields[1]
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return response{}, errBadResponse
+	}
+
+	resp := response{line: line}
+	for i := 0; i < n; i++ {
+		op, err := c.readResponse()
+		if err != nil {
+			return response{}, err
+		}
+		resp.ops = append(resp.ops, op)
+	}
+	return resp, nil
+}
+
+func (c *conn) close() {
+	c.netConn.Close()
+}
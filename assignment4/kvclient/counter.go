@@ -0,0 +1,57 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Options of Incr and Decr, nil for defaults
+type CounterOptions struct {
+	Initial  int64  //Value of a missing key, before adding delta
+	Bounded  bool   //Result must be within Min and Max
+	Min, Max int64  //Bounds if Bounded
+	Overflow string //If result is out of bounds: "fail" (default, ErrOutOfRange), "clamp" or "wrap"
+}
+
+//Add delta to the number in key, as one command on the server
+//Returns the new value
+func (c *Client) Incr(ctx context.Context, key string, delta int64, opts *CounterOptions) (int64, error) {
+	return c.counter(ctx, "incr", key, delta, opts)
+}
+
+//Subtract delta from the number in key. Returns the new value
+func (c *Client) Decr(ctx context.Context, key string, delta int64, opts *CounterOptions) (int64, error) {
+	return c.counter(ctx, "decr", key, delta, opts)
+}
+
+func (c *Client) counter(ctx context.Context, cmd string, key string, delta int64, opts *CounterOptions) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrCommand
+	}
+
+	line := fmt.Sprintf("%s %s %d", cmd, key, delta)
+	if opts != nil {
+		line += fmt.Sprintf(" initial %d", opts.Initial)
+		if opts.Bounded {
+			line += fmt.Sprintf(" min %d max %d", opts.Min, opts.Max)
+		}
+		if opts.Overflow != "" {
+			line += " " + opts.Overflow
+		}
+	}
+
+	resp, err := c.doOnce(ctx, line, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(resp.line, "NUM ") {
+		return 0, responseError(resp.line)
+	}
+	number, err := strconv.ParseInt(resp.line[4:], 10, 64)
+	if err != nil {
+		return 0, &ServerError{resp.line}
+	}
+	return number, nil
+}
@@ -0,0 +1,126 @@
+package kvclient
+
+import (
+	"context"
+)
+
+//Leader election among clients. Candidates campaign on a lock of the
+//election's name, and the one holding it is the leader. The leader's
+//value is kept in the key of the same name, attached to the lock's
+//lease, so it goes away when the leader does.
+type Election struct {
+	Name string
+
+	c    *Client
+	lock *Lock //Held while leader
+}
+
+func (c *Client) NewElection(name string) *Election {
+	return &Election{Name: name, c: c}
+}
+
+//Wait till elected, then publish value as the leader's
+//ttl is seconds after which leadership is lost if this client dies
+func (e *Election) Campaign(ctx context.Context, value []byte, ttl int64) error {
+	lock, err := e.c.Lock(ctx, e.Name, ttl)
+	if err != nil {
+		return err
+	}
+
+	if _, err := e.c.SetWithLease(ctx, e.Name, value, lock.Lease); err != nil {
+		lock.Unlock(ctx)
+		return err
+	}
+	e.lock = lock
+	return nil
+}
+
+//Change value while being the leader
+func (e *Election) Proclaim(ctx context.Context, value []byte) error {
+	if e.lock == nil {
+		return ErrLeaseNotFound
+	}
+	_, err := e.c.SetWithLease(ctx, e.Name, value, e.lock.Lease)
+	return err
+}
+
+//Stop being the leader, so that next candidate is elected
+func (e *Election) Resign(ctx context.Context) error {
+	if e.lock == nil {
+		return nil
+	}
+	lock := e.lock
+	e.lock = nil
+	return lock.Unlock(ctx)
+}
+
+//Fencing token of this client's term as leader, 0 if not leader
+func (e *Election) Token() int64 {
+	if e.lock == nil {
+		return 0
+	}
+	return e.lock.Token
+}
+
+//Closed if leadership was lost without resigning
+func (e *Election) Lost() <-chan bool {
+	if e.lock == nil {
+		return nil
+	}
+	return e.lock.Lost()
+}
+
+//Value of the current leader, ErrNotFound if there is none
+func (e *Election) Leader(ctx context.Context) ([]byte, error) {
+	return e.c.Get(ctx, e.Name)
+}
+
+//Values of the leader as it changes, nil when there is no leader
+//The current value is sent first. Channel is closed when ctx is done
+func (e *Election) Observe(ctx context.Context) <-chan []byte {
+	values := make(chan []byte)
+	go e.observe(ctx, values)
+	return values
+}
+
+func (e *Election) observe(ctx context.Context, values chan []byte) {
+	defer close(values)
+
+	for ctx.Err() == nil {
+		var value []byte
+		from := int64(0)
+		item, err := e.c.GetMeta(ctx, e.Name)
+		switch err {
+		case nil:
+			value, from = item.Value, item.Version+1
+		case ErrNotFound:
+		default:
+			return
+		}
+		if !sendValue(ctx, values, value) {
+			return
+		}
+
+		for event := range e.c.Watch(ctx, e.Name, from) {
+			if event.Err != nil {
+				break //Compacted, start again from current value
+			}
+			value = nil
+			if event.Type == "put" {
+				value = event.Value
+			}
+			if !sendValue(ctx, values, value) {
+				return
+			}
+		}
+	}
+}
+
+func sendValue(ctx context.Context, values chan []byte, value []byte) bool {
+	select {
+	case values <- value:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
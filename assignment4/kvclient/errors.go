@@ -0,0 +1,118 @@
+package kvclient
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//Errors returned by kvstore, as typed errors
+var (
+	ErrNotFound = errors.New("kvclient: key not found")
+	ErrVersion  = errors.New("kvclient: version mismatch")
+	ErrCommand  = errors.New("kvclient: invalid command or arguments")
+	ErrInternal = errors.New("kvclient: internal server error")
+	ErrTooLarge = errors.New("kvclient: value too large")
+	ErrNoLeader = errors.New("kvclient: couldn't reach the leader")
+
+	ErrLeaseNotFound = errors.New("kvclient: lease not found or expired")
+	ErrNotNumber     = errors.New("kvclient: value is not a number")
+	ErrOutOfRange    = errors.New("kvclient: counter would go out of range")
+	ErrOutOfMemory   = errors.New("kvclient: kvstore is out of memory")
+
+	ErrNamespaceNotFound = errors.New("kvclient: namespace not found")
+	ErrQuotaExceeded     = errors.New("kvclient: namespace quota exceeded")
+	ErrRateLimited       = errors.New("kvclient: namespace rate limit reached")
+
+	ErrAuthRequired     = errors.New("kvclient: user not logged in")
+	ErrAuthFailed       = errors.New("kvclient: wrong user or password")
+	ErrPermissionDenied = errors.New("kvclient: permission denied")
+
+	//Command might or might not have been applied
+	ErrSessionExpired = errors.New("kvclient: session expired")
+	ErrNotLeader      = errors.New("kvclient: leader changed before command committed")
+	ErrTimeout        = errors.New("kvclient: command not committed in time")
+)
+
+//Response from server which the client doesn't understand
+type ServerError struct {
+	Response string
+}
+
+func (e *ServerError) Error() string {
+	return "kvclient: unexpected response " + strconv.Quote(e.Response)
+}
+
+//Server contacted is not the leader
+type RedirectError struct {
+	LeaderID int
+	Address  string //Client address of leader, empty if server didn't tell
+}
+
+func (e *RedirectError) Error() string {
+	return "kvclient: redirect to server " + strconv.Itoa(e.LeaderID)
+}
+
+//Map error responses of kvstore to errors
+func responseError(response string) error {
+
+	fields := strings.Fields(response)
+	if len(fields) == 0 {
+		return &ServerError{response}
+	}
+
+	switch fields[0] {
+	case "ERR_NOT_FOUND":
+		return ErrNotFound
+	case "ERR_VERSION":
+		return ErrVersion
+	case "ERR_CMD_ERR":
+		return ErrCommand
+	case "ERR_INTERNAL":
+		return ErrInternal
+	case "ERR_TOO_LARGE":
+		return ErrTooLarge
+	case "ERR_NO_LEADER":
+		return ErrNoLeader
+	case "ERR_LEASE_NOT_FOUND":
+		return ErrLeaseNotFound
+	case "ERR_NOT_NUMBER":
+		return ErrNotNumber
+	case "ERR_OUT_OF_RANGE":
+		return ErrOutOfRange
+	case "ERR_OUT_OF_MEMORY":
+		return ErrOutOfMemory
+	case "ERR_NAMESPACE_NOT_FOUND":
+		return ErrNamespaceNotFound
+	case "ERR_QUOTA_EXCEEDED":
+		return ErrQuotaExceeded
+	case "ERR_RATE_LIMITED":
+		return ErrRateLimited
+	case "ERR_AUTH_REQUIRED":
+		return ErrAuthRequired
+	case "ERR_AUTH_FAILED":
+		return ErrAuthFailed
+	case "ERR_PERMISSION_DENIED":
+		return ErrPermissionDenied
+	case "ERR_SESSION_EXPIRED", "ERR_STALE_SEQ":
+		return ErrSessionExpired
+	case "ERR_NOT_LEADER":
+		return ErrNotLeader
+	case "ERR_TIMEOUT":
+		return ErrTimeout
+	case "REDIRECT":
+		if len(fields) < 2 {
+			break
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			break
+		}
+		redirect := &RedirectError{LeaderID: id}
+		if len(fields) > 2 {
+			redirect.Address = fields[2]
+		}
+		return redirect
+	}
+	return &ServerError{response}
+}
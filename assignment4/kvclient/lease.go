@@ -0,0 +1,73 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Grant a lease which expires after ttl seconds unless kept alive
+//Returns id of the lease
+func (c *Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	if ttl <= 0 {
+		return 0, ErrCommand
+	}
+	resp, err := c.doOnce(ctx, "lease grant "+strconv.FormatInt(ttl, 10), nil)
+	if err != nil {
+		return 0, err
+	}
+	id, _, err := parseLease(resp)
+	return id, err
+}
+
+//Restart ttl of lease, call it well within the ttl
+//Returns the ttl, fails with ErrLeaseNotFound if the lease expired
+func (c *Client) KeepAlive(ctx context.Context, id int64) (int64, error) {
+	resp, err := c.do(ctx, "lease keepalive "+strconv.FormatInt(id, 10), nil, true)
+	if err != nil {
+		return 0, err
+	}
+	_, ttl, err := parseLease(resp)
+	return ttl, err
+}
+
+//Remove lease along with all keys attached to it
+func (c *Client) Revoke(ctx context.Context, id int64) error {
+	resp, err := c.doOnce(ctx, "lease revoke "+strconv.FormatInt(id, 10), nil)
+	if err != nil {
+		return err
+	}
+	if resp.line != "REVOKED" {
+		return responseError(resp.line)
+	}
+	return nil
+}
+
+//Store value of key attached to lease, overwriting it if it exists
+//Key is deleted along with the lease. Returns version of the new value
+func (c *Client) SetWithLease(ctx context.Context, key string, value []byte, id int64) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrCommand
+	}
+
+	//As a transaction, so that an existing key is overwritten
+	line := fmt.Sprintf("txn 0 1 0\r\nput %s 0 %d lease %d\r\n%s", key, len(value), id, value)
+	resp, err := c.doOnce(ctx, line, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(resp.line, "TXN SUCCESS") || len(resp.ops) != 1 {
+		return 0, responseError(resp.line)
+	}
+	return parseVersion(resp.ops[0])
+}
+
+//LEASE <id> <ttl>
+func parseLease(resp response) (int64, int64, error) {
+	var id, ttl int64
+	if _, err := fmt.Sscanf(resp.line, "LEASE %d %d", &id, &ttl); err != nil {
+		return 0, 0, responseError(resp.line)
+	}
+	return id, ttl, nil
+}
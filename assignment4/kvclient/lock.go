@@ -0,0 +1,147 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//A lock held by this client
+//Its lease is kept alive in background till Unlock
+type Lock struct {
+	Name  string
+	Lease int64 //Lease of the lock
+	Token int64 //Fencing token, bigger for every new holder of the lock
+
+	c        *Client
+	ttl      int64
+	stop     chan bool //Closed by Unlock
+	lost     chan bool //Closed if lease expired
+	stopOnce sync.Once
+}
+
+//Holder and waiters of a lock
+type LockStatus struct {
+	Holder  int64 //Lease of the holder
+	Token   int64 //Fencing token of the holder
+	Waiters int64
+}
+
+//Take lock name, waiting in queue till it is free or ctx is done
+//ttl is seconds the lock lives if this client stops keeping it alive
+//(eg: it crashed). The lock is also released if the session it was
+//taken in expires, or the client is closed.
+func (c *Client) Lock(ctx context.Context, name string, ttl int64) (*Lock, error) {
+	if !validKey(name) || ttl <= 0 {
+		return nil, ErrCommand
+	}
+
+	resp, err := c.doOnce(ctx, fmt.Sprintf("lock %s %d", name, ttl), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Lock{Name: name, c: c, ttl: ttl, stop: make(chan bool), lost: make(chan bool)}
+	var position int64
+	if _, err := fmt.Sscanf(resp.line, "LOCKED %d %d", &l.Lease, &l.Token); err != nil {
+		if _, err := fmt.Sscanf(resp.line, "WAITING %d %d", &l.Lease, &position); err != nil {
+			return nil, responseError(resp.line)
+		}
+	}
+
+	go l.keepAlive()
+
+	if l.Token == 0 {
+		if err := l.wait(ctx); err != nil {
+			unlockCtx, cancel := context.WithTimeout(context.Background(), c.DialTimeout)
+			defer cancel()
+			l.Unlock(unlockCtx)
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+//Wait in queue till lease of this lock is the holder
+func (l *Lock) wait(ctx context.Context) error {
+	for {
+		status, err := l.c.LockStatus(ctx, l.Name)
+		if err == nil && status.Holder == l.Lease {
+			l.Token = status.Token
+			return nil
+		}
+
+		select {
+		case <-time.After(l.c.RetryDelay):
+		case <-l.lost:
+			return ErrLeaseNotFound
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Send keepalives a few times within ttl
+func (l *Lock) keepAlive() {
+	ticker := time.NewTicker(time.Duration(l.ttl) * time.Second / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(l.ttl)*time.Second/3)
+		_, err := l.c.KeepAlive(ctx, l.Lease)
+		cancel()
+		if err == ErrLeaseNotFound {
+			close(l.lost)
+			return
+		}
+	}
+}
+
+//Closed if the lock was lost because its lease expired
+//A holder must stop using what the lock guards
+func (l *Lock) Lost() <-chan bool {
+	return l.lost
+}
+
+//Release the lock, next waiter gets it
+func (l *Lock) Unlock(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+
+	resp, err := l.c.doOnce(ctx, fmt.Sprintf("unlock %s %d", l.Name, l.Lease), nil)
+	if err != nil {
+		return err
+	}
+	if resp.line == "ERR_NOT_FOUND" {
+		return ErrLeaseNotFound //Lost already
+	}
+	if resp.line != "UNLOCKED" {
+		return responseError(resp.line)
+	}
+	return nil
+}
+
+//Holder of lock name, ErrNotFound if no one holds it
+func (c *Client) LockStatus(ctx context.Context, name string) (*LockStatus, error) {
+	if !validKey(name) {
+		return nil, ErrCommand
+	}
+
+	resp, err := c.do(ctx, "lock-status "+name, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &LockStatus{}
+	var respName string
+	if _, err := fmt.Sscanf(resp.line, "LOCK %s %d %d %d", &respName, &status.Holder, &status.Token, &status.Waiters); err != nil {
+		return nil, responseError(resp.line)
+	}
+	return status, nil
+}
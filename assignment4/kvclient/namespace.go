@@ -0,0 +1,122 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Limits of a namespace, 0 for no limit
+type Quota struct {
+	MaxKeys  int64 //Number of keys
+	MaxBytes int64 //Bytes of keys and values, with some overhead per key
+	Rate     int64 //Requests per second
+}
+
+//Usage and quota of a namespace
+type NamespaceStats struct {
+	Name      string
+	Keys      int64
+	Bytes     int64
+	Requests  int64 //Commands run in it
+	Throttled int64 //Commands rejected with ErrRateLimited
+	Quota     Quota
+}
+
+//Create a namespace, fails with ErrVersion if it exists
+//quota can be nil for no limits
+func (c *Client) CreateNamespace(ctx context.Context, name string, quota *Quota) error {
+	return c.namespaceCommand(ctx, "create", name, quota)
+}
+
+//Change quota of a namespace, nil for no limits
+func (c *Client) SetQuota(ctx context.Context, name string, quota *Quota) error {
+	return c.namespaceCommand(ctx, "quota", name, quota)
+}
+
+//Delete a namespace and all keys in it
+func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
+	if !validKey(name) {
+		return ErrCommand
+	}
+	resp, err := c.doOnce(ctx, "namespace delete "+name, nil)
+	if err != nil {
+		return err
+	}
+	if resp.line != "DELETED" {
+		return responseError(resp.line)
+	}
+	return nil
+}
+
+func (c *Client) namespaceCommand(ctx context.Context, op, name string, quota *Quota) error {
+	if !validKey(name) {
+		return ErrCommand
+	}
+
+	line := fmt.Sprintf("namespace %s %s", op, name)
+	if quota != nil {
+		line += fmt.Sprintf(" maxkeys %d maxbytes %d rate %d", quota.MaxKeys, quota.MaxBytes, quota.Rate)
+	}
+
+	//Applying it again gives the same result
+	resp, err := c.do(ctx, line, nil, op == "quota")
+	if err != nil {
+		return err
+	}
+	if resp.line != "OK" {
+		return responseError(resp.line)
+	}
+	return nil
+}
+
+//Usage of namespace name, or of the client's namespace if name is empty
+func (c *Client) Stats(ctx context.Context, name string) (*NamespaceStats, error) {
+	line := "stats"
+	if name != "" {
+		if !validKey(name) {
+			return nil, ErrCommand
+		}
+		line += " " + name
+	}
+
+	resp, err := c.do(ctx, line, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return parseStats(resp.line)
+}
+
+//STATS <name> keys <n> bytes <n> ... as pairs of name and number
+func parseStats(line string) (*NamespaceStats, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "STATS" || len(fields)%2 != 0 {
+		return nil, responseError(line)
+	}
+
+	stats := &NamespaceStats{Name: fields[1]}
+	for i := 2; i < len(fields); i += 2 {
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, &ServerError{line}
+		}
+		switch fields[i] {
+		case "keys":
+			stats.Keys = n
+		case "bytes":
+			stats.Bytes = n
+		case "requests":
+			stats.Requests = n
+		case "throttled":
+			stats.Throttled = n
+		case "maxkeys":
+			stats.Quota.MaxKeys = n
+		case "maxbytes":
+			stats.Quota.MaxBytes = n
+		case "rate":
+			stats.Quota.Rate = n
+		}
+	}
+	return stats, nil
+}
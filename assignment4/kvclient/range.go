@@ -0,0 +1,110 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Options of Range and Prefix, nil for defaults
+type RangeOptions struct {
+	Limit     int64 //Most keys in a page, 0 for server default
+	KeysOnly  bool  //Only keys, no values
+	CountOnly bool  //Only number of keys in the range
+}
+
+//A page of keys
+type RangeResult struct {
+	Items []Item //In sorted order, only Key is set with KeysOnly
+	Count int64  //Number of keys, all in range with CountOnly
+	Next  string //Start (cursor for Prefix) of the next page, "" if none
+}
+
+//Keys from start upto end, not including end. end "" means no end
+//To get the next page, call again with start as Next of the result
+func (c *Client) Range(ctx context.Context, start, end string, opts *RangeOptions) (*RangeResult, error) {
+	if !validKey(start) || (end != "" && !validKey(end)) {
+		return nil, ErrCommand
+	}
+	if end == "" {
+		end = "*"
+	}
+	return c.rangeQuery(ctx, "range "+start+" "+end, opts)
+}
+
+//Keys starting with prefix, from cursor if it is not ""
+//To get the next page, call again with cursor as Next of the result
+func (c *Client) Prefix(ctx context.Context, prefix, cursor string, opts *RangeOptions) (*RangeResult, error) {
+	if !validKey(prefix) || (cursor != "" && !validKey(cursor)) {
+		return nil, ErrCommand
+	}
+	line := "prefix " + prefix
+	if cursor != "" {
+		line += " from " + cursor
+	}
+	return c.rangeQuery(ctx, line, opts)
+}
+
+func (c *Client) rangeQuery(ctx context.Context, line string, opts *RangeOptions) (*RangeResult, error) {
+	if opts != nil {
+		if opts.Limit > 0 {
+			line += " limit " + strconv.FormatInt(opts.Limit, 10)
+		}
+		if opts.KeysOnly {
+			line += " keys"
+		}
+		if opts.CountOnly {
+			line += " count"
+		}
+	}
+
+	resp, err := c.do(ctx, line, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(resp.line)
+	result := &RangeResult{}
+	switch {
+	case len(fields) == 2 && fields[0] == "COUNT":
+		result.Count, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errBadResponse
+		}
+		return result, nil
+
+	case (len(fields) == 2 || len(fields) == 3) && fields[0] == "RANGE":
+		if len(fields) == 3 {
+			result.Next = fields[2]
+		}
+	default:
+		return nil, responseError(resp.line)
+	}
+
+	for _, op := range resp.ops {
+		item, err := parseKeyItem(op)
+		if err != nil {
+			return nil, err
+		}
+		result.Items = append(result.Items, item)
+	}
+	result.Count = int64(len(result.Items))
+	return result, nil
+}
+
+//KEY <key> [<version> <exptime> <numbytes>]
+func parseKeyItem(resp response) (Item, error) {
+	fields := strings.Fields(resp.line)
+	if len(fields) == 2 && fields[0] == "KEY" {
+		return Item{Key: fields[1]}, nil
+	}
+
+	item := Item{Value: resp.data}
+	var numbytes int64
+	_, err := fmt.Sscanf(resp.line, "KEY %s %d %d %d", &item.Key, &item.Version, &item.ExpiryTime, &numbytes)
+	if err != nil || resp.data == nil {
+		return Item{}, errBadResponse
+	}
+	return item, nil
+}
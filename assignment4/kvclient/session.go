@@ -0,0 +1,97 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//A session registered with the cluster. A command tagged with session
+//id and sequence number is applied only once however many times it is
+//sent, so commands in a session are safe to retry.
+//A session runs one command at a time, so the client keeps a pool of them.
+type session struct {
+	id       int64
+	seq      int64 //Sequence number of last command
+	lastUsed time.Time
+}
+
+//Run a command which is not idempotent exactly once, using a session
+func (c *Client) doOnce(ctx context.Context, line string, data []byte) (response, error) {
+	if !c.Sessions {
+		return c.do(ctx, line, data, false)
+	}
+
+	s, err := c.getSession(ctx)
+	if err != nil {
+		return response{}, err
+	}
+
+	s.seq++
+	tagged := fmt.Sprintf("session %d %d %s", s.id, s.seq, line)
+	resp, err := c.do(ctx, tagged, data, true)
+
+	if err == nil && (resp.line == "ERR_SESSION_EXPIRED" || resp.line == "ERR_STALE_SEQ") {
+		return response{}, responseError(resp.line) //Session is of no use now
+	}
+
+	//On error, command may still be applied after we stop waiting. It is
+	//fine, next command of session has a higher sequence number
+	c.putSession(s)
+	return resp, err
+}
+
+//Idle session from pool, or a newly registered one
+func (c *Client) getSession(ctx context.Context) (*session, error) {
+	c.lock.Lock()
+	for len(c.sessions) > 0 {
+		s := c.sessions[len(c.sessions)-1]
+		c.sessions = c.sessions[:len(c.sessions)-1]
+		if time.Since(s.lastUsed) < c.SessionIdle {
+			c.lock.Unlock()
+			return s, nil
+		}
+		//Server might have expired it
+	}
+	c.lock.Unlock()
+
+	//A lost registration only leaves a session unused till it
+	//expires, so register can be retried
+	resp, err := c.do(ctx, "register", nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{}
+	if _, err := fmt.Sscanf(resp.line, "SESSION %d", &s.id); err != nil {
+		return nil, responseError(resp.line)
+	}
+	return s, nil
+}
+
+//Return session to pool after use
+func (c *Client) putSession(s *session) {
+	s.lastUsed = time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.sessions) >= c.MaxIdle {
+		return //Left to expire on server
+	}
+	c.sessions = append(c.sessions, s)
+}
+
+//Unregister idle sessions so that server can forget them
+func (c *Client) closeSessions() {
+	c.lock.Lock()
+	sessions := c.sessions
+	c.sessions = nil
+	c.lock.Unlock()
+
+	for _, s := range sessions {
+		ctx, cancel := context.WithTimeout(context.Background(), c.DialTimeout)
+		c.do(ctx, fmt.Sprintf("unregister %d", s.id), nil, true)
+		cancel()
+	}
+}
@@ -0,0 +1,139 @@
+package kvclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+//A condition of a transaction
+type Compare struct {
+	line string
+}
+
+//Version of key compared with version. op is =, !=, < or >
+//A key which doesn't exist never matches
+func Version(key string, op string, version int64) Compare {
+	return Compare{fmt.Sprintf("version %s %s %d", key, op, version)}
+}
+
+//Key exists
+func Exists(key string) Compare {
+	return Compare{"exists " + key}
+}
+
+//Key doesn't exist
+func Missing(key string) Compare {
+	return Compare{"missing " + key}
+}
+
+//An operation of a transaction
+type Op struct {
+	kind  string
+	key   string
+	value []byte
+	exp   int64
+}
+
+//Store value of key, overwriting it if it exists
+func OpPut(key string, value []byte, exptime int64) Op {
+	return Op{kind: "put", key: key, value: value, exp: exptime}
+}
+
+//Remove key
+func OpDelete(key string) Op {
+	return Op{kind: "delete", key: key}
+}
+
+//Read key along with its version
+func OpGet(key string) Op {
+	return Op{kind: "get", key: key}
+}
+
+//Result of a transaction
+type TxnResponse struct {
+	Succeeded bool       //All compares held, so success ops were applied
+	Results   []OpResult //Of the ops applied, in order
+}
+
+type OpResult struct {
+	Version int64 //New version for put
+	Item    *Item //Key read by get, nil if it doesn't exist
+	Deleted bool  //Key was removed by delete
+}
+
+//Check compares and apply success ops if all hold, failure ops otherwise
+//Everything happens atomically, as one entry in the log
+func (c *Client) Txn(ctx context.Context, compares []Compare, success, failure []Op) (*TxnResponse, error) {
+
+	lines := []string{fmt.Sprintf("txn %d %d %d", len(compares), len(success), len(failure))}
+	for _, compare := range compares {
+		lines = append(lines, compare.line)
+	}
+	for _, op := range append(append([]Op{}, success...), failure...) {
+		if !validKey(op.key) {
+			return nil, ErrCommand
+		}
+		if op.kind != "put" {
+			lines = append(lines, op.kind+" "+op.key)
+			continue
+		}
+		if len(op.value) == 0 {
+			return nil, ErrCommand
+		}
+		lines = append(lines, fmt.Sprintf("put %s %d %d", op.key, op.exp, len(op.value)))
+		lines = append(lines, string(op.value))
+	}
+
+	//Lines go as one, data of puts is within
+	resp, err := c.doOnce(ctx, strings.Join(lines, "\r\n"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := &TxnResponse{}
+	var ops []Op
+	switch {
+	case strings.HasPrefix(resp.line, "TXN SUCCESS"):
+		txn.Succeeded, ops = true, success
+	case strings.HasPrefix(resp.line, "TXN FAILURE"):
+		ops = failure
+	default:
+		return nil, responseError(resp.line)
+	}
+	if len(resp.ops) != len(ops) {
+		return nil, errBadResponse
+	}
+
+	for i, op := range ops {
+		result, err := opResult(op, resp.ops[i])
+		if err != nil {
+			return nil, err
+		}
+		txn.Results = append(txn.Results, result)
+	}
+	return txn, nil
+}
+
+func opResult(op Op, resp response) (OpResult, error) {
+	switch op.kind {
+	case "put":
+		version, err := parseVersion(resp)
+		return OpResult{Version: version}, err
+
+	case "delete":
+		if resp.line == "ERR_NOT_FOUND" {
+			return OpResult{}, nil
+		}
+		if resp.line != "DELETED" {
+			return OpResult{}, responseError(resp.line)
+		}
+		return OpResult{Deleted: true}, nil
+	}
+
+	if resp.line == "ERR_NOT_FOUND" {
+		return OpResult{}, nil
+	}
+	item, err := parseItem(op.key, resp)
+	return OpResult{Item: item}, err
+}
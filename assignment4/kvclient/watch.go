@@ -0,0 +1,158 @@
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Watch can't resume since events from its revision are not kept anymore
+var ErrCompacted = errors.New("kvclient: revision compacted")
+
+//A change of a watched key
+type WatchEvent struct {
+	Type       string //put, delete or expire
+	Key        string
+	Value      []byte //For put
+	ExpiryTime int64  //For put
+	Revision   int64  //Lsn of the change, version of key after put
+	Err        error  //Set on the last event if watch failed
+}
+
+//Watch changes of key, or of all keys starting with prefix if key ends
+//with *. Changes from revision fromRevision are sent, or only new ones if
+//it is 0. Events are sent on the channel till ctx is done. If connection
+//breaks, watch resumes on another server from where it stopped.
+//If it can't resume, an event with Err is sent and channel is closed.
+func (c *Client) Watch(ctx context.Context, key string, fromRevision int64) <-chan WatchEvent {
+	events := make(chan WatchEvent)
+	go c.watch(ctx, key, fromRevision, events)
+	return events
+}
+
+func (c *Client) watch(ctx context.Context, key string, from int64, events chan WatchEvent) {
+	defer close(events)
+
+	if !validKey(key) {
+		sendEvent(ctx, events, WatchEvent{Err: ErrCommand})
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(attempt) * c.RetryDelay
+			if attempt > c.MaxRetries {
+				delay = time.Duration(c.MaxRetries) * c.RetryDelay
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		next, err := c.watchOnce(ctx, key, from, events)
+		if next > from {
+			from, attempt = next, 0 //Made progress, resume from there
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrCompacted || err == ErrCommand || err == ErrAuthFailed || err == ErrPermissionDenied || err == ErrAuthRequired {
+			sendEvent(ctx, events, WatchEvent{Err: err})
+			return
+		}
+	}
+}
+
+//Watch on one connection till it breaks
+//Returns revision to resume from
+func (c *Client) watchOnce(ctx context.Context, key string, from int64, events chan WatchEvent) (int64, error) {
+	addr := c.leaderAddr()
+	cn, err := c.dial(ctx, addr)
+	if err != nil {
+		c.forgetLeader(addr)
+		return from, err
+	}
+	defer cn.close()
+
+	//Unblock reads when ctx is done
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.netConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	line := "watch " + key
+	if from > 0 {
+		line += " " + strconv.FormatInt(from, 10)
+	}
+	resp, err := cn.exchange(line, nil)
+	if err != nil {
+		return from, err
+	}
+
+	fields := strings.Fields(resp.line)
+	switch {
+	case len(fields) == 2 && fields[0] == "WATCHING":
+		if from == 0 {
+			//Resume after what was current, if connection breaks
+			current, _ := strconv.ParseInt(fields[1], 10, 64)
+			from = current + 1
+		}
+	case len(fields) > 0 && fields[0] == "ERR_COMPACTED":
+		return from, ErrCompacted
+	default:
+		return from, responseError(resp.line)
+	}
+
+	for {
+		resp, err := cn.readResponse()
+		if err != nil {
+			return from, err
+		}
+
+		event, ok := parseEvent(resp)
+		if !ok {
+			if strings.HasPrefix(resp.line, "ERR_WATCH_LAGGED") {
+				return from, nil //Resume from where server stopped
+			}
+			return from, &ServerError{resp.line}
+		}
+
+		if !sendEvent(ctx, events, event) {
+			return from, ctx.Err()
+		}
+		from = event.Revision + 1
+	}
+}
+
+//EVENT <type> <key> <revision> [<exptime> <numbytes>]
+func parseEvent(resp response) (WatchEvent, bool) {
+	var event WatchEvent
+	if strings.HasPrefix(resp.line, "EVENT put ") {
+		var numbytes int64
+		_, err := fmt.Sscanf(resp.line, "EVENT put %s %d %d %d", &event.Key, &event.Revision, &event.ExpiryTime, &numbytes)
+		event.Type, event.Value = "put", resp.data
+		return event, err == nil && resp.data != nil
+	}
+
+	_, err := fmt.Sscanf(resp.line, "EVENT %s %s %d", &event.Type, &event.Key, &event.Revision)
+	return event, err == nil
+}
+
+func sendEvent(ctx context.Context, events chan WatchEvent, event WatchEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
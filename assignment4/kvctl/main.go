@@ -0,0 +1,786 @@
+package main
+
+import (
+	"assignment4/kvclient"
+	"assignment4/raft"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Command line client for the kvstore cluster
+//Runs one command given as arguments, or an interactive shell if none
+
+const HISTORY_FILE = ".kvctl_history"
+
+const usage = `Usage: kvctl [flags] [command]
+
+Commands:
+  get <key>
+  getm <key>
+  set <key> <value> [exptime]
+  cas <key> <version> <value> [exptime]
+  delete <key>
+  incr <key> [delta]
+  decr <key> [delta]
+  keys <prefix>
+  count <prefix>
+  watch <key> [from_revision]
+  lock <name> [ttl]
+  lock-status <name>
+  elect <name> [value]
+  namespace create <name> [maxkeys <n>] [maxbytes <n>] [rate <n>]
+  namespace quota <name> [maxkeys <n>] [maxbytes <n>] [rate <n>]
+  namespace delete <name>
+  stats [namespace]
+  user add|passwd <name> <password>
+  user delete <name>
+  user grant|revoke <name> <role>
+  role add|delete <role>
+  role grant <role> read|write|admin <key>
+  role revoke <role> <key>
+
+A value of "-" is read from stdin. A watched key ending with * watches
+all keys starting with the rest of it. Lock holds the lock till
+interrupted. Elect campaigns with value and stays leader till interrupted,
+or prints the leader as it changes if no value is given. Keys are in
+the namespace given with -n, default if not given. A granted key ending
+with * gives permission on all keys starting with the rest of it. If
+the cluster needs a login, -user is given and the password is taken
+from KVCTL_PASSWORD. Without a
+command, an interactive shell is started. In the shell, "history" lists
+earlier commands, "!!" runs the last one and "!<n>" runs command n.
+Commands with a password are not kept in history.
+
+Flags:
+`
+
+var (
+	configPath = flag.String("config", "config.json", "cluster config file")
+	output     = flag.String("o", "text", "output format: text or json")
+	timeout    = flag.Duration("timeout", 5*time.Second, "timeout for each command")
+	namespace  = flag.String("n", "", "namespace of keys, default if not given")
+	user       = flag.String("user", "", "user to log in as, password is in KVCTL_PASSWORD")
+	caFile     = flag.String("ca", "", "CA of server certificates, CAFile of config if not given")
+)
+
+//Seconds a lock or leadership lives after kvctl dies, if not given
+const DEFAULT_LOCK_TTL = 10
+
+var errUsage = errors.New("wrong arguments, see help")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output != "text" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "Output format must be text or json")
+		os.Exit(2)
+	}
+
+	client, err := newClient(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	if flag.NArg() == 0 {
+		repl(client)
+		return
+	}
+
+	if err := run(client, flag.Args()); err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+//Client for servers in cluster config
+func newClient(path string) (*kvclient.Client, error) {
+	config, err := raft.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("No servers in config file " + path)
+	}
+
+	client := kvclient.NewFromConfig(&config)
+	client.Namespace = *namespace
+	client.User, client.Password = *user, os.Getenv("KVCTL_PASSWORD")
+
+	if config.ClientTLS || *caFile != "" {
+		path := *caFile
+		if path == "" {
+			path = config.CAFile
+		}
+		if client.TLSConfig, err = kvclient.NewTLSConfig(path); err != nil {
+			return nil, errors.New("Couldn't load CA: " + err.Error())
+		}
+	}
+	return client, nil
+}
+
+//Run one command
+func run(client *kvclient.Client, args []string) error {
+
+	if args[0] == "watch" {
+		if len(args) != 2 && len(args) != 3 {
+			return errUsage
+		}
+		from := int64(0)
+		if len(args) == 3 {
+			var err error
+			if from, err = strconv.ParseInt(args[2], 10, 64); err != nil || from < 0 {
+				return errUsage
+			}
+		}
+		return watch(client, args[1], from)
+	}
+
+	if args[0] == "lock" || args[0] == "elect" {
+		if len(args) != 2 && len(args) != 3 {
+			return errUsage
+		}
+		if args[0] == "elect" {
+			return elect(client, args[1:])
+		}
+
+		ttl := int64(DEFAULT_LOCK_TTL)
+		if len(args) == 3 {
+			var err error
+			if ttl, err = strconv.ParseInt(args[2], 10, 64); err != nil || ttl <= 0 {
+				return errUsage
+			}
+		}
+		return holdLock(client, args[1], ttl)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return errUsage
+		}
+		value, err := client.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		printItem(&kvclient.Item{Key: args[1], Value: value}, false)
+
+	case "getm":
+		if len(args) != 2 {
+			return errUsage
+		}
+		item, err := client.GetMeta(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		printItem(item, true)
+
+	case "set":
+		if len(args) != 3 && len(args) != 4 {
+			return errUsage
+		}
+		value, exptime, err := valueArgs(args[2:])
+		if err != nil {
+			return err
+		}
+		version, err := client.Set(ctx, args[1], value, exptime)
+		if err != nil {
+			return err
+		}
+		printVersion(args[1], version)
+
+	case "cas":
+		if len(args) != 4 && len(args) != 5 {
+			return errUsage
+		}
+		version, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		value, exptime, err := valueArgs(args[3:])
+		if err != nil {
+			return err
+		}
+		version, err = client.CAS(ctx, args[1], version, value, exptime)
+		if err != nil {
+			return err
+		}
+		printVersion(args[1], version)
+
+	case "delete":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := client.Delete(ctx, args[1]); err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{"key": args[1], "deleted": true})
+		} else {
+			fmt.Println("DELETED")
+		}
+
+	case "incr", "decr":
+		if len(args) != 2 && len(args) != 3 {
+			return errUsage
+		}
+		delta := int64(1)
+		if len(args) == 3 {
+			var err error
+			if delta, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+				return errUsage
+			}
+		}
+		counter := client.Incr
+		if args[0] == "decr" {
+			counter = client.Decr
+		}
+		number, err := counter(ctx, args[1], delta, nil)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{"key": args[1], "value": number})
+		} else {
+			fmt.Println(number)
+		}
+
+	case "lock-status":
+		if len(args) != 2 {
+			return errUsage
+		}
+		status, err := client.LockStatus(ctx, args[1])
+		if err == kvclient.ErrNotFound {
+			status, err = &kvclient.LockStatus{}, nil //Free, holder 0
+		}
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{"lock": args[1], "holder": status.Holder, "token": status.Token, "waiters": status.Waiters})
+		} else {
+			fmt.Printf("holder %d token %d waiters %d\n", status.Holder, status.Token, status.Waiters)
+		}
+
+	case "keys":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return listKeys(ctx, client, args[1])
+
+	case "count":
+		if len(args) != 2 {
+			return errUsage
+		}
+		result, err := client.Prefix(ctx, args[1], "", &kvclient.RangeOptions{CountOnly: true})
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{"prefix": args[1], "count": result.Count})
+		} else {
+			fmt.Println(result.Count)
+		}
+
+	case "namespace":
+		return namespaceCommand(ctx, client, args[1:])
+
+	case "user", "role":
+		if err := accessCommand(ctx, client, args); err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{args[0]: args[2], args[1]: true})
+		} else {
+			fmt.Println("OK")
+		}
+
+	case "stats":
+		if len(args) > 2 {
+			return errUsage
+		}
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		stats, err := client.Stats(ctx, name)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			printJSON(map[string]interface{}{"namespace": stats.Name, "keys": stats.Keys, "bytes": stats.Bytes,
+				"requests": stats.Requests, "throttled": stats.Throttled,
+				"maxkeys": stats.Quota.MaxKeys, "maxbytes": stats.Quota.MaxBytes, "rate": stats.Quota.Rate})
+		} else {
+			fmt.Printf("namespace %s\nkeys %d/%s\nbytes %d/%s\nrequests %d (%d throttled, rate %s)\n",
+				stats.Name, stats.Keys, limit(stats.Quota.MaxKeys), stats.Bytes, limit(stats.Quota.MaxBytes),
+				stats.Requests, stats.Throttled, limit(stats.Quota.Rate))
+		}
+
+	default:
+		return errors.New("unknown command " + strconv.Quote(args[0]))
+	}
+
+	return nil
+}
+
+//create|quota <name> [maxkeys <n>] [maxbytes <n>] [rate <n>], delete <name>
+func namespaceCommand(ctx context.Context, client *kvclient.Client, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	var err error
+	switch args[0] {
+	case "create", "quota":
+		quota, er := quotaArgs(args[2:])
+		if er != nil {
+			return er
+		}
+		if args[0] == "create" {
+			err = client.CreateNamespace(ctx, args[1], quota)
+		} else {
+			err = client.SetQuota(ctx, args[1], quota)
+		}
+	case "delete":
+		if len(args) != 2 {
+			return errUsage
+		}
+		err = client.DeleteNamespace(ctx, args[1])
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(map[string]interface{}{"namespace": args[1], args[0]: true})
+	} else {
+		fmt.Println("OK")
+	}
+	return nil
+}
+
+//user and role commands
+func accessCommand(ctx context.Context, client *kvclient.Client, args []string) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+
+	switch args[0] + " " + args[1] + " " + strconv.Itoa(len(args)) {
+	case "user add 4":
+		return client.AddUser(ctx, args[2], args[3])
+	case "user passwd 4":
+		return client.ChangePassword(ctx, args[2], args[3])
+	case "user delete 3":
+		return client.DeleteUser(ctx, args[2])
+	case "user grant 4":
+		return client.GrantRole(ctx, args[2], args[3])
+	case "user revoke 4":
+		return client.RevokeRole(ctx, args[2], args[3])
+	case "role add 3":
+		return client.AddRole(ctx, args[2])
+	case "role delete 3":
+		return client.DeleteRole(ctx, args[2])
+	case "role grant 5":
+		return client.GrantPermission(ctx, args[2], args[3], args[4])
+	case "role revoke 4":
+		return client.RevokePermission(ctx, args[2], args[3])
+	}
+	return errUsage
+}
+
+//[maxkeys <n>] [maxbytes <n>] [rate <n>]
+func quotaArgs(args []string) (*kvclient.Quota, error) {
+	if len(args)%2 != 0 {
+		return nil, errUsage
+	}
+
+	quota := &kvclient.Quota{}
+	for i := 0; i < len(args); i += 2 {
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			return nil, errUsage
+		}
+		switch args[i] {
+		case "maxkeys":
+			quota.MaxKeys = n
+		case "maxbytes":
+			quota.MaxBytes = n
+		case "rate":
+			quota.Rate = n
+		default:
+			return nil, errUsage
+		}
+	}
+	return quota, nil
+}
+
+//Quota as text, 0 is no limit
+func limit(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+//<value> [exptime], value "-" is read from stdin
+func valueArgs(args []string) ([]byte, int64, error) {
+	value := []byte(args[0])
+	if args[0] == "-" {
+		var err error
+		if value, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	exptime := int64(0)
+	if len(args) > 1 {
+		var err error
+		exptime, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil || exptime < 0 {
+			return nil, 0, errUsage
+		}
+	}
+	return value, exptime, nil
+}
+
+//Print all keys with prefix, a page at a time
+func listKeys(ctx context.Context, client *kvclient.Client, prefix string) error {
+	cursor := ""
+	for {
+		result, err := client.Prefix(ctx, prefix, cursor, &kvclient.RangeOptions{KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Items {
+			if *output == "json" {
+				printJSON(map[string]interface{}{"key": item.Key})
+			} else {
+				fmt.Println(item.Key)
+			}
+		}
+		if result.Next == "" {
+			return nil
+		}
+		cursor = result.Next
+	}
+}
+
+//Print changes of key as they happen, till interrupted
+func watch(client *kvclient.Client, key string, from int64) error {
+	for event := range client.Watch(context.Background(), key, from) {
+		if event.Err != nil {
+			return event.Err
+		}
+		printEvent(event)
+	}
+	return nil
+}
+
+//Context which is done on interrupt (Ctrl-C)
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return ctx, cancel
+}
+
+//Take lock and hold it till interrupted
+func holdLock(client *kvclient.Client, name string, ttl int64) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	lock, err := client.Lock(ctx, name, ttl)
+	if err != nil {
+		return err
+	}
+	printLock(name, lock.Token)
+
+	select {
+	case <-ctx.Done():
+	case <-lock.Lost():
+		return errors.New("lock lost")
+	}
+
+	unlockCtx, unlockCancel := context.WithTimeout(context.Background(), *timeout)
+	defer unlockCancel()
+	return lock.Unlock(unlockCtx)
+}
+
+//Campaign with value and stay leader till interrupted, or print leader
+//values as they change if no value is given
+func elect(client *kvclient.Client, args []string) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	election := client.NewElection(args[0])
+	if len(args) == 1 {
+		for value := range election.Observe(ctx) {
+			printLeader(args[0], value)
+		}
+		return nil
+	}
+
+	if err := election.Campaign(ctx, []byte(args[1]), DEFAULT_LOCK_TTL); err != nil {
+		return err
+	}
+	printLock(args[0], election.Token())
+
+	select {
+	case <-ctx.Done():
+	case <-election.Lost():
+		return errors.New("leadership lost")
+	}
+
+	resignCtx, resignCancel := context.WithTimeout(context.Background(), *timeout)
+	defer resignCancel()
+	return election.Resign(resignCtx)
+}
+
+// --------------------------------------
+// Interactive shell
+
+func repl(client *kvclient.Client) {
+
+	history := loadHistory()
+	input := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("Connected to cluster in " + *configPath + ". Type help for commands.")
+
+	for {
+		fmt.Print("kvctl> ")
+		if !input.Scan() {
+			fmt.Println()
+			return
+		}
+
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			continue
+		}
+
+		//History expansion
+		if strings.HasPrefix(line, "!") {
+			expanded, ok := expandHistory(history, line)
+			if !ok {
+				fmt.Println("No such command in history")
+				continue
+			}
+			line = expanded
+			fmt.Println(line)
+		}
+
+		switch line {
+		case "exit", "quit":
+			return
+		case "help":
+			fmt.Print(usage)
+			continue
+		case "history":
+			for i, cmd := range history {
+				fmt.Printf("%4d  %s\n", i+1, cmd)
+			}
+			continue
+		}
+
+		args, err := splitArgs(line)
+		if !hasPassword(args) {
+			history = append(history, line)
+			saveHistory(line)
+		}
+		if err == nil {
+			err = run(client, args)
+		}
+		if err != nil {
+			printError(err)
+		}
+	}
+}
+
+//!! for last command, !n for nth command
+func expandHistory(history []string, line string) (string, bool) {
+	if len(history) == 0 {
+		return "", false
+	}
+	if line == "!!" {
+		return history[len(history)-1], true
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", false
+	}
+	return history[n-1], true
+}
+
+//Commands with a password are kept out of history, which is saved to disk
+func hasPassword(args []string) bool {
+	return len(args) >= 2 && args[0] == "user" && (args[1] == "add" || args[1] == "passwd")
+}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, HISTORY_FILE)
+}
+
+func loadHistory() []string {
+	data, err := ioutil.ReadFile(historyPath())
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+func saveHistory(line string) {
+	file, err := os.OpenFile(historyPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.WriteString(line + "\n")
+}
+
+//Split line into words, words can be quoted with " to have spaces
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word []rune
+	inWord, quoted := false, false
+
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				args = append(args, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return args, nil
+}
+
+// --------------------------------------
+// Output
+
+func printItem(item *kvclient.Item, meta bool) {
+	if *output == "json" {
+		obj := map[string]interface{}{"key": item.Key, "value": string(item.Value)}
+		if meta {
+			obj["version"] = item.Version
+			obj["expiry"] = item.ExpiryTime
+		}
+		printJSON(obj)
+		return
+	}
+
+	if meta {
+		fmt.Printf("version %d expiry %d\n", item.Version, item.ExpiryTime)
+	}
+	fmt.Println(string(item.Value))
+}
+
+func printVersion(key string, version int64) {
+	if *output == "json" {
+		printJSON(map[string]interface{}{"key": key, "version": version})
+	} else {
+		fmt.Println("OK", version)
+	}
+}
+
+func printEvent(event kvclient.WatchEvent) {
+	if *output == "json" {
+		obj := map[string]interface{}{"event": event.Type, "key": event.Key, "revision": event.Revision}
+		if event.Type == "put" {
+			obj["value"] = string(event.Value)
+			obj["expiry"] = event.ExpiryTime
+		}
+		printJSON(obj)
+		return
+	}
+
+	fmt.Printf("%s %s revision %d\n", event.Type, event.Key, event.Revision)
+	if event.Type == "put" {
+		fmt.Println(string(event.Value))
+	}
+}
+
+func printLock(name string, token int64) {
+	if *output == "json" {
+		printJSON(map[string]interface{}{"lock": name, "token": token})
+	} else {
+		fmt.Println("LOCKED token", token)
+	}
+}
+
+func printLeader(name string, value []byte) {
+	if *output == "json" {
+		obj := map[string]interface{}{"election": name, "leader": nil}
+		if value != nil {
+			obj["leader"] = string(value)
+		}
+		printJSON(obj)
+		return
+	}
+
+	if value == nil {
+		fmt.Println("no leader")
+	} else {
+		fmt.Println(string(value))
+	}
+}
+
+func printError(err error) {
+	if *output == "json" {
+		printJSON(map[string]interface{}{"error": err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+	}
+}
+
+func printJSON(obj interface{}) {
+	data, _ := json.Marshal(obj)
+	fmt.Println(string(data))
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Users, roles and permissions on keys. A client logs in on its
+//connection with auth, and its commands are checked against the roles
+//of its user.
+//
+//	auth <user> <password>\r\n
+//	user add <user> <password>\r\n
+//	user delete <user>\r\n
+//	user passwd <user> <password>\r\n
+//	user grant <user> <role>\r\n
+//	user revoke <user> <role>\r\n
+//	role add <role>\r\n
+//	role delete <role>\r\n
+//	role grant <role> read|write|admin <key>\r\n
+//	role revoke <role> <key>\r\n
+//
+//Authentication is off till a user named root is added, who has the
+//built in root role which allows everything. Users with the root role
+//manage users, roles and namespaces. A role is granted read, write or
+//admin on a key, or on all keys with a prefix when the key ends with *,
+//in the namespace of the connection. Write allows read, and admin allows
+//write and granting permissions on keys within it.
+//
+//Users and roles are changed through the log, so all servers have them.
+//Passwords are salted and hashed before they are appended, and a server
+//checks auth with its own copy, without the log.
+//
+//A follower forwarding commands of a logged in client to the leader
+//doesn't keep the password. It logs in on the leader with a token,
+//
+//	authtoken <user> <expires> <mac>\r\n
+//
+//where mac is an HMAC of user and expiry time (unix seconds) keyed with
+//the password hash of user, which only servers have. A token stops
+//working when it expires or the password is changed.
+
+const ROOT_USER = "root"
+const ROOT_ROLE = "root"
+
+//Rounds of hashing a password, to make guessing it slow
+const PASSWORD_ITERATIONS = 10000
+
+//Seconds a login token is good for, long enough for clocks of servers
+//to differ a little. Followers make a new one after half of it
+const AUTH_TOKEN_TTL = 300
+
+const (
+	PERM_READ = 1 + iota
+	PERM_WRITE
+	PERM_ADMIN
+)
+
+var permissionLevels = map[string]int{"read": PERM_READ, "write": PERM_WRITE, "admin": PERM_ADMIN}
+
+//What a client command needs: read or write on its key, to be logged in,
+//the root role, admin on the key it grants, or to be the user itself
+var commandPermissions = map[string]string{
+	"get": "read", "getm": "read", "ttl": "read", "lock-status": "read", "range": "range",
+	"set": "write", "cas": "write", "put": "write", "replace": "write", "delete": "write",
+	"casdelete": "write", "touch": "write", "incr": "write", "lock": "write", "unlock": "write",
+	"txn":        "txn",
+	"leasegrant": "login", "leasekeepalive": "login", "leaserevoke": "login",
+	"register": "login", "unregister": "login", "stats": "login",
+	"namespacecreate": "root", "namespacequota": "root", "namespacedelete": "root",
+	"useradd": "root", "userdelete": "root", "usergrant": "root", "userrevoke": "root",
+	"roleadd": "root", "roledelete": "root",
+	"rolegrant": "grant", "rolerevoke": "grant",
+	"userpasswd": "self",
+}
+
+type user struct {
+	password string          //salt:hash
+	roles    map[string]bool //Names of roles
+}
+
+type role struct {
+	grants map[string]int //Permission by key as stored, ending with * for prefix
+}
+
+//Users and roles, changed by kvStoreHandler and read by connections
+type accessTable struct {
+	lock  sync.Mutex
+	users map[string]*user
+	roles map[string]*role
+}
+
+var acl = newAccessTable()
+
+func newAccessTable() *accessTable {
+	return &accessTable{users: make(map[string]*user), roles: make(map[string]*role)}
+}
+
+//auth <user> <password>
+func parseAuth(fields []string) (Command, string) {
+	if len(fields) != 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+	return Command{Cmd: "auth", Key: fields[1], Value: fields[2]}, ""
+}
+
+//authtoken <user> <expires> <mac>
+func parseAuthToken(fields []string) (Command, string) {
+	if len(fields) != 4 {
+		return Command{}, ERR_CMD_ERR
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return Command{}, ERR_CMD_ERR
+	}
+	return Command{Cmd: "authtoken", Key: fields[1], ExpiryTime: expires, Value: fields[3]}, ""
+}
+
+//user add|delete|passwd|grant|revoke <user> [<password>|<role>]
+func parseUser(fields []string) (Command, string) {
+	if len(fields) < 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Cmd: "user" + fields[1], Key: fields[2]}
+	switch fields[1] {
+	case "delete":
+		if len(fields) != 3 {
+			return Command{}, ERR_CMD_ERR
+		}
+	case "add", "passwd":
+		if len(fields) != 4 {
+			return Command{}, ERR_CMD_ERR
+		}
+		//Only the hash goes in the log
+		command.Value = newPasswordHash(fields[3])
+	case "grant", "revoke":
+		if len(fields) != 4 {
+			return Command{}, ERR_CMD_ERR
+		}
+		command.Role = fields[3]
+	default:
+		return Command{}, ERR_CMD_ERR
+	}
+	return command, ""
+}
+
+//role add|delete <role>, role grant <role> <permission> <key>, role revoke <role> <key>
+func parseRole(fields []string) (Command, string) {
+	if len(fields) < 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Cmd: "role" + fields[1], Role: fields[2]}
+	switch {
+	case (fields[1] == "add" || fields[1] == "delete") && len(fields) == 3:
+	case fields[1] == "grant" && len(fields) == 5:
+		if _, ok := permissionLevels[fields[3]]; !ok {
+			return Command{}, ERR_CMD_ERR
+		}
+		command.Permission, command.Key = fields[3], fields[4]
+	case fields[1] == "revoke" && len(fields) == 4:
+		command.Key = fields[3]
+	default:
+		return Command{}, ERR_CMD_ERR
+	}
+	return command, ""
+}
+
+//salt:hash of password with a new random salt
+func newPasswordHash(password string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		log.Print("Couldn't make salt: " + err.Error())
+	}
+	return hex.EncodeToString(salt) + ":" + passwordHash(password, hex.EncodeToString(salt))
+}
+
+//PBKDF2 with HMAC-SHA256, one block long
+func passwordHash(password, salt string) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(salt))
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	sum := append([]byte(nil), u...)
+	for i := 1; i < PASSWORD_ITERATIONS; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range sum {
+			sum[j] ^= u[j]
+		}
+	}
+	return hex.EncodeToString(sum)
+}
+
+//Whether clients must log in. Must hold lock
+func (t *accessTable) enabled() bool {
+	_, ok := t.users[ROOT_USER]
+	return ok
+}
+
+//Check password of name. Fails the same way for unknown users
+func (t *accessTable) login(name, password string) bool {
+	t.lock.Lock()
+	u, ok := t.users[name]
+	stored := "unknown:" //Hash anyway, so that unknown users take as long
+	if ok {
+		stored = u.password
+	}
+	t.lock.Unlock()
+
+	i := strings.Index(stored, ":")
+	hash := passwordHash(password, stored[:i])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(stored[i+1:])) == 1 && ok
+}
+
+//MAC of a login token of name, "" if there is no such user
+//Must hold lock
+func (t *accessTable) tokenMAC(name string, expires int64) string {
+	u, ok := t.users[name]
+	if !ok {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(u.password))
+	mac.Write([]byte(name + " " + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//authtoken command logging in name on another server, and when it
+//expires. False if there is no such user
+func (t *accessTable) loginToken(name string) (string, int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	expires := time.Now().Unix() + AUTH_TOKEN_TTL
+	mac := t.tokenMAC(name, expires)
+	if mac == "" {
+		return "", 0, false
+	}
+	return "authtoken " + name + " " + strconv.FormatInt(expires, 10) + " " + mac + "\r\n", expires, true
+}
+
+//Check login token of name, made by another server
+func (t *accessTable) checkToken(name string, expires int64, mac string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if time.Now().Unix() > expires {
+		return false
+	}
+	want := t.tokenMAC(name, expires)
+	return want != "" && subtle.ConstantTimeCompare([]byte(want), []byte(mac)) == 1
+}
+
+//Check that user can read key (or keys with a prefix, ending with *)
+//without the log, for watches
+func (t *accessTable) canRead(name, key string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.enabled() {
+		return ""
+	}
+	u, ok := t.users[name]
+	if !ok {
+		return ERR_AUTH_REQUIRED
+	}
+	if !u.roles[ROOT_ROLE] && !t.covers(u, PERM_READ, key) {
+		return ERR_PERMISSION_DENIED
+	}
+	return ""
+}
+
+//Whether name can act for any user: authentication is off, or name
+//has the root role
+func (t *accessTable) isRoot(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.enabled() {
+		return true
+	}
+	u, ok := t.users[name]
+	return ok && u.roles[ROOT_ROLE]
+}
+
+//Whether a role of u has level on key, or on all keys of a prefix
+//ending with *. Must hold lock
+func (t *accessTable) covers(u *user, level int, key string) bool {
+	prefix := strings.HasSuffix(key, "*")
+	target := strings.TrimSuffix(key, "*")
+
+	for name := range u.roles {
+		r, ok := t.roles[name]
+		if !ok {
+			continue
+		}
+		for granted, l := range r.grants {
+			if l < level {
+				continue
+			}
+			if strings.HasSuffix(granted, "*") && strings.HasPrefix(target, strings.TrimSuffix(granted, "*")) {
+				return true
+			}
+			if !prefix && granted == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Whether a role of u can read all keys from start upto end
+//Must hold lock
+func (t *accessTable) coversRange(u *user, start, end string) bool {
+	for name := range u.roles {
+		r, ok := t.roles[name]
+		if !ok {
+			continue
+		}
+		for granted, l := range r.grants {
+			if l < PERM_READ || !strings.HasSuffix(granted, "*") {
+				continue
+			}
+			prefix := strings.TrimSuffix(granted, "*")
+			last := prefixEnd(prefix)
+			if strings.HasPrefix(start, prefix) && (last == "" || end != "" && end <= last) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Check the user of a client command may run it
+//Done before anything else, so that a denied command learns nothing
+func (store *kvStore) authorize(command Command) string {
+	need, ok := commandPermissions[command.Cmd]
+	if !ok {
+		return "" //Not from a client
+	}
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	if !acl.enabled() {
+		return ""
+	}
+	u, ok := acl.users[command.User]
+	if !ok {
+		return ERR_AUTH_REQUIRED
+	}
+	if u.roles[ROOT_ROLE] {
+		return ""
+	}
+
+	scoped := scopeCommand(command)
+	allowed := false
+	switch need {
+	case "login":
+		allowed = true
+	case "self":
+		allowed = command.Key == command.User
+	case "read", "write":
+		allowed = acl.covers(u, permissionLevels[need], scoped.Key)
+	case "grant":
+		allowed = acl.covers(u, PERM_ADMIN, scoped.Key)
+	case "range":
+		allowed = acl.coversRange(u, scoped.Key, scoped.RangeEnd)
+	case "txn":
+		allowed = true
+		for _, compare := range scoped.Compares {
+			allowed = allowed && acl.covers(u, PERM_READ, compare.Key)
+		}
+		for _, op := range append(scoped.Success, scoped.Failure...) {
+			level := PERM_WRITE
+			if op.Cmd == "getm" {
+				level = PERM_READ
+			}
+			allowed = allowed && acl.covers(u, level, op.Key)
+		}
+	}
+
+	if !allowed {
+		return ERR_PERMISSION_DENIED
+	}
+	return ""
+}
+
+//Apply a user or role command
+func (t *accessTable) change(command Command) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u, userFound := t.users[command.Key]
+	r, roleFound := t.roles[command.Role]
+
+	switch command.Cmd {
+	case "useradd":
+		if userFound {
+			return ERR_VERSION
+		}
+		u = &user{password: command.Value, roles: make(map[string]bool)}
+		if command.Key == ROOT_USER {
+			u.roles[ROOT_ROLE] = true
+			log.Print("Authentication enabled")
+		}
+		t.users[command.Key] = u
+
+	case "userdelete":
+		if !userFound {
+			return ERR_NOT_FOUND
+		}
+		delete(t.users, command.Key)
+		if command.Key == ROOT_USER {
+			log.Print("Authentication disabled")
+		}
+
+	case "userpasswd":
+		if !userFound {
+			return ERR_NOT_FOUND
+		}
+		u.password = command.Value
+
+	case "usergrant":
+		if !userFound || !roleFound && command.Role != ROOT_ROLE {
+			return ERR_NOT_FOUND
+		}
+		u.roles[command.Role] = true
+
+	case "userrevoke":
+		if !userFound || !u.roles[command.Role] {
+			return ERR_NOT_FOUND
+		}
+		if command.Key == ROOT_USER && command.Role == ROOT_ROLE {
+			return ERR_CMD_ERR //Root is always root
+		}
+		delete(u.roles, command.Role)
+
+	case "roleadd":
+		if roleFound || command.Role == ROOT_ROLE {
+			return ERR_VERSION
+		}
+		t.roles[command.Role] = &role{grants: make(map[string]int)}
+
+	case "roledelete":
+		if !roleFound {
+			return ERR_NOT_FOUND
+		}
+		delete(t.roles, command.Role)
+		for _, u := range t.users {
+			delete(u.roles, command.Role)
+		}
+
+	case "rolegrant":
+		if !roleFound {
+			return ERR_NOT_FOUND
+		}
+		r.grants[scopedKey(command.Namespace, command.Key)] = permissionLevels[command.Permission]
+
+	case "rolerevoke":
+		key := scopedKey(command.Namespace, command.Key)
+		if !roleFound || r.grants[key] == 0 {
+			return ERR_NOT_FOUND
+		}
+		delete(r.grants, key)
+	}
+	return "OK"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//Access table with root and a user bob who can read keys starting with a
+func testAccessTable() *accessTable {
+	t := newAccessTable()
+	t.change(Command{Cmd: "useradd", Key: ROOT_USER, Value: newPasswordHash("secret")})
+	t.change(Command{Cmd: "useradd", Key: "bob", Value: newPasswordHash("pw")})
+	t.change(Command{Cmd: "roleadd", Role: "reader"})
+	t.change(Command{Cmd: "rolegrant", Role: "reader", Permission: "read", Key: "a*"})
+	t.change(Command{Cmd: "usergrant", Key: "bob", Role: "reader"})
+	return t
+}
+
+func TestLoginToken(t *testing.T) {
+	table := testAccessTable()
+
+	line, expires, ok := table.loginToken("bob")
+	if !ok || strings.Contains(line, "pw") {
+		t.Fatalf("got %q %v", line, ok)
+	}
+	command, errStr := parseInput(strings.TrimSuffix(line, "\r\n"))
+	if errStr != "" || command.Cmd != "authtoken" || command.ExpiryTime != expires {
+		t.Fatalf("token line %q parsed as %+v %q", line, command, errStr)
+	}
+
+	if !table.checkToken("bob", expires, command.Value) {
+		t.Error("valid token rejected")
+	}
+	if table.checkToken(ROOT_USER, expires, command.Value) {
+		t.Error("token of bob accepted for root")
+	}
+	if table.checkToken("bob", expires+1, command.Value) {
+		t.Error("token accepted with another expiry")
+	}
+	if _, _, ok := table.loginToken("nobody"); ok {
+		t.Error("token made for unknown user")
+	}
+
+	expired := expires - 2*AUTH_TOKEN_TTL
+	if table.checkToken("bob", expired, table.tokenMAC("bob", expired)) {
+		t.Error("expired token accepted")
+	}
+
+	//Changing password makes old tokens useless
+	table.change(Command{Cmd: "userpasswd", Key: "bob", Value: newPasswordHash("new")})
+	if table.checkToken("bob", expires, command.Value) {
+		t.Error("token accepted after password change")
+	}
+}
+
+func TestParseAuthToken(t *testing.T) {
+	for _, line := range []string{"authtoken bob", "authtoken bob x mac", "authtoken bob 1 mac extra"} {
+		if _, errStr := parseInput(line); errStr != ERR_CMD_ERR {
+			t.Errorf("%q: got %q, want %q", line, errStr, ERR_CMD_ERR)
+		}
+	}
+	command, errStr := parseInput("authtoken bob " + strconv.Itoa(100) + " mac")
+	if errStr != "" || command.Key != "bob" || command.ExpiryTime != 100 || command.Value != "mac" {
+		t.Errorf("got %+v %q", command, errStr)
+	}
+}
+
+func TestWatchRecheck(t *testing.T) {
+	defer func(old *accessTable) { acl = old }(acl)
+	acl = testAccessTable()
+
+	w, _, errStr := hub.watch(scopedKey("", "a*"), "bob", 0)
+	if errStr != "" {
+		t.Fatal(errStr)
+	}
+	defer hub.cancel(w)
+
+	hub.recheck()
+	if w.denied != "" {
+		t.Fatalf("watch dropped while bob can read: %q", w.denied)
+	}
+
+	acl.change(Command{Cmd: "userrevoke", Key: "bob", Role: "reader"})
+	hub.recheck()
+	if w.denied != ERR_PERMISSION_DENIED {
+		t.Errorf("got %q, want %q", w.denied, ERR_PERMISSION_DENIED)
+	}
+	if _, ok := <-w.events; ok {
+		t.Error("events of dropped watch not closed")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"log"
+	"time"
+)
+
+//Settings which change what commands do, MaxMemory, EvictionPolicy and
+//SessionTimeout, must be the same on all replicas. Config of servers,
+//with its environment overrides, can differ, so replicas don't read
+//them from config while applying. The leader appends a settings
+//command with those of its config whenever they differ from the ones
+//applied, and all replicas take them from the log. Till the first one
+//is applied, there is no memory limit and sessions last
+//DEFAULT_SESSION_TIMEOUT.
+
+type clusterSettings struct {
+	maxMemory      int64  //Bytes, 0 for no limit
+	evictionPolicy string //Never "", reject if not given
+	sessionTimeout int64  //Seconds, 0 for default
+}
+
+func defaultSettings() clusterSettings {
+	return clusterSettings{evictionPolicy: "reject"}
+}
+
+//Settings as given in config of this server
+func configSettings() clusterSettings {
+	return settingsOf(Command{Length: raft.ClusterInfo.MaxMemory, Value: raft.ClusterInfo.EvictionPolicy,
+		ExpiryTime: raft.ClusterInfo.SessionTimeout})
+}
+
+//Settings carried by a settings command
+func settingsOf(command Command) clusterSettings {
+	s := clusterSettings{command.Length, command.Value, command.ExpiryTime}
+	if s.maxMemory < 0 {
+		s.maxMemory = 0
+	}
+	if s.evictionPolicy == "" {
+		s.evictionPolicy = "reject"
+	}
+	if s.sessionTimeout < 0 {
+		s.sessionTimeout = 0
+	}
+	return s
+}
+
+func (s clusterSettings) command() Command {
+	return Command{Cmd: "settings", Length: s.maxMemory, Value: s.evictionPolicy, ExpiryTime: s.sessionTimeout}
+}
+
+//Have evictor append settings of config if they differ from the ones
+//applied. Sent only to the leader, by evictor
+func (store *kvStore) checkSettings() {
+	want := configSettings()
+	if want == store.settings || time.Since(store.settingsProposed) < EVICT_RETRY_INTERVAL {
+		return
+	}
+
+	select {
+	case store.victims <- []Command{want.command()}:
+		store.settingsProposed = time.Now()
+	default:
+		//Evictor is busy, tried again on next check
+	}
+}
+
+func (store *kvStore) applySettings(command Command) {
+	s := settingsOf(command)
+	if !validEvictionPolicy(s.evictionPolicy) {
+		log.Print("Unknown EvictionPolicy " + s.evictionPolicy + " in log, ignored")
+		return
+	}
+	store.settings = s
+	store.sessions.timeout = s.sessionTimeout
+	store.settingsProposed = time.Time{}
+	log.Print(fmt.Sprintf("Settings: MaxMemory %d, EvictionPolicy %s, SessionTimeout %d",
+		s.maxMemory, s.evictionPolicy, s.sessionTimeout))
+}
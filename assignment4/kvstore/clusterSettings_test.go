@@ -0,0 +1,56 @@
+package main
+
+import (
+	"assignment4/raft"
+	"strings"
+	"testing"
+)
+
+func TestSettingsFromLog(t *testing.T) {
+	defer func(config raft.ClusterConfig) { raft.ClusterInfo = config }(raft.ClusterInfo)
+	raft.ClusterInfo.MaxMemory = 1000
+	raft.ClusterInfo.EvictionPolicy = "lru"
+	raft.ClusterInfo.SessionTimeout = 30
+
+	//Config alone changes nothing, leader proposes it through the log
+	store := newTestStore()
+	if store.settings != defaultSettings() {
+		t.Fatalf("got %+v before any settings entry", store.settings)
+	}
+	store.checkSettings()
+	var commands []Command
+	select {
+	case commands = <-store.victims:
+	default:
+		t.Fatal("leader didn't propose settings of its config")
+	}
+	store.checkSettings()
+	if len(store.victims) != 0 {
+		t.Error("settings proposed again before retry interval")
+	}
+
+	store.applySettings(commands[0])
+	if store.settings != configSettings() || store.sessions.timeout != 30 {
+		t.Errorf("got %+v, timeout %d after applying", store.settings, store.sessions.timeout)
+	}
+	store.checkSettings()
+	if len(store.victims) != 0 {
+		t.Error("settings proposed though already applied")
+	}
+}
+
+func TestMemoryCeiling(t *testing.T) {
+	store := newTestStore()
+	store.applySettings(Command{Cmd: "settings", Length: 350, Value: "lru"})
+
+	//Over MaxMemory is fine till evictions are applied, up to the ceiling
+	big := strings.Repeat("x", 60) //126 bytes with key and overhead
+	for _, key := range []string{"a", "b", "c"} {
+		if response := store.setCas(Command(putOp(key, big, 0))); !strings.HasPrefix(response, "OK") {
+			t.Fatalf("%s: got %q", key, response)
+		}
+	}
+	if response := store.setCas(Command(putOp("d", big, 0))); response != ERR_OUT_OF_MEMORY {
+		t.Errorf("got %q over ceiling, want %q", response, ERR_OUT_OF_MEMORY)
+	}
+}
@@ -3,128 +3,440 @@ package main
 import (
 	"assignment4/raft"
 	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
-var lock sync.Mutex //Lock for adding to client map
+//Max commands of a connection waiting for response,
+//reading from client stops till some of them are answered
+const MAX_INFLIGHT = 64
+
+//Responses nobody claimed are dropped after this time
+const ORPHAN_TIMEOUT = time.Minute
+
+//Time a command can wait to be committed if not given in config
+const DEFAULT_REQUEST_TIMEOUT = 5 * time.Second
+
+//Clients are told to retry after this many milliseconds on ERR_TIMEOUT,
+//time enough for an election to finish
+const RETRY_HINT_MS = 1000
+
+var lock sync.Mutex //Lock for pendingMap and orphanMap
+
+//Requests waiting for kvstore response, by their Lsn
+var pendingMap = make(map[raft.Lsn]chan KVResponse)
+
+//Responses which came before anyone started waiting for them
+//(or after the client went away)
+var orphanMap = make(map[raft.Lsn]orphan)
+
+type orphan struct {
+	resp KVResponse
+	at   time.Time
+}
+
+//A response the connection writer has to send, in order
+type pendingReply struct {
+	lsn      raft.Lsn        //0 if not waiting on kvstore
+	ch       chan KVResponse //Response arrives here
+	deadline time.Time       //ERR_TIMEOUT is sent if no response by then
+	watch    *watcher        //Events are sent after response, if watching
+}
 
 //Always runing go routine
-//Receive response and lsn from kvstore,
-//get the corresponding client connection object,
-//send response to it and serve another command
-func clientConnManager(raftObj *raft.Raft, clientMap map[raft.Lsn]net.Conn, kvResponse chan KVResponse) {
+//Receive response and lsn from kvstore and
+//hand it over to the request waiting for it.
+//Requests whose entries raft may have lost get ERR_NOT_LEADER
+func clientConnManager(kvResponse chan KVResponse, lost <-chan raft.Lsn) {
 
 	for {
-		resp := <-kvResponse //Receive response from kv store
-
-		lsnKey := resp.lsn
+		var resp KVResponse
+		select {
+		case resp = <-kvResponse: //Receive response from kv store
+		case from := <-lost:
+			failPending(from)
+			continue
+		}
 
-		//Access connection object and remove from client map
 		lock.Lock()
-		conn := clientMap[lsnKey]
-		delete(clientMap, lsnKey) //Not required anymore, so remove from map
+		waiter, ok := pendingMap[resp.lsn]
+		if ok {
+			delete(pendingMap, resp.lsn) //Not required anymore, so remove from map
+		} else {
+			//Request not registered yet, keep it till it is
+			orphanMap[resp.lsn] = orphan{resp, time.Now()}
+			sweepOrphans()
+		}
 		lock.Unlock()
 
-		//Send connection and response to actual client handler
-		go handleOneCommand(conn, resp, raftObj, clientMap)
+		if ok {
+			waiter <- resp
+		}
 	}
 }
 
-//Handle exactly one command
-//If parsed succesfully, append to raft log
-//add to global clientMap and quit
-//clientConnManager() will call again for next command
-func handleOneCommand(clientConn net.Conn, response KVResponse, raftObj *raft.Raft, clientMap map[raft.Lsn]net.Conn) {
+//Fail requests waiting for entries from lsn onwards, since this server
+//is not the leader anymore or those entries were removed from log.
+//Such an entry may still be committed by the new leader, so client can't
+//be sure it was not applied
+func failPending(from raft.Lsn) {
+	lock.Lock()
+	defer lock.Unlock()
 
-	//If there is some response of previous command, then
-	//send that first before serving new one
+	for lsn, waiter := range pendingMap {
+		if lsn >= from {
+			delete(pendingMap, lsn)
+			waiter <- KVResponse{lsn, ERR_NOT_LEADER}
+		}
+	}
 
-	if response.lsn != 0 { //When called for first time, it will be 0
-		ret := WriteTCP(clientConn, response.response+"\r\n") //Write response to client
+	//Responses for them can't come anymore, and lsn can be used again
+	for lsn := range orphanMap {
+		if lsn >= from {
+			delete(orphanMap, lsn)
+		}
+	}
+}
 
-		if !ret {
-			log.Print("Client disconnected/broken pipe")
-			clientConn.Close()
-			return
+//Remove old unclaimed responses. Must hold lock
+func sweepOrphans() {
+	for lsn, o := range orphanMap {
+		if time.Since(o.at) > ORPHAN_TIMEOUT {
+			delete(orphanMap, lsn)
 		}
 	}
+}
+
+//Register interest in response of lsn
+func waitFor(lsn raft.Lsn) chan KVResponse {
+	waiter := make(chan KVResponse, 1)
+
+	lock.Lock()
+	if o, ok := orphanMap[lsn]; ok {
+		//Response already came
+		delete(orphanMap, lsn)
+		waiter <- o.resp
+	} else {
+		pendingMap[lsn] = waiter
+	}
+	lock.Unlock()
+
+	return waiter
+}
+
+//Wait for response of lsn till request timeout
+func waitReply(lsn raft.Lsn) pendingReply {
+	return pendingReply{lsn: lsn, ch: waitFor(lsn), deadline: time.Now().Add(requestTimeout())}
+}
+
+//No more interested in response of lsn
+func cancelWait(lsn raft.Lsn) {
+	lock.Lock()
+	delete(pendingMap, lsn)
+	lock.Unlock()
+}
+
+//Append command to raft log, stamped with time of this server
+//which will be the leader's time if append succeeds
+func appendCommand(raftObj *raft.Raft, command Command) (raft.LogEntry, error) {
+	command.Timestamp = time.Now().UnixNano()
+	return raftObj.Append(raft.Command(command))
+}
+
+//Append command to raft log and block till kvstore responds
+//Returns ErrRedirect from raft if this server is not the leader
+func submitCommand(raftObj *raft.Raft, command Command) (string, error) {
+
+	if response := admitOnLeader(raftObj, command); response != "" {
+		return response, nil
+	}
+
+	logEntry, err := appendCommand(raftObj, command)
+	if err != nil {
+		return "", err
+	}
+
+	lsn := logEntry.Lsn()
+	select {
+	case resp := <-waitFor(lsn):
+		return resp.response, nil
+	case <-time.After(requestTimeout()):
+		cancelWait(lsn)
+		return timeoutResponse(), nil
+	}
+}
+
+func requestTimeout() time.Duration {
+	if raft.ClusterInfo.RequestTimeout > 0 {
+		return time.Duration(raft.ClusterInfo.RequestTimeout) * time.Millisecond
+	}
+	return DEFAULT_REQUEST_TIMEOUT
+}
+
+//ERR_TIMEOUT <retry_after_ms>
+func timeoutResponse() string {
+	return ERR_TIMEOUT + " " + strconv.Itoa(RETRY_HINT_MS)
+}
+
+//Serve a client connection
+//Commands are read, parsed and appended to raft log one after another
+//without waiting for their responses. Writer go routine sends back
+//responses in the same order as commands came
+func handleClient(clientConn net.Conn, raftObj *raft.Raft) {
+	if !trackConn(clientConn) {
+		clientConn.Close() //Shutting down
+		return
+	}
+
+	replies := make(chan pendingReply, MAX_INFLIGHT) //Responses to be sent, in order
+	abort := make(chan bool)                         //Closed if client is gone
+
+	go writeReplies(clientConn, replies, abort)
+
+	reader := newProtocolReader(clientConn, maxValueSize())
+	defer close(replies) //Writer sends what is left and closes connection
+
+	var leaderConn *forwardConn //To forward commands if not leader
+	forwarded := false          //Commands are forwarded from a follower
+	var state clientState       //Namespace and user selected by client
+	defer func() {
+		if leaderConn != nil {
+			leaderConn.close()
+		}
+	}()
 
-	// Server the client for one command
 	for {
-		//Input scanner
-		scanner := bufio.NewScanner(clientConn)
-		scanner.Split(bufio.ScanLines) //Treat command as string with \n
-		scanner.Scan()
-		buf := scanner.Text()
-
-		if scanner.Err() != nil {
-			log.Print("Command Read Error")
-			sendError(clientConn, ERR_INTERNAL)
-			clientConn.Close()
-			break
-		}
-
-		command, err := parseInput(buf)
-
-		if err != "" {
-			ret := sendError(clientConn, err)
-			if !ret {
-				log.Print("Client disconnected/broken pipe")
-				clientConn.Close()
-				break
+		command, errStr, err := reader.readCommand()
+
+		if err != nil {
+			if err != io.EOF && !isStopping() {
+				log.Print("Command Read Error: " + err.Error())
+				close(abort) //Nobody to send responses to
 			}
-			continue // Something is wrong, retry command
-		}
-		if command.Cmd == "set" || command.Cmd == "cas" {
-			//Read data bytes of command.Length length
-			scanner.Split(bufio.ScanBytes) //Treat each byte as a token
-			dataBytes := make([]byte, command.Length)
-
-			for i := int64(0); i < command.Length; i++ {
-				scanner.Scan() // Read bytes of specified length
-				if scanner.Err() != nil {
-					log.Print("Data Read Error")
-					sendError(clientConn, ERR_INTERNAL)
-					return
-				}
-				dataBytes[i] = scanner.Bytes()[0]
+			return //On shutdown, writer still sends responses
+		}
+
+		if errStr != "" {
+			replies <- immediateReply(errStr) // Something is wrong, reply error
+			continue
+		}
+
+		if command.Cmd == "forwarded" {
+			forwarded = true
+			replies <- immediateReply("OK")
+			continue
+		}
+
+		if command.Cmd == "use" {
+			//Checked by kvstore when a command is run in it
+			state.namespace = command.Namespace
+			replies <- immediateReply("OK")
+			continue
+		}
+
+		if command.Cmd == "auth" {
+			//Checked with users of this server, its commands are
+			//checked again by kvstore
+			if !acl.login(command.Key, command.Value) {
+				log.Print("Authentication failed for " + command.Key)
+				replies <- immediateReply(ERR_AUTH_FAILED)
+				continue
 			}
-			command.Value = string(dataBytes)
+			state.user = command.Key
+			replies <- immediateReply("OK")
+			continue
 		}
-		// Everything upto here (parsing command) is fine
 
-		//Append to log , add to client map and wait for client handler to
-		// continue handling when the response comes back
+		if command.Cmd == "authtoken" {
+			//Login of a client of the follower forwarding commands
+			if !forwarded || !acl.checkToken(command.Key, command.ExpiryTime, command.Value) {
+				log.Print("Login token rejected for " + command.Key)
+				state.user = "" //Commands of follower's client must not run as previous user
+				replies <- immediateReply(ERR_AUTH_FAILED)
+				continue
+			}
+			state.user = command.Key
+			replies <- immediateReply("OK")
+			continue
+		}
+		command.Namespace, command.User = state.namespace, state.user
 
-		logEntry, er := raftObj.Append(raft.Command(command))
+		if command.Cmd == "watch" {
+			//Served from state machine of this server, no need of leader
+			key := scopedKey(state.namespace, command.Key)
+			if errStr := acl.canRead(state.user, key); errStr != "" {
+				replies <- immediateReply(errStr)
+				continue
+			}
+			w, revision, errStr := hub.watch(key, state.user, command.Version)
+			if errStr != "" {
+				replies <- immediateReply(errStr)
+				continue
+			}
+			reply := immediateReply("WATCHING " + strconv.FormatInt(revision, 10))
+			reply.watch = w
+			replies <- reply
+
+			//Connection only streams events from now, till client closes it
+			io.Copy(ioutil.Discard, reader.reader)
+			hub.cancel(w)
+			return
+		}
+
+		if response := admitOnLeader(raftObj, command); response != "" {
+			replies <- immediateReply(response)
+			continue
+		}
+
+		//Append to log and let writer wait for response
+		logEntry, er := appendCommand(raftObj, command)
 
 		if er != nil { //Possibly not the leader, so redirect
 			log.Print(er.Error())
 
-			response := "REDIRECT " + strconv.Itoa(raftObj.LeaderID)
-			ret := WriteTCP(clientConn, response+"\r\n") //Write response to client
+			leaderID, isRedirect := er.(raft.ErrRedirect)
+			if !raft.ClusterInfo.ForwardToLeader || forwarded || !isRedirect {
+				replies <- immediateReply(redirectResponse(er))
+				continue
+			}
 
-			if !ret {
-				log.Print("Client disconnected/broken pipe")
-				clientConn.Close()
+			//Forward to leader instead
+			if leaderConn == nil || leaderConn.leaderID != int(leaderID) || leaderConn.isBroken() {
+				if leaderConn != nil {
+					leaderConn.close()
+				}
+				leaderConn, er = dialLeader(int(leaderID))
+				if er != nil {
+					log.Print("Forward Error: " + er.Error())
+					replies <- immediateReply(redirectResponse(raft.ErrRedirect(leaderID)))
+					continue
+				}
 			}
+			replies <- leaderConn.forward(state, reader.raw)
+			continue
+		}
+
+		replies <- waitReply(logEntry.Lsn())
+	}
+}
+
+//Response for a command which couldn't be appended since this server
+//is not the leader. REDIRECT <leader_id> <host>:<client_port>, or
+//ERR_NO_LEADER if leader is not known
+func redirectResponse(err error) string {
+	leaderID, ok := err.(raft.ErrRedirect)
+	if !ok {
+		return ERR_NO_LEADER
+	}
+
+	leader, ok := serverConfig(int(leaderID))
+	if !ok {
+		return "REDIRECT " + strconv.Itoa(int(leaderID))
+	}
+	return "REDIRECT " + strconv.Itoa(int(leaderID)) + " " + leader.ClientAddress()
+}
+
+//Reply which doesn't need to wait for kvstore
+func immediateReply(response string) pendingReply {
+	ch := make(chan KVResponse, 1)
+	ch <- KVResponse{0, response}
+	return pendingReply{lsn: 0, ch: ch}
+}
+
+//Send responses to client in order
+func writeReplies(clientConn net.Conn, replies chan pendingReply, abort chan bool) {
+
+	defer untrackConn(clientConn)
+	defer clientConn.Close()
+	writer := bufio.NewWriter(clientConn)
+
+	for reply := range replies {
 
-			break
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !reply.deadline.IsZero() {
+			timer = time.NewTimer(time.Until(reply.deadline))
+			timeout = timer.C
 		}
 
-		//Add to client map
-		lsn := logEntry.Lsn()
+		var resp KVResponse
+		select {
+		case resp = <-reply.ch:
+		case <-timeout:
+			log.Print("Request timed out")
+			cancelWait(reply.lsn)
+			resp = KVResponse{reply.lsn, timeoutResponse()}
+		case <-abort:
+			cancelWait(reply.lsn)
+			drainReplies(replies)
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
 
-		lock.Lock()
-		clientMap[lsn] = clientConn
-		lock.Unlock()
+		writer.WriteString(resp.response + "\r\n")
+
+		if reply.watch != nil {
+			writeEvents(writer, reply.watch)
+			drainReplies(replies)
+			return
+		}
+
+		if len(replies) > 0 {
+			continue //More responses to send, write together
+		}
+
+		if err := writer.Flush(); err != nil {
+			log.Print("Client disconnected/broken pipe")
+			clientConn.Close() //Makes reader stop as well
+			drainReplies(replies)
+			return
+		}
+	}
+}
 
-		//Stop and wait for clientConnManger() to do something
-		break
+//Stream events of a watch till it is dropped or client goes away
+func writeEvents(writer *bufio.Writer, w *watcher) {
+	for {
+		if err := writer.Flush(); err != nil {
+			log.Print("Client disconnected/broken pipe")
+			hub.cancel(w)
+			return
+		}
 
+		event, ok := <-w.events
+		for ok {
+			writer.WriteString(event + "\r\n")
+			if len(w.events) == 0 {
+				break
+			}
+			event, ok = <-w.events //More events ready, write together
+		}
+
+		if !ok {
+			if w.lagged > 0 {
+				//Client was too slow, tell it where to resume from
+				writer.WriteString(fmt.Sprintf("%s %d\r\n", ERR_WATCH_LAGGED, w.lagged))
+			}
+			if w.denied != "" {
+				writer.WriteString(w.denied + "\r\n")
+			}
+			writer.Flush()
+			return
+		}
 	}
+}
 
+//Forget replies of a connection which is gone
+func drainReplies(replies chan pendingReply) {
+	for reply := range replies {
+		cancelWait(reply.lsn)
+	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+//Counters are keys holding a number which is changed within the state
+//machine, so concurrent clients don't conflict as they do with getm
+//and cas. Each change is a single log entry.
+//
+//	incr <key> <delta> [initial <n>] [min <n>] [max <n>] [fail|clamp|wrap]\r\n
+//	decr <key> <delta> [...]\r\n
+//
+//A missing key is taken as initial, 0 if not given. If the result is
+//not within min and max, fail (the default) replies ERR_OUT_OF_RANGE,
+//clamp stops at the bound and wrap goes around to the other bound.
+//A key with an expiry time keeps it, counted again from the change.
+//Reply is "NUM <new_value>".
+
+//Counter without bounds other than those of int64
+func newCounter(key string, delta int64) Command {
+	return Command{Cmd: "incr", Key: key, Delta: delta, Min: math.MinInt64, Max: math.MaxInt64, Overflow: "fail"}
+}
+
+//incr|decr <key> <delta> [options]
+func parseCounter(fields []string) (Command, string) {
+	if len(fields) < 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	delta, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || (fields[0] == "decr" && delta == math.MinInt64) {
+		return Command{}, ERR_CMD_ERR
+	}
+	if fields[0] == "decr" {
+		delta = -delta
+	}
+	command := newCounter(fields[1], delta)
+
+	options := fields[3:]
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "fail", "clamp", "wrap":
+			command.Overflow = options[i]
+			continue
+		case "initial", "min", "max":
+		default:
+			return Command{}, ERR_CMD_ERR
+		}
+
+		if i+1 == len(options) {
+			return Command{}, ERR_CMD_ERR
+		}
+		n, err := strconv.ParseInt(options[i+1], 10, 64)
+		if err != nil {
+			return Command{}, ERR_CMD_ERR
+		}
+
+		switch options[i] {
+		case "initial":
+			command.Initial = n
+		case "min":
+			command.Min = n
+		case "max":
+			command.Max = n
+		}
+		i++
+	}
+
+	if command.Min > command.Max {
+		return Command{}, ERR_CMD_ERR
+	}
+	return command, ""
+}
+
+//Add delta to numeric value of a key
+func (store *kvStore) incrKey(command Command) string {
+	key := command.Key
+
+	number := command.Initial
+	val, ok := store.data.get(key)
+	if ok == true {
+		n, err := strconv.ParseInt(string(val.val), 10, 64)
+		if err != nil {
+			log.Print("Value not a number")
+			return ERR_NOT_NUMBER
+		}
+		number = n
+	}
+
+	number, ok = addBounded(number, command)
+	if !ok {
+		log.Print("Counter out of range")
+		return ERR_OUT_OF_RANGE
+	}
+
+	val.val = []byte(strconv.FormatInt(number, 10))
+	val.numbytes = int64(len(val.val))
+	val.version = store.revision
+	if !store.fits(key, val) {
+		log.Print("Out of memory")
+		return ERR_OUT_OF_MEMORY
+	}
+	if !store.withinQuota(key, val) {
+		log.Print("Quota exceeded")
+		return ERR_QUOTA_EXCEEDED
+	}
+	store.data.set(key, val)
+	store.access(key)
+	store.setExpiry(key) //Timer of old version would be ignored
+
+	stored, _ := store.data.get(key)
+	hub.publish(watchEvent{kind: "put", key: key, revision: store.revision, val: stored})
+
+	return fmt.Sprintf("NUM %d", number)
+}
+
+//number + delta as per bounds and overflow policy of command
+//False if it is out of bounds and policy is to fail
+func addBounded(number int64, command Command) (int64, bool) {
+	//Big ints, as the sum or the span of bounds may not fit in int64
+	sum := new(big.Int).Add(big.NewInt(number), big.NewInt(command.Delta))
+	min, max := big.NewInt(command.Min), big.NewInt(command.Max)
+
+	if sum.Cmp(min) >= 0 && sum.Cmp(max) <= 0 {
+		return sum.Int64(), true
+	}
+
+	switch command.Overflow {
+	case "clamp":
+		if sum.Cmp(min) < 0 {
+			return command.Min, true
+		}
+		return command.Max, true
+
+	case "wrap":
+		span := new(big.Int).Sub(max, min)
+		span.Add(span, big.NewInt(1))
+		sum.Sub(sum, min)
+		sum.Mod(sum, span) //Never negative
+		sum.Add(sum, min)
+		return sum.Int64(), true
+	}
+	return 0, false
+}
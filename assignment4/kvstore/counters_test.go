@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddBounded(t *testing.T) {
+	bounded := func(delta, min, max int64, overflow string) Command {
+		return Command{Cmd: "incr", Delta: delta, Min: min, Max: max, Overflow: overflow}
+	}
+
+	tests := []struct {
+		number  int64
+		command Command
+		want    int64
+		ok      bool
+	}{
+		{5, newCounter("", 3), 8, true},
+		{5, newCounter("", -10), -5, true},
+		{math.MaxInt64, newCounter("", 1), 0, false},
+		{math.MinInt64, newCounter("", -1), 0, false},
+		{8, bounded(3, 0, 9, "fail"), 0, false},
+		{8, bounded(3, 0, 9, "clamp"), 9, true},
+		{1, bounded(-3, 0, 9, "clamp"), 0, true},
+		{8, bounded(3, 0, 9, "wrap"), 1, true},
+		{1, bounded(-3, 0, 9, "wrap"), 8, true},
+		{0, bounded(-25, 0, 9, "wrap"), 5, true},
+		{math.MaxInt64, bounded(1, math.MinInt64, math.MaxInt64, "wrap"), math.MinInt64, true},
+		{math.MaxInt64, bounded(math.MaxInt64, math.MinInt64, math.MaxInt64, "clamp"), math.MaxInt64, true},
+	}
+
+	for _, test := range tests {
+		got, ok := addBounded(test.number, test.command)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%d + %d in [%d, %d] %s: got %d %v, want %d %v", test.number, test.command.Delta,
+				test.command.Min, test.command.Max, test.command.Overflow, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseCounter(t *testing.T) {
+	command, errStr := parseCounter(strings.Fields("decr c 2 initial 10 min 0 max 20 clamp"))
+	if errStr != "" || command.Delta != -2 || command.Initial != 10 || command.Min != 0 || command.Max != 20 || command.Overflow != "clamp" {
+		t.Errorf("got %+v %q", command, errStr)
+	}
+
+	for _, line := range []string{"incr c", "incr c x", "incr c 1 min", "incr c 1 min 5 max 4", "incr c 1 bad", "decr c -9223372036854775808"} {
+		if _, errStr := parseCounter(strings.Fields(line)); errStr != ERR_CMD_ERR {
+			t.Errorf("%q: got %q, want %q", line, errStr, ERR_CMD_ERR)
+		}
+	}
+}
+
+func TestIncrKeepsExpiry(t *testing.T) {
+	store := newTestStore()
+	key := scopedKey("", "c")
+	store.setCas(Command{Cmd: "set", Key: key, Value: "1", Length: 1, ExpiryTime: 1})
+
+	store.revision++
+	if response := store.incrKey(newCounter(key, 1)); response != "NUM 2" {
+		t.Fatalf("got %q", response)
+	}
+	if response := store.ttlKey(Command{Key: key}); response != "TTL 1" {
+		t.Errorf("got %q after incr, want TTL 1", response)
+	}
+
+	//Expire command picked for the old version is ignored
+	due := Command{Cmd: "expire", Key: key, Version: 1, Timestamp: store.sessions.clock + int64(time.Second)}
+	store.expiryHandler(due)
+	if _, ok := store.data.get(key); !ok {
+		t.Fatal("counter expired by command for old version")
+	}
+
+	due.Version = store.revision
+	store.expiryHandler(due)
+	if _, ok := store.data.get(key); ok {
+		t.Error("counter not expired")
+	}
+}
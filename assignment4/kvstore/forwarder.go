@@ -0,0 +1,219 @@
+package main
+
+import (
+	"assignment4/raft"
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//When ForwardToLeader is set in config, a follower sends commands of
+//its clients to the leader and relays back the responses, instead of
+//replying REDIRECT
+
+const FORWARD_DIAL_TIMEOUT = time.Second
+
+//Connection to leader used to forward commands of one client connection
+//Commands are pipelined on it, so they reach the leader in the same
+//order as they came from client and responses come back in order
+type forwardConn struct {
+	leaderID int
+	conn     net.Conn
+	lock     sync.Mutex           //For writing to conn and waiting
+	waiting  chan chan KVResponse //Responses expected, in order
+	closed   bool
+	broken   bool        //Connection to leader failed
+	state    clientState //Selected on leader for commands sent
+	expires  int64       //When login token sent to leader expires
+}
+
+//What a client selected on its connection, which is selected on its
+//connection to leader as well
+type clientState struct {
+	namespace string
+	user      string //Logged in user, "" if none
+}
+
+func dialLeader(leaderID int) (*forwardConn, error) {
+	leader, _ := serverConfig(leaderID)
+	address := leader.ClientAddress()
+
+	//Leader shows certificate of its id, and this server its own
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: FORWARD_DIAL_TIMEOUT}
+	if raft.ClusterInfo.ClientTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, raft.DialTLSConfig(leaderID))
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forwardConn{leaderID: leaderID, conn: conn, waiting: make(chan chan KVResponse, MAX_INFLIGHT)}
+
+	//Tell leader not to forward these commands again
+	f.send([]byte("forwarded\r\n"))
+
+	go f.readResponses()
+	return f, nil
+}
+
+//Send a command (line and data as read from client) to leader, to be
+//run as per state of client
+func (f *forwardConn) forward(state clientState, raw []byte) pendingReply {
+	//Replies to these are not needed. If login fails on leader, the
+	//command fails there for want of it
+	renew := time.Now().Unix() > f.expires-AUTH_TOKEN_TTL/2
+	if state.user != "" && (state.user != f.state.user || renew) {
+		line, expires, ok := acl.loginToken(state.user)
+		if !ok {
+			line = "authtoken " + state.user + " 0 -\r\n" //User is gone, log out on leader
+		}
+		f.send([]byte(line))
+		f.expires = expires
+	}
+	if state.namespace != f.state.namespace {
+		f.send([]byte("use " + namespaceName(state.namespace) + "\r\n"))
+	}
+	f.state = state
+	return pendingReply{ch: f.send(raw), deadline: time.Now().Add(requestTimeout())}
+}
+
+func (f *forwardConn) send(raw []byte) chan KVResponse {
+	ch := make(chan KVResponse, 1)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.broken || f.closed {
+		ch <- KVResponse{0, ERR_INTERNAL}
+		return ch
+	}
+
+	f.waiting <- ch
+	if _, err := f.conn.Write(raw); err != nil {
+		log.Print("Forward Error: " + err.Error())
+		f.broken = true
+		f.conn.Close() //Reader fails the waiting ones
+	}
+	return ch
+}
+
+//Read responses from leader and hand them over in order
+func (f *forwardConn) readResponses() {
+	defer f.conn.Close()
+
+	reader := newProtocolReader(f.conn, maxValueSize())
+	first := true
+
+	for ch := range f.waiting {
+		if f.isBroken() {
+			ch <- KVResponse{0, ERR_INTERNAL}
+			continue
+		}
+
+		response, err := readResponse(reader)
+		if err != nil {
+			log.Print("Forward Error: " + err.Error())
+			f.lock.Lock()
+			f.broken = true
+			f.lock.Unlock()
+			f.conn.Close()
+			ch <- KVResponse{0, ERR_INTERNAL}
+			continue
+		}
+
+		if first && response != "OK" {
+			//Leader doesn't understand forwarded, must be old
+			log.Print("Forward Error: " + response)
+		}
+		first = false
+
+		ch <- KVResponse{0, response}
+	}
+}
+
+func (f *forwardConn) isBroken() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.broken
+}
+
+//No more commands, connection closes after pending responses
+func (f *forwardConn) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.waiting)
+	}
+}
+
+//Read a response line, along with value if it is a VALUE response
+//and responses of operations or items if it is a TXN or RANGE response
+func readResponse(reader *protocolReader) (string, error) {
+
+	line, errStr, err := reader.readLine()
+	if err != nil {
+		return "", err
+	}
+	if errStr != "" {
+		return errStr, nil
+	}
+
+	if strings.HasPrefix(line, "TXN ") || strings.HasPrefix(line, "RANGE ") {
+		return readListResponse(reader, line)
+	}
+
+	//Value follows VALUE, and KEY of a range unless it is only the key
+	fields := strings.Fields(line)
+	if !strings.HasPrefix(line, "VALUE ") && !(len(fields) == 5 && fields[0] == "KEY") {
+		return line, nil
+	}
+
+	//Last field is number of bytes
+	length, er := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if er != nil {
+		return ERR_INTERNAL, nil
+	}
+
+	data, errStr, err := reader.readData(length)
+	if err != nil {
+		return "", err
+	}
+	if errStr != "" {
+		return errStr, nil
+	}
+
+	return line + "\r\n" + string(data), nil
+}
+
+//TXN SUCCESS|FAILURE <n> or RANGE <n> [<next>], followed by n responses
+func readListResponse(reader *protocolReader, line string) (string, error) {
+	fields := strings.Fields(line)
+	count := fields[len(fields)-1]
+	if fields[0] == "RANGE" {
+		count = fields[1]
+	}
+	n, er := strconv.Atoi(count)
+	if er != nil {
+		return ERR_INTERNAL, nil
+	}
+
+	responses := []string{line}
+	for i := 0; i < n; i++ {
+		response, err := readResponse(reader)
+		if err != nil {
+			return "", err
+		}
+		responses = append(responses, response)
+	}
+	return strings.Join(responses, "\r\n"), nil
+}
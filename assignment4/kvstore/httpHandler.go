@@ -0,0 +1,307 @@
+package main
+
+import (
+	"assignment4/raft"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//HTTP/JSON gateway for the kvstore
+//	GET    /v1/keys/{key}
+//	PUT    /v1/keys/{key}?ttl=<seconds>   (If-Match: <version> for cas, If-None-Match: * for create)
+//	DELETE /v1/keys/{key}                 (If-Match: <version> for conditional delete)
+//Keys are in namespace given by X-Namespace header, default if none
+//User is given with basic authentication
+//Values which are not UTF-8 are sent base64 encoded in JSON, or as they
+//are if client accepts application/octet-stream
+
+const keysPath = "/v1/keys/"
+
+type httpHandler struct {
+	raftObj *raft.Raft
+}
+
+//Metadata of a key sent back as JSON
+type keyResponse struct {
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	Base64  *string `json:"value_base64,omitempty"` //Instead of value, if it is not UTF-8
+	Version int64   `json:"version"`
+	Expiry  *int64  `json:"expiry,omitempty"`
+	Bytes   *int64  `json:"bytes,omitempty"`
+}
+
+type deleteResponse struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted"`
+}
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Leader *int   `json:"leader,omitempty"`
+}
+
+//Listen for HTTP clients on address
+func startHttpServer(raftObj *raft.Raft, address string) {
+
+	mux := http.NewServeMux()
+	mux.Handle(keysPath, &httpHandler{raftObj})
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Print("Error listening to HTTP port:" + err.Error())
+		return
+	}
+
+	log.Print("HTTP server started:", listener.Addr())
+
+	server := &http.Server{Handler: mux}
+	if !addHttpServer(server) {
+		listener.Close() //Shutting down
+		return
+	}
+
+	//HTTPS if clients use TLS
+	err = server.Serve(clientListener(listener))
+	if err != nil && err != http.ErrServerClosed {
+		log.Print("Error serving HTTP:" + err.Error())
+	}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, keysPath)
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, ERR_CMD_ERR)
+		return
+	}
+
+	var command Command
+	var err string
+
+	switch r.Method {
+	case "GET", "HEAD":
+		command = Command{Cmd: "getm", Key: key}
+	case "PUT":
+		command, err = putCommand(key, r)
+	case "DELETE":
+		command, err = deleteCommand(key, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, ERR_CMD_ERR)
+		return
+	}
+
+	if space := r.Header.Get("X-Namespace"); space != "" {
+		if !validNamespace(space) {
+			err = ERR_CMD_ERR
+		}
+		command.Namespace = namespaceID(space)
+	}
+
+	if name, password, ok := r.BasicAuth(); ok && err == "" {
+		if !acl.login(name, password) {
+			err = ERR_AUTH_FAILED
+		}
+		command.User = name
+	}
+
+	if err != "" {
+		writeJSONError(w, errorStatus(err, command), err)
+		return
+	}
+
+	response, er := submitCommand(h.raftObj, command)
+	if er != nil {
+		log.Print(er.Error())
+		h.redirect(w, r, er)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(response, "VALUE "):
+		writeValue(w, r, key, response)
+	case strings.HasPrefix(response, "OK "):
+		version, _ := strconv.ParseInt(strings.TrimPrefix(response, "OK "), 10, 64)
+		w.Header().Set("ETag", etag(version))
+		writeJSON(w, http.StatusOK, keyResponse{Key: key, Version: version})
+	case response == "DELETED":
+		writeJSON(w, http.StatusOK, deleteResponse{key, true})
+	case strings.HasPrefix(response, ERR_TIMEOUT):
+		retryAfter := (RETRY_HINT_MS + 999) / 1000
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeJSONError(w, http.StatusGatewayTimeout, ERR_TIMEOUT)
+	default:
+		writeJSONError(w, errorStatus(response, command), response)
+	}
+}
+
+//set, cas or put as per precondition headers
+func putCommand(key string, r *http.Request) (Command, string) {
+
+	//Read one byte more than allowed to know if it is too large
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueSize()+1))
+	if err != nil {
+		return Command{}, ERR_INTERNAL
+	}
+	if int64(len(data)) > maxValueSize() {
+		return Command{}, ERR_TOO_LARGE
+	}
+	if len(data) == 0 {
+		return Command{}, ERR_CMD_ERR //Text protocol needs a value too
+	}
+
+	command := Command{Cmd: "put", Key: key, Value: string(data), Length: int64(len(data))}
+
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		command.ExpiryTime, err = strconv.ParseInt(ttl, 10, 64)
+		if err != nil || command.ExpiryTime < 0 {
+			return Command{}, ERR_CMD_ERR
+		}
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		command.Cmd = "cas"
+		command.Version, err = parseETag(match)
+		if err != nil {
+			return Command{}, ERR_CMD_ERR
+		}
+	} else if r.Header.Get("If-None-Match") == "*" {
+		command.Cmd = "set" //Create only
+	}
+
+	return command, ""
+}
+
+func deleteCommand(key string, r *http.Request) (Command, string) {
+
+	command := Command{Cmd: "delete", Key: key}
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		version, err := parseETag(match)
+		if err != nil {
+			return Command{}, ERR_CMD_ERR
+		}
+		command.Cmd = "casdelete"
+		command.Version = version
+	}
+
+	return command, ""
+}
+
+//HTTP status for an error response of kvstore
+func errorStatus(response string, command Command) int {
+	switch response {
+	case ERR_NOT_FOUND, ERR_NAMESPACE_NOT_FOUND:
+		return http.StatusNotFound
+	case ERR_VERSION:
+		if command.Cmd == "set" || command.Cmd == "cas" || command.Cmd == "casdelete" {
+			return http.StatusPreconditionFailed
+		}
+		return http.StatusConflict
+	case ERR_CMD_ERR, ERR_NOT_NUMBER:
+		return http.StatusBadRequest
+	case ERR_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case ERR_OUT_OF_MEMORY, ERR_QUOTA_EXCEEDED:
+		return http.StatusInsufficientStorage
+	case ERR_RATE_LIMITED:
+		return http.StatusTooManyRequests
+	case ERR_AUTH_REQUIRED, ERR_AUTH_FAILED:
+		return http.StatusUnauthorized
+	case ERR_PERMISSION_DENIED:
+		return http.StatusForbidden
+	case ERR_NOT_LEADER:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+//Send client to same url on leader
+func (h *httpHandler) redirect(w http.ResponseWriter, r *http.Request, err error) {
+
+	redirect, ok := err.(raft.ErrRedirect)
+	if !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, ERR_NO_LEADER)
+		return
+	}
+
+	leaderID := int(redirect)
+	leader, ok := serverConfig(leaderID)
+	if !ok || leader.HttpPort <= 0 {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{"ERR_REDIRECT", &leaderID})
+		return
+	}
+
+	scheme := "http://"
+	if raft.ClusterInfo.ClientTLS {
+		scheme = "https://"
+	}
+	url := scheme + net.JoinHostPort(leader.Hostname, strconv.Itoa(leader.HttpPort)) + r.URL.RequestURI()
+	w.Header().Set("Location", url)
+	writeJSON(w, http.StatusTemporaryRedirect, errorResponse{"ERR_REDIRECT", &leaderID})
+}
+
+//Parse "VALUE <version> <expiry_time> <num_bytes>\r\n<value>" from getm
+func writeValue(w http.ResponseWriter, r *http.Request, key string, response string) {
+
+	i := strings.Index(response, "\r\n")
+	var version, expiry, numbytes int64
+	_, err := fmt.Sscanf(response[:i], "VALUE %d %d %d", &version, &expiry, &numbytes)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, ERR_INTERNAL)
+		return
+	}
+
+	data := response[i+2:]
+
+	w.Header().Set("ETag", etag(version))
+	if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Expiry", strconv.FormatInt(expiry, 10))
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, data)
+		return
+	}
+
+	body := keyResponse{Key: key, Version: version, Expiry: &expiry, Bytes: &numbytes}
+	if utf8.ValidString(data) {
+		body.Value = &data
+	} else {
+		encoded := base64.StdEncoding.EncodeToString([]byte(data))
+		body.Base64 = &encoded
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+//Version from an ETag, quotes are optional
+func parseETag(tag string) (int64, error) {
+	return strconv.ParseInt(strings.Trim(strings.TrimSpace(tag), `"`), 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kvstore"`)
+	}
+	writeJSON(w, status, errorResponse{Error: err})
+}
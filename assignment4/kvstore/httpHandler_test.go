@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteValue(t *testing.T) {
+	tests := []struct {
+		value, accept, want string
+	}{
+		{"hello", "", `"value":"hello"`},
+		{"\xff\x00\xfe", "", `"value_base64":"/wD+"`},
+		{"\xff\x00\xfe", "application/octet-stream", "\xff\x00\xfe"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", keysPath+"k", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		writeValue(w, r, "k", "VALUE 7 0 3\r\n"+test.value)
+
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != `"7"` {
+			t.Errorf("%q: got status %d, ETag %q", test.value, w.Code, w.Header().Get("ETag"))
+		}
+		if !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%q: got body %q, want %q in it", test.value, w.Body.String(), test.want)
+		}
+		if test.accept == "" {
+			var body keyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Errorf("%q: %v", test.value, err)
+			}
+		}
+	}
+}
+
+func TestPutCommand(t *testing.T) {
+	r := httptest.NewRequest("PUT", keysPath+"k?ttl=5", strings.NewReader("v"))
+	r.Header.Set("If-Match", `"3"`)
+	command, errStr := putCommand("k", r)
+	if errStr != "" || command.Cmd != "cas" || command.Version != 3 || command.ExpiryTime != 5 || command.Value != "v" {
+		t.Errorf("got %+v %q", command, errStr)
+	}
+
+	r = httptest.NewRequest("PUT", keysPath+"k", strings.NewReader(""))
+	if _, errStr := putCommand("k", r); errStr != ERR_CMD_ERR {
+		t.Errorf("empty value: got %q, want %q", errStr, ERR_CMD_ERR)
+	}
+
+	r = httptest.NewRequest("PUT", keysPath+"k?ttl=-1", strings.NewReader("v"))
+	if _, errStr := putCommand("k", r); errStr != ERR_CMD_ERR {
+		t.Errorf("negative ttl: got %q, want %q", errStr, ERR_CMD_ERR)
+	}
+}
@@ -26,18 +26,80 @@ func parseInput(command string) (Command, string) {
 		reqLen = 2
 	case "delete":
 		reqLen = 2
+	case "forwarded": //Sent by followers forwarding commands
+		reqLen = 1
+	case "register":
+		reqLen = 1
+	case "unregister":
+		reqLen = 2
+	case "session":
+		return parseSession(fields)
+	case "txn":
+		reqLen = 4
+	case "watch":
+		return parseWatch(fields)
+	case "lease":
+		return parseLease(fields)
+	case "lock", "unlock", "lock-status":
+		return parseLock(fields)
+	case "incr", "decr":
+		return parseCounter(fields)
+	case "range":
+		return parseRange(fields)
+	case "prefix":
+		return parsePrefix(fields)
+	case "use":
+		return parseUse(fields)
+	case "namespace":
+		return parseNamespace(fields)
+	case "stats":
+		return parseStats(fields)
+	case "auth":
+		return parseAuth(fields)
+	case "authtoken":
+		return parseAuthToken(fields)
+	case "user":
+		return parseUser(fields)
+	case "role":
+		return parseRole(fields)
 	default:
 		reqLen = -1
 	}
 
+	//Set and cas can attach key to a lease
+	lease := int64(0)
+	if fields[0] == "set" || fields[0] == "cas" {
+		var ok bool
+		if lease, fields, ok = parseLeaseOption(fields, reqLen); !ok {
+			return Command{}, ERR_CMD_ERR
+		}
+		length = len(fields)
+	}
+
 	//Length didn't match
 	if reqLen != length {
 		return Command{}, ERR_CMD_ERR
 	}
 
+	if fields[0] == "txn" {
+		return parseTxn(fields)
+	}
+
+	if fields[0] == "forwarded" || fields[0] == "register" {
+		return Command{Cmd: fields[0]}, ""
+	}
+
+	if fields[0] == "unregister" {
+		clientID, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || clientID <= 0 {
+			return Command{}, ERR_CMD_ERR
+		}
+		return Command{Cmd: "unregister", ClientID: clientID}, ""
+	}
+
 	//Get, Getm and Delete requires no more validations while parsing
 	if fields[0] == "get" || fields[0] == "getm" || fields[0] == "delete" {
-		return Command{fields[0], fields[1], 0, 0, 0, ""}, ""
+		return Command{Cmd: fields[0], Key: fields[1]}, ""
 	}
 
 	//Validate expiry timer
@@ -59,7 +121,7 @@ func parseInput(command string) (Command, string) {
 
 	//All validations for set completed
 	if fields[0] == "set" {
-		return Command{"set", fields[1], expiryTime, numBytes, 0, ""}, ""
+		return Command{Cmd: "set", Key: fields[1], ExpiryTime: expiryTime, Length: numBytes, Lease: lease}, ""
 	}
 
 	//Version number for cas
@@ -69,5 +131,35 @@ func parseInput(command string) (Command, string) {
 	}
 
 	//Return cas
-	return Command{"cas", fields[1], expiryTime, numBytes, version, ""}, ""
+	return Command{Cmd: "cas", Key: fields[1], ExpiryTime: expiryTime, Length: numBytes, Version: version, Lease: lease}, ""
+}
+
+//session <client_id> <seq> <command>
+//Command is run in the client's session
+func parseSession(fields []string) (Command, string) {
+	if len(fields) < 4 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	clientID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || clientID <= 0 {
+		return Command{}, ERR_CMD_ERR
+	}
+	seq, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || seq <= 0 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	switch fields[3] {
+	case "session", "register", "unregister", "forwarded", "watch", "use", "auth", "authtoken":
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command, errStr := parseInput(strings.Join(fields[3:], " "))
+	if errStr != "" {
+		return Command{}, errStr
+	}
+	command.ClientID = clientID
+	command.Seq = seq
+	return command, ""
 }
@@ -4,32 +4,65 @@ import (
 	"assignment4/raft"
 	"fmt"
 	"log"
-	"math/rand"
 	"time"
 )
 
-func kvStoreHandler(commitCh chan raft.LogEntry, kvResponse chan KVResponse) {
+//State machine of the kvstore, changed only by applying log entries
+type kvStore struct {
+	data       *orderedMap //Sorted by key
+	sessions   *sessionTable
+	leases     *leaseTable
+	locks      map[string]*lockState
+	namespaces map[string]*namespace //By name, "" for default
+	evicting   map[string]time.Time  //Keys picked for eviction, when
+	expiring   map[string]time.Time  //Keys picked for expiry, when
+	victims    chan []Command        //Keys to evict or expire, to evictor
+	revision   int64                 //Lsn of entry being applied
+
+	settings         clusterSettings //As applied from log
+	settingsProposed time.Time       //When leader last sent its own
+}
+
+func kvStoreHandler(commitCh chan raft.LogEntry, kvResponse chan KVResponse, leases *leaseTable, victims chan []Command) {
 
 	//Create kv store
-	kvstore := make(map[string]value)
+	store := &kvStore{
+		data:       newOrderedMap(),
+		sessions:   newSessionTable(),
+		leases:     leases,
+		locks:      make(map[string]*lockState),
+		namespaces: map[string]*namespace{"": {}},
+		evicting:   make(map[string]time.Time),
+		expiring:   make(map[string]time.Time),
+		victims:    victims,
+		settings:   defaultSettings(),
+	}
 
 	for {
 		logEntry := <-commitCh //Receive from raft
 		command := Command(logEntry.Data())
+		if logEntry.Lsn() > 0 {
+			store.revision = int64(logEntry.Lsn())
+			hub.applied(store.revision)
+		}
+		if logEntry.Kind() != raft.CommandEntry {
+			continue //No-op or config entry of raft, nobody waits for it
+		}
+		for _, id := range store.sessions.tick(command.Timestamp) {
+			store.releaseSession(id)
+		}
 
-		response := ""
-		switch command.Cmd {
-		case "set", "cas":
-			response = setCas(command, kvstore, commitCh)
-		case "get", "getm":
-			response = getValueMeta(command, kvstore)
-		case "delete":
-			response = deleteKey(command, kvstore)
-		case "expire":
-			response = expiryHandler(command, kvstore)
-			continue //No one is waiting for response
-		default:
-			continue
+		response := store.authorize(command)
+		if response == "" {
+			var ok bool
+			response, ok = store.sessions.duplicate(command)
+			if !ok {
+				response, ok = store.apply(logEntry, command)
+				if !ok {
+					continue //No one is waiting for response
+				}
+				store.sessions.record(command, response)
+			}
 		}
 
 		if logEntry.Committed() {
@@ -44,26 +77,111 @@ func kvStoreHandler(commitCh chan raft.LogEntry, kvResponse chan KVResponse) {
 	}
 }
 
-func setCas(command Command, kvstore map[string]value, commitCh chan raft.LogEntry) string {
+//Apply command to kv store and return its response
+//False if it is not a client command
+func (store *kvStore) apply(logEntry raft.LogEntry, command Command) (string, bool) {
+
+	if namespacedCommands[command.Cmd] {
+		if response := store.admit(command); response != "" {
+			return response, true
+		}
+		command = scopeCommand(command)
+	}
+
+	switch command.Cmd {
+	case "set", "cas", "put", "replace":
+		return store.setCas(command), true
+	case "get", "getm":
+		return store.getValueMeta(command), true
+	case "delete", "casdelete":
+		return store.deleteKey(command), true
+	case "touch":
+		return store.touchKey(command), true
+	case "ttl":
+		return store.ttlKey(command), true
+	case "incr":
+		return store.incrKey(command), true
+	case "txn":
+		return store.applyTxn(command), true
+	case "range":
+		return store.rangeKeys(command), true
+	case "register":
+		return store.sessions.register(logEntry.Lsn(), command.User), true
+	case "unregister":
+		response := store.sessions.unregister(command)
+		if response == "OK" {
+			store.releaseSession(command.ClientID)
+		}
+		return response, true
+	case "lock":
+		return store.lock(logEntry, command), true
+	case "unlock":
+		return store.unlock(command), true
+	case "lock-status":
+		return store.lockStatus(command), true
+	case "namespacecreate":
+		return store.createNamespace(command), true
+	case "namespacequota":
+		return store.setQuota(command), true
+	case "namespacedelete":
+		return store.deleteNamespace(command), true
+	case "stats":
+		return store.stats(command), true
+	case "useradd", "userdelete", "userpasswd", "usergrant", "userrevoke",
+		"roleadd", "roledelete", "rolegrant", "rolerevoke":
+		response := acl.change(command)
+		if response == "OK" {
+			hub.recheck() //Watches of keys which can't be read now are dropped
+		}
+		return response, true
+	case "leasegrant":
+		return store.grantLease(logEntry, command), true
+	case "leasekeepalive":
+		return store.keepAliveLease(command), true
+	case "leaserevoke":
+		return store.revokeLease(command), true
+	case "leaseexpire":
+		store.expireLease(command)
+	case "evict":
+		store.evictKey(command)
+	case "evictcheck":
+		store.findVictims()
+	case "expirecheck":
+		store.findExpired()
+	case "settings":
+		store.applySettings(command)
+	case "settingscheck":
+		store.checkSettings()
+	case "expire":
+		store.expiryHandler(command)
+	}
+	return "", false
+}
+
+func (store *kvStore) setCas(command Command) string {
 
 	key := command.Key
-	val := command.Value
-	numbytes := command.Length
-	exptime := command.ExpiryTime
 	version := command.Version
 
 	//Check if already exist
-	data, ok := kvstore[key]
+	data, ok := store.data.get(key)
 
-	if command.Cmd == "set" {
+	switch command.Cmd {
+	case "set":
 		if ok == true {
 			log.Print("Key already exists")
 			return ERR_VERSION
 		}
-		//Get a random number as version
-		version = int64(rand.Intn(10000))
 
-	} else { //CAS
+	case "put": //Set, overwriting if exists
+
+	case "replace": //Set only if exists
+		if ok == false {
+			log.Print("Key not found")
+			return ERR_NOT_FOUND
+		}
+
+	default: //CAS
 		if ok == false {
 			log.Print("Key not found")
 			return ERR_NOT_FOUND
@@ -73,41 +191,71 @@ func setCas(command Command, kvstore map[string]value, commitCh chan raft.LogEnt
 			log.Print("Version mismatch")
 			return ERR_VERSION
 		}
+	}
 
-		//Increment Version
-		version++
+	if !store.leaseExists(command.Lease) {
+		log.Print("Lease not found")
+		return ERR_LEASE_NOT_FOUND
 	}
 
-	//Add value to keystore
-	kvstore[key] = value{[]byte(val), numbytes, version, exptime}
+	newVal := store.newValue(command, data)
+	if !store.fits(key, newVal) {
+		log.Print("Out of memory")
+		return ERR_OUT_OF_MEMORY
+	}
+	if !store.withinQuota(key, newVal) {
+		log.Print("Quota exceeded")
+		return ERR_QUOTA_EXCEEDED
+	}
 
-	//Inform KV-Handler by sending a fake log entry to expire
-	sendExpiry := func() {
-		command := raft.Command{"expire", key, 0, 0, version, ""}
-		fakeLogEntry := raft.LogItem{raft.Lsn(0), command, true, 0}
+	return store.storeValue(key, newVal, data.lease)
+}
 
-		commitCh <- fakeLogEntry
-	}
+//Value command sets in key, old being the value it has now
+func (store *kvStore) newValue(command Command, old value) value {
+	//Version is the revision at which key was changed, so it is
+	//same on all servers and never repeats
+	return value{val: []byte(command.Value), numbytes: command.Length, version: store.revision,
+		exptime: command.ExpiryTime, lease: command.Lease, hits: old.hits}
+}
 
-	//Set expiry timer
-	if exptime > 0 {
-		time.AfterFunc(time.Duration(exptime)*time.Second, sendExpiry)
-	}
+//Add value to keystore, once checks are done
+func (store *kvStore) storeValue(key string, newVal value, oldLease int64) string {
+	store.data.set(key, newVal)
+	store.attachKey(key, oldLease, newVal.lease)
+	store.access(key)
+	store.setExpiry(key)
 
-	return fmt.Sprintf("OK %d", version)
+	stored, _ := store.data.get(key)
+	hub.publish(watchEvent{kind: "put", key: key, revision: store.revision, val: stored})
+
+	return fmt.Sprintf("OK %d", newVal.version)
 }
 
-func getValueMeta(command Command, kvstore map[string]value) string {
+//Set expiry time of key as per its exptime, in log time, so it is the
+//same on all replicas. Leader appends an expire command once it is due
+func (store *kvStore) setExpiry(key string) {
+	val, _ := store.data.get(key)
+	val.expiresAt = 0
+	if val.exptime > 0 {
+		val.expiresAt = store.sessions.clock + val.exptime*int64(time.Second)
+	}
+	store.data.set(key, val)
+}
+
+func (store *kvStore) getValueMeta(command Command) string {
 	key := command.Key
 
 	//Check if already exist
-	val, ok := kvstore[key]
+	val, ok := store.data.get(key)
 
 	if ok == false {
 		log.Print("Key not found")
 		return ERR_NOT_FOUND
 	}
 
+	store.access(key)
+
 	retStr := "VALUE "
 
 	if command.Cmd == "get" {
@@ -121,40 +269,107 @@ func getValueMeta(command Command, kvstore map[string]value) string {
 	return retStr
 }
 
-func deleteKey(command Command, kvstore map[string]value) string {
+func (store *kvStore) deleteKey(command Command) string {
 	key := command.Key
 
 	//Check if already exist
-	_, ok := kvstore[key]
+	val, ok := store.data.get(key)
 
 	if ok == false {
 		log.Print("Key not found")
 		return ERR_NOT_FOUND
 	}
 
+	if command.Cmd == "casdelete" && val.version != command.Version {
+		log.Print("Version mismatch")
+		return ERR_VERSION
+	}
+
 	// If value is present delete it
-	delete(kvstore, key)
+	store.data.delete(key)
+	store.attachKey(key, val.lease, 0)
+	hub.publish(watchEvent{kind: "delete", key: key, revision: store.revision})
 
 	return "DELETED"
 }
 
-func expiryHandler(command Command, kvstore map[string]value) string {
+//Delete key expired by leader, unless it was changed or touched after
+//it was picked
+func (store *kvStore) expiryHandler(command Command) {
 	key := command.Key
-	version := command.Version
+	delete(store.expiring, key)
+
+	val, ok := store.data.get(key)
+	if !ok {
+		return //Key already removed
+	}
 
-	//Check if exist
-	val, ok := kvstore[key]
+	if val.version == command.Version && val.expiresAt > 0 && command.Timestamp >= val.expiresAt {
+		store.data.delete(key)
+		store.attachKey(key, val.lease, 0)
+		log.Print(key + " expired.")
+		hub.publish(watchEvent{kind: "expire", key: key, revision: store.revision})
+	}
+}
+
+//Pick keys whose expiry time has passed and hand them to evictor, which
+//appends expire commands for them. Sent only to the leader, by evictor
+func (store *kvStore) findExpired() {
+	now := time.Now()
+	var expired []Command
+	store.data.ascend("", func(key string, val value) bool {
+		if val.expiresAt > 0 && now.UnixNano() >= val.expiresAt && now.Sub(store.expiring[key]) >= EVICT_RETRY_INTERVAL {
+			expired = append(expired, Command{Cmd: "expire", Key: key, Version: val.version})
+			store.expiring[key] = now
+		}
+		return true
+	})
 
+	if len(expired) > 0 {
+		select {
+		case store.victims <- expired:
+		default:
+			//Evictor is busy, they are picked again after retry interval
+			for _, command := range expired {
+				delete(store.expiring, command.Key)
+			}
+		}
+	}
+}
+
+//Change expiry time of a key without modifying it
+func (store *kvStore) touchKey(command Command) string {
+	key := command.Key
+
+	val, ok := store.data.get(key)
 	if ok == false {
-		//Key already removed
+		log.Print("Key not found")
 		return ERR_NOT_FOUND
 	}
 
-	if val.version == version {
-		// If same version, remove it
-		delete(kvstore, key)
-		log.Print(key + " expired.")
+	val.exptime = command.ExpiryTime
+	store.data.set(key, val)
+	store.setExpiry(key)
+
+	return "TOUCHED"
+}
+
+//Remaining seconds till a key expires, -1 if it never does
+func (store *kvStore) ttlKey(command Command) string {
+	val, ok := store.data.get(command.Key)
+	if ok == false {
+		log.Print("Key not found")
+		return ERR_NOT_FOUND
 	}
 
-	return "EXPIRY_SUCCESS"
+	if val.expiresAt == 0 {
+		return "TTL -1"
+	}
+
+	remaining := time.Duration(val.expiresAt - store.sessions.clock)
+	seconds := int64((remaining + time.Second - 1) / time.Second) //Round up
+	if seconds < 0 {
+		seconds = 0
+	}
+	return fmt.Sprintf("TTL %d", seconds)
 }
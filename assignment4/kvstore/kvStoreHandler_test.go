@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireThroughLog(t *testing.T) {
+	store := newTestStore()
+	key := scopedKey("", "e")
+	store.sessions.clock = time.Now().UnixNano()
+	store.setCas(Command{Cmd: "set", Key: key, Value: "v", Length: 1, ExpiryTime: 100})
+
+	//Not due yet, so leader appends nothing
+	store.findExpired()
+	select {
+	case commands := <-store.victims:
+		t.Fatalf("got %+v before key is due", commands)
+	default:
+	}
+
+	val, _ := store.data.get(key)
+	val.expiresAt = time.Now().Add(-time.Second).UnixNano()
+	store.data.set(key, val)
+
+	store.findExpired()
+	var commands []Command
+	select {
+	case commands = <-store.victims:
+	default:
+		t.Fatal("no expire command for due key")
+	}
+	if len(commands) != 1 || commands[0].Cmd != "expire" || commands[0].Version != val.version {
+		t.Fatalf("got %+v", commands)
+	}
+
+	//Picked already, so not again until retry interval
+	store.findExpired()
+	if len(store.victims) != 0 {
+		t.Error("key picked twice")
+	}
+
+	//Applied as a log entry, event has its revision
+	store.revision = 9
+	command := commands[0]
+	command.Timestamp = time.Now().UnixNano()
+	store.expiryHandler(command)
+	if _, ok := store.data.get(key); ok {
+		t.Error("key not expired")
+	}
+	if e := hub.history[len(hub.history)-1]; e.kind != "expire" || e.key != key || e.revision != 9 {
+		t.Errorf("got event %+v, want expire at revision 9", e)
+	}
+}
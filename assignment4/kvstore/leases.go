@@ -0,0 +1,275 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Leases let a group of keys expire together. A client grants a lease
+//with a ttl, attaches keys to it and keeps it alive. When the lease
+//expires or is revoked, all its keys are deleted.
+//
+//	lease grant <ttl>\r\n
+//	lease keepalive <lease_id>\r\n
+//	lease revoke <lease_id>\r\n
+//	set <key> <exptime> <numbytes> lease <lease_id>\r\n
+//
+//A lease can be kept alive or revoked only by the user who granted it,
+//or a user with the root role, since revoking deletes its keys.
+//
+//Only the leader decides that a lease expired, by appending a
+//leaseexpire command. Replicas apply it like any other command, and
+//time comes from Timestamp of commands, so all of them agree on which
+//keys were deleted and when.
+
+//How often the leader looks for expired leases
+const LEASE_CHECK_INTERVAL = 500 * time.Millisecond
+
+//Wait before proposing expiry of the same lease again
+const LEASE_RETRY_INTERVAL = 5 * time.Second
+
+//Longest ttl of a lease, in seconds
+const MAX_LEASE_TTL = 365 * 24 * 60 * 60
+
+type lease struct {
+	ttl       int64           //Seconds
+	expiresAt int64           //In log time (unix nanoseconds)
+	keys      map[string]bool //Attached keys
+	proposed  time.Time       //When leader last proposed its expiry
+	locks     []string        //Locks it holds or waits for
+	session   int64           //Session which took it for a lock, 0 if none
+	user      string          //Who granted it, only they or root can keep it alive or revoke it
+}
+
+//Leases of kvstore, changed by kvStoreHandler and read by leaseExpirer
+type leaseTable struct {
+	lock   sync.Mutex
+	leases map[int64]*lease //By lease id, lsn of grant
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{leases: make(map[int64]*lease)}
+}
+
+//lease grant|keepalive|revoke <arg>
+func parseLease(fields []string) (Command, string) {
+	if len(fields) != 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	arg, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || arg <= 0 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	switch fields[1] {
+	case "grant":
+		if arg > MAX_LEASE_TTL {
+			return Command{}, ERR_CMD_ERR
+		}
+		return Command{Cmd: "leasegrant", ExpiryTime: arg}, ""
+	case "keepalive":
+		return Command{Cmd: "leasekeepalive", Lease: arg}, ""
+	case "revoke":
+		return Command{Cmd: "leaserevoke", Lease: arg}, ""
+	}
+	return Command{}, ERR_CMD_ERR
+}
+
+//Optional "lease <lease_id>" at the end of set and cas
+//Returns the lease id (0 if none) and fields without it
+func parseLeaseOption(fields []string, reqLen int) (int64, []string, bool) {
+	if len(fields) != reqLen+2 || fields[reqLen] != "lease" {
+		return 0, fields, true
+	}
+
+	id, err := strconv.ParseInt(fields[reqLen+1], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fields, false
+	}
+	return id, fields[:reqLen], true
+}
+
+//New lease, its id is the lsn of grant command
+func (store *kvStore) grantLease(logEntry raft.LogEntry, command Command) string {
+	id := int64(logEntry.Lsn())
+	store.addLease(id, command.ExpiryTime, command.User)
+	return fmt.Sprintf("LEASE %d %d", id, command.ExpiryTime)
+}
+
+func (store *kvStore) addLease(id int64, ttl int64, user string) *lease {
+	l := &lease{ttl: ttl, keys: make(map[string]bool), user: user}
+	l.expiresAt = store.sessions.clock + l.ttl*int64(time.Second)
+
+	store.leases.lock.Lock()
+	store.leases.leases[id] = l
+	store.leases.lock.Unlock()
+	return l
+}
+
+func (store *kvStore) keepAliveLease(command Command) string {
+	store.leases.lock.Lock()
+	defer store.leases.lock.Unlock()
+
+	l, ok := store.leases.leases[command.Lease]
+	if !ok {
+		return ERR_LEASE_NOT_FOUND
+	}
+	if !canUseLease(l, command.User) {
+		return ERR_PERMISSION_DENIED
+	}
+
+	l.expiresAt = store.sessions.clock + l.ttl*int64(time.Second)
+	store.sessions.touch(l.session) //Locks of session are in use
+	return fmt.Sprintf("LEASE %d %d", command.Lease, l.ttl)
+}
+
+func (store *kvStore) revokeLease(command Command) string {
+	if errStr := store.checkLeaseOwner(command.Lease, command.User); errStr != "" {
+		return errStr
+	}
+	store.removeLease(command.Lease, "delete")
+	return "REVOKED"
+}
+
+//Whether user may keep alive or revoke lease l. Must hold lock of leases
+func canUseLease(l *lease, user string) bool {
+	return l.user == user || acl.isRoot(user)
+}
+
+//Error if lease doesn't exist or user may not revoke it
+func (store *kvStore) checkLeaseOwner(id int64, user string) string {
+	store.leases.lock.Lock()
+	defer store.leases.lock.Unlock()
+
+	l, ok := store.leases.leases[id]
+	if !ok {
+		return ERR_LEASE_NOT_FOUND
+	}
+	if !canUseLease(l, user) {
+		log.Print("Lease " + strconv.FormatInt(id, 10) + " is not of " + user)
+		return ERR_PERMISSION_DENIED
+	}
+	return ""
+}
+
+//Proposed by the leader when it found the lease expired
+//Ignored if it was kept alive meanwhile
+func (store *kvStore) expireLease(command Command) {
+	store.leases.lock.Lock()
+	l, ok := store.leases.leases[command.Lease]
+	due := ok && command.Timestamp >= l.expiresAt
+	store.leases.lock.Unlock()
+
+	if due {
+		log.Print("Lease " + strconv.FormatInt(command.Lease, 10) + " expired")
+		store.removeLease(command.Lease, "expire")
+	}
+}
+
+//Delete lease and its keys, kind is the event of deleted keys
+func (store *kvStore) removeLease(id int64, kind string) bool {
+	store.leases.lock.Lock()
+	l, ok := store.leases.leases[id]
+	delete(store.leases.leases, id)
+	store.leases.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	//Same order of events on all replicas
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		store.data.delete(key)
+		hub.publish(watchEvent{kind: kind, key: key, revision: store.revision})
+	}
+
+	for _, name := range l.locks {
+		store.releaseLock(name, id)
+	}
+	return true
+}
+
+//Check that lease of command exists, before key is changed
+func (store *kvStore) leaseExists(id int64) bool {
+	if id == 0 {
+		return true
+	}
+
+	store.leases.lock.Lock()
+	defer store.leases.lock.Unlock()
+
+	_, ok := store.leases.leases[id]
+	return ok
+}
+
+//Move key from one lease to another, either can be 0 for none
+func (store *kvStore) attachKey(key string, from, to int64) {
+	if from == to {
+		return
+	}
+
+	store.leases.lock.Lock()
+	defer store.leases.lock.Unlock()
+
+	if l, ok := store.leases.leases[from]; ok {
+		delete(l.keys, key)
+	}
+	if l, ok := store.leases.leases[to]; ok {
+		l.keys[key] = true
+	}
+}
+
+//Leases which have expired as per now, and not proposed recently
+//A lease gets full ttl from leaderSince, as keepalives sent while
+//there was no leader could not get through
+func (t *leaseTable) due(now, leaderSince time.Time) []int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var ids []int64
+	for id, l := range t.leases {
+		if now.UnixNano() < l.expiresAt || now.Sub(leaderSince) < time.Duration(l.ttl)*time.Second {
+			continue
+		}
+		if now.Sub(l.proposed) < LEASE_RETRY_INTERVAL {
+			continue
+		}
+		l.proposed = now
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+//Append leaseexpire for expired leases while this server is the leader
+func leaseExpirer(raftObj *raft.Raft, leases *leaseTable) {
+
+	var leaderSince time.Time
+	for now := range time.Tick(LEASE_CHECK_INTERVAL) {
+		if !raftObj.IsLeader() {
+			leaderSince = time.Time{}
+			continue
+		}
+		if leaderSince.IsZero() {
+			leaderSince = now
+		}
+
+		for _, id := range leases.due(now, leaderSince) {
+			//No one waits for response, it is not sent
+			if _, err := appendCommand(raftObj, Command{Cmd: "leaseexpire", Lease: id}); err != nil {
+				log.Print("Couldn't expire lease: " + err.Error())
+			}
+		}
+	}
+}
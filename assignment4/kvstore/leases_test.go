@@ -0,0 +1,44 @@
+package main
+
+import (
+	"assignment4/raft"
+	"testing"
+)
+
+func TestLeaseOwner(t *testing.T) {
+	defer func(old *accessTable) { acl = old }(acl)
+	acl = testAccessTable()
+	acl.change(Command{Cmd: "useradd", Key: "eve", Value: newPasswordHash("pw")})
+
+	store := newTestStore()
+	grant := raft.LogItem{LSN: 7, DATA: raft.Command{Cmd: "leasegrant", ExpiryTime: 60, User: "bob"}}
+	if response := store.grantLease(grant, Command(grant.DATA)); response != "LEASE 7 60" {
+		t.Fatalf("got %q", response)
+	}
+	key := scopedKey("", "a")
+	store.setCas(Command{Cmd: "set", Key: key, Value: "1", Length: 1, Lease: 7, User: "bob"})
+
+	//Another user can't keep it alive or revoke it, even knowing its id
+	if response := store.keepAliveLease(Command{Lease: 7, User: "eve"}); response != ERR_PERMISSION_DENIED {
+		t.Errorf("keepalive by eve: got %q", response)
+	}
+	if response := store.revokeLease(Command{Lease: 7, User: "eve"}); response != ERR_PERMISSION_DENIED {
+		t.Errorf("revoke by eve: got %q", response)
+	}
+	if _, ok := store.data.get(key); !ok {
+		t.Fatal("key of lease deleted by another user")
+	}
+
+	if response := store.keepAliveLease(Command{Lease: 7, User: "bob"}); response != "LEASE 7 60" {
+		t.Errorf("keepalive by bob: got %q", response)
+	}
+	if response := store.revokeLease(Command{Lease: 7, User: ROOT_USER}); response != "REVOKED" {
+		t.Errorf("revoke by root: got %q", response)
+	}
+	if _, ok := store.data.get(key); ok {
+		t.Error("key of revoked lease not deleted")
+	}
+	if response := store.revokeLease(Command{Lease: 7, User: "bob"}); response != ERR_LEASE_NOT_FOUND {
+		t.Errorf("revoke again: got %q", response)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+//Locks for coordinating clients. Each lock command gets a lease of its
+//own, which the client keeps alive while it holds or waits for the lock.
+//
+//	lock <name> <ttl>\r\n
+//	unlock <name> <lease_id>\r\n
+//	lock-status <name>\r\n
+//
+//Reply to lock is "LOCKED <lease_id> <token>" if the lock was free,
+//otherwise "WAITING <lease_id> <position>" and the client is queued.
+//Waiters get the lock in the order they asked for it, when the holder
+//unlocks, its lease expires or its session expires. The client sees it
+//became the holder with lock-status, which replies
+//"LOCK <name> <holder_lease_id> <token> <num_waiters>". Only the user
+//who took the lock, or root, can unlock it.
+//
+//Token is the lsn of the entry which gave the lock to its holder, so a
+//newer holder always has a bigger token. Resources guarded by the lock
+//can reject requests with a token smaller than one they have seen.
+
+type lockState struct {
+	queue []int64 //Lease ids, holder first, then waiters in order
+	token int64   //Fencing token of holder
+}
+
+//lock <name> <ttl>, unlock <name> <lease_id>, lock-status <name>
+func parseLock(fields []string) (Command, string) {
+	if fields[0] == "lock-status" {
+		if len(fields) != 2 {
+			return Command{}, ERR_CMD_ERR
+		}
+		return Command{Cmd: "lock-status", Key: fields[1]}, ""
+	}
+
+	if len(fields) != 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+	arg, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || arg <= 0 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	if fields[0] == "unlock" {
+		return Command{Cmd: "unlock", Key: fields[1], Lease: arg}, ""
+	}
+	if arg > MAX_LEASE_TTL {
+		return Command{}, ERR_CMD_ERR
+	}
+	return Command{Cmd: "lock", Key: fields[1], ExpiryTime: arg}, ""
+}
+
+//Take the lock, or queue up for it, with a new lease
+func (store *kvStore) lock(logEntry raft.LogEntry, command Command) string {
+	id := int64(logEntry.Lsn())
+
+	l := store.addLease(id, command.ExpiryTime, command.User)
+	store.leases.lock.Lock()
+	l.locks = append(l.locks, command.Key)
+	l.session = command.ClientID
+	store.leases.lock.Unlock()
+
+	state, ok := store.locks[command.Key]
+	if !ok {
+		state = &lockState{}
+		store.locks[command.Key] = state
+	}
+	state.queue = append(state.queue, id)
+
+	if len(state.queue) == 1 {
+		state.token = store.revision
+		return fmt.Sprintf("LOCKED %d %d", id, state.token)
+	}
+	return fmt.Sprintf("WAITING %d %d", id, len(state.queue)-1)
+}
+
+//Give up the lock, or stop waiting for it. Lease of lock is revoked
+func (store *kvStore) unlock(command Command) string {
+	state, ok := store.locks[command.Key]
+	if !ok || !containsLease(state.queue, command.Lease) {
+		return ERR_NOT_FOUND
+	}
+	//Lease id is shown by lock-status, so knowing it is not enough
+	if errStr := store.checkLeaseOwner(command.Lease, command.User); errStr != "" {
+		return errStr
+	}
+
+	store.removeLease(command.Lease, "delete")
+	return "UNLOCKED"
+}
+
+func (store *kvStore) lockStatus(command Command) string {
+	state, ok := store.locks[command.Key]
+	if !ok {
+		return ERR_NOT_FOUND
+	}
+	return fmt.Sprintf("LOCK %s %d %d %d", unscopedKey(command.Key), state.queue[0], state.token, len(state.queue)-1)
+}
+
+//Remove lease from queue of lock, next waiter gets it if it was the holder
+func (store *kvStore) releaseLock(name string, id int64) {
+	state, ok := store.locks[name]
+	if !ok {
+		return
+	}
+
+	for i, lease := range state.queue {
+		if lease == id {
+			state.queue = append(state.queue[:i], state.queue[i+1:]...)
+			if i == 0 {
+				state.token = store.revision
+			}
+			break
+		}
+	}
+
+	if len(state.queue) == 0 {
+		delete(store.locks, name)
+	}
+}
+
+//Revoke leases of locks taken in an expired session
+func (store *kvStore) releaseSession(session int64) {
+	var ids []int64
+	store.leases.lock.Lock()
+	for id, l := range store.leases.leases {
+		if l.session == session {
+			ids = append(ids, id)
+		}
+	}
+	store.leases.lock.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		store.removeLease(id, "expire")
+	}
+}
+
+func containsLease(ids []int64, id int64) bool {
+	for _, lease := range ids {
+		if lease == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"assignment4/raft"
+	"strings"
+	"testing"
+)
+
+func TestUnlockOwner(t *testing.T) {
+	defer func(old *accessTable) { acl = old }(acl)
+	acl = testAccessTable()
+	acl.change(Command{Cmd: "useradd", Key: "eve", Value: newPasswordHash("pw")})
+
+	store := newTestStore()
+	name := scopedKey("", "job")
+	take := func(lsn raft.Lsn, user string) string {
+		store.revision = int64(lsn)
+		entry := raft.LogItem{LSN: lsn}
+		return store.lock(entry, Command{Cmd: "lock", Key: name, ExpiryTime: 60, User: user})
+	}
+
+	if response := take(3, "bob"); response != "LOCKED 3 3" {
+		t.Fatalf("got %q", response)
+	}
+	if response := take(4, "eve"); response != "WAITING 4 1" {
+		t.Fatalf("got %q", response)
+	}
+
+	//eve knows the holder's lease from lock-status, but can't use it
+	if response := store.lockStatus(Command{Key: name}); !strings.HasPrefix(response, "LOCK job 3 ") {
+		t.Fatalf("got %q", response)
+	}
+	if response := store.unlock(Command{Key: name, Lease: 3, User: "eve"}); response != ERR_PERMISSION_DENIED {
+		t.Errorf("unlock by eve: got %q", response)
+	}
+	if state := store.locks[name]; state.queue[0] != 3 {
+		t.Errorf("holder changed to %d", state.queue[0])
+	}
+
+	store.revision = 5
+	if response := store.unlock(Command{Key: name, Lease: 3, User: "bob"}); response != "UNLOCKED" {
+		t.Errorf("unlock by bob: got %q", response)
+	}
+	if response := store.lockStatus(Command{Key: name}); response != "LOCK job 4 5 0" {
+		t.Errorf("got %q, want eve holding with token 5", response)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"assignment4/raft"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+//Memory budget of the kvstore, MaxMemory bytes in settings. A key is
+//counted as the bytes of its name and value and a fixed overhead, so
+//every replica counts the same. When the budget is used up,
+//EvictionPolicy in settings decides what happens:
+//
+//	reject: writes which need more memory fail with ERR_OUT_OF_MEMORY
+//	lru:    least recently used keys are evicted
+//	lfu:    least frequently used keys are evicted
+//	ttl:    keys with an expiry time are evicted, soonest to expire first
+//
+//Only the leader picks keys to evict, and appends an evict command for
+//each, so replicas delete the same keys at the same point. Reads go
+//through the log too, so use of keys is the same on all replicas.
+//Writes can go over the budget till evictions are applied, but not
+//beyond MEMORY_OVERSHOOT_PERCENT more, after which they are rejected
+//as with reject.
+
+//Bytes counted for a key besides its name and value
+const ENTRY_OVERHEAD = 64
+
+//How often the leader checks if keys must be evicted
+const EVICT_CHECK_INTERVAL = 200 * time.Millisecond
+
+//Wait before proposing eviction of the same key again
+const EVICT_RETRY_INTERVAL = 5 * time.Second
+
+//How far over MaxMemory writes can go when keys are evicted
+const MEMORY_OVERSHOOT_PERCENT = 25
+
+func entrySize(key string, val value) int64 {
+	return int64(len(key)) + int64(len(val.val)) + ENTRY_OVERHEAD
+}
+
+func validEvictionPolicy(policy string) bool {
+	switch policy {
+	case "", "reject", "lru", "lfu", "ttl":
+		return true
+	}
+	return false
+}
+
+//Memory writes can't take the store beyond, 0 for no limit
+func (store *kvStore) memoryCeiling() int64 {
+	max := store.settings.maxMemory
+	if max <= 0 || store.settings.evictionPolicy == "reject" {
+		return max
+	}
+	if max > math.MaxInt64/2 {
+		return math.MaxInt64
+	}
+	return max + max*MEMORY_OVERSHOOT_PERCENT/100
+}
+
+//False if storing val in key needs memory which isn't there
+func (store *kvStore) fits(key string, val value) bool {
+	ceiling := store.memoryCeiling()
+	if ceiling <= 0 {
+		return true
+	}
+
+	grow := entrySize(key, val)
+	if old, ok := store.data.get(key); ok {
+		grow -= entrySize(key, old)
+	}
+	return grow <= 0 || store.data.bytes+grow <= ceiling
+}
+
+//Like fits, for all keys a transaction changes, with sizes they will
+//have after it (0 if deleted)
+func (store *kvStore) txnFits(sizes map[string]int64) bool {
+	ceiling := store.memoryCeiling()
+	if ceiling <= 0 {
+		return true
+	}
+
+	grow := int64(0)
+	for key, size := range sizes {
+		grow += size
+		if old, ok := store.data.get(key); ok {
+			grow -= entrySize(key, old)
+		}
+	}
+	return grow <= 0 || store.data.bytes+grow <= ceiling
+}
+
+//Record use of key, for lru and lfu
+func (store *kvStore) access(key string) {
+	val, ok := store.data.get(key)
+	if !ok {
+		return
+	}
+	val.lastAccess = store.revision
+	val.hits++
+	store.data.set(key, val)
+}
+
+//Pick keys to evict till memory used is within budget, and hand them
+//to evictor. Sent only to the leader, by evictor itself
+func (store *kvStore) findVictims() {
+	if store.settings.maxMemory <= 0 || store.settings.evictionPolicy == "reject" || store.data.bytes <= store.settings.maxMemory {
+		return
+	}
+
+	type candidate struct {
+		key string
+		val value
+	}
+
+	now := time.Now()
+	policy := store.settings.evictionPolicy
+	excess := store.data.bytes - store.settings.maxMemory
+	var candidates []candidate
+	store.data.ascend("", func(key string, val value) bool {
+		if now.Sub(store.evicting[key]) < EVICT_RETRY_INTERVAL {
+			excess -= entrySize(key, val) //Eviction not applied yet
+			return true
+		}
+		if policy == "ttl" && val.expiresAt == 0 {
+			return true //Never expires, so never evicted
+		}
+		candidates = append(candidates, candidate{key, val})
+		return true
+	})
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].val, candidates[j].val
+		switch {
+		case policy == "lfu" && a.hits != b.hits:
+			return a.hits < b.hits
+		case policy == "ttl":
+			return a.expiresAt < b.expiresAt
+		}
+		return a.lastAccess < b.lastAccess
+	})
+
+	var victims []Command
+	for _, c := range candidates {
+		if excess <= 0 {
+			break
+		}
+		victims = append(victims, Command{Cmd: "evict", Key: c.key, Version: c.val.version})
+		store.evicting[c.key] = now
+		excess -= entrySize(c.key, c.val)
+	}
+
+	if len(victims) > 0 {
+		select {
+		case store.victims <- victims:
+		default:
+			//Evictor is busy, they are picked again after retry interval
+		}
+	}
+}
+
+//Delete key evicted by leader, unless it changed after it was picked
+func (store *kvStore) evictKey(command Command) {
+	delete(store.evicting, command.Key)
+
+	val, ok := store.data.get(command.Key)
+	if !ok || val.version != command.Version {
+		return
+	}
+
+	store.data.delete(command.Key)
+	store.attachKey(command.Key, val.lease, 0)
+	log.Print(command.Key + " evicted")
+	hub.publish(watchEvent{kind: "evict", key: command.Key, revision: store.revision})
+}
+
+//While this server is the leader, has kvstore look for keys to evict or
+//expire and for settings to change, and appends commands for them
+func evictor(raftObj *raft.Raft, commitCh chan raft.LogEntry, victims chan []Command) {
+
+	ticker := time.NewTicker(EVICT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !raftObj.IsLeader() {
+				continue
+			}
+			//Fake entries, which only make kvstore look for keys, or
+			//for settings of config not applied yet
+			for _, cmd := range []string{"evictcheck", "expirecheck", "settingscheck"} {
+				check := raft.Command{Cmd: cmd}
+				commitCh <- raft.LogItem{LSN: raft.Lsn(0), DATA: check, COMMITTED: true}
+			}
+
+		case commands := <-victims:
+			for _, command := range commands {
+				if _, err := appendCommand(raftObj, command); err != nil {
+					log.Print("Couldn't " + command.Cmd + ": " + err.Error())
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Namespaces keep keys of different teams apart. A connection selects a
+//namespace with use, after which its commands see only keys (and locks)
+//of that namespace. Namespaces are created and deleted through the log,
+//and can have quotas on number of keys, their bytes and request rate.
+//
+//	use <namespace>\r\n
+//	namespace create <namespace> [maxkeys <n>] [maxbytes <n>] [rate <n>]\r\n
+//	namespace quota <namespace> [maxkeys <n>] [maxbytes <n>] [rate <n>]\r\n
+//	namespace delete <namespace>\r\n
+//	stats [<namespace>]\r\n
+//
+//Connections start in the namespace named default, which always exists.
+//Keys are stored with their namespace and a space in front, so each
+//namespace is one range of keys. Neither namespace names nor keys of the
+//text protocol can have a space, so the two never mix up.
+//
+//Rate is requests per second, with bursts of up to a second of them.
+//It is checked with the leader's time of the command, so all replicas
+//throttle the same commands. The leader also rejects commands over the
+//rate before appending them, so they don't take up the log.
+
+//Name of the namespace of keys stored before namespaces were added
+const DEFAULT_NAMESPACE = "default"
+
+const MAX_NAMESPACE_LEN = 64
+
+//Largest rate quota, in requests per second
+const MAX_NAMESPACE_RATE = 1000000
+
+type namespace struct {
+	maxKeys, maxBytes, maxRate int64 //Quotas, 0 for no limit
+
+	tokens   int64 //Requests allowed now, times a second in nanoseconds
+	refilled int64 //Log time tokens were last added
+
+	requests, throttled int64 //Commands run and rejected for rate
+}
+
+//Keys and bytes used by a namespace
+type spaceUsage struct {
+	keys, bytes int64
+}
+
+//Commands which work on keys of the connection's namespace
+var namespacedCommands = map[string]bool{
+	"set": true, "cas": true, "put": true, "replace": true,
+	"get": true, "getm": true, "delete": true, "casdelete": true,
+	"touch": true, "ttl": true, "incr": true, "txn": true, "range": true,
+	"lock": true, "unlock": true, "lock-status": true,
+	"leasegrant": true, "leasekeepalive": true, "leaserevoke": true,
+}
+
+func validNamespace(name string) bool {
+	if name == "" || len(name) > MAX_NAMESPACE_LEN {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+//Name used inside kvstore, "" for the default namespace
+func namespaceID(name string) string {
+	if name == DEFAULT_NAMESPACE {
+		return ""
+	}
+	return name
+}
+
+func namespaceName(id string) string {
+	if id == "" {
+		return DEFAULT_NAMESPACE
+	}
+	return id
+}
+
+//Key as stored in kvstore
+func scopedKey(space, key string) string {
+	return space + " " + key
+}
+
+//Key as seen by clients
+func unscopedKey(key string) string {
+	return key[strings.Index(key, " ")+1:]
+}
+
+func namespaceOf(key string) string {
+	return key[:strings.Index(key, " ")]
+}
+
+//use <namespace>
+func parseUse(fields []string) (Command, string) {
+	if len(fields) != 2 || !validNamespace(fields[1]) {
+		return Command{}, ERR_CMD_ERR
+	}
+	return Command{Cmd: "use", Namespace: namespaceID(fields[1])}, ""
+}
+
+//stats [<namespace>], of the connection's namespace if none is given
+func parseStats(fields []string) (Command, string) {
+	switch {
+	case len(fields) == 1:
+		return Command{Cmd: "stats"}, ""
+	case len(fields) == 2 && validNamespace(fields[1]):
+		return Command{Cmd: "stats", Key: fields[1]}, ""
+	}
+	return Command{}, ERR_CMD_ERR
+}
+
+//namespace create|quota|delete <namespace> [maxkeys <n>] [maxbytes <n>] [rate <n>]
+func parseNamespace(fields []string) (Command, string) {
+	if len(fields) < 3 || !validNamespace(fields[2]) {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Key: fields[2]}
+	switch fields[1] {
+	case "create":
+		command.Cmd = "namespacecreate"
+	case "quota":
+		command.Cmd = "namespacequota"
+	case "delete":
+		if len(fields) != 3 {
+			return Command{}, ERR_CMD_ERR
+		}
+		return Command{Cmd: "namespacedelete", Key: fields[2]}, ""
+	default:
+		return Command{}, ERR_CMD_ERR
+	}
+
+	options := fields[3:]
+	if len(options)%2 != 0 {
+		return Command{}, ERR_CMD_ERR
+	}
+	for i := 0; i < len(options); i += 2 {
+		n, err := strconv.ParseInt(options[i+1], 10, 64)
+		if err != nil || n < 0 {
+			return Command{}, ERR_CMD_ERR
+		}
+		switch options[i] {
+		case "maxkeys":
+			command.MaxKeys = n
+		case "maxbytes":
+			command.MaxBytes = n
+		case "rate":
+			if n > MAX_NAMESPACE_RATE {
+				return Command{}, ERR_CMD_ERR
+			}
+			command.MaxRate = n
+		default:
+			return Command{}, ERR_CMD_ERR
+		}
+	}
+	return command, ""
+}
+
+//Keys of command as stored in kvstore
+//Slices are copied, since command is still in raft's log
+func scopeCommand(command Command) Command {
+	space := command.Namespace
+
+	command.Key = scopedKey(space, command.Key)
+	if command.Cmd == "range" {
+		if command.RangeEnd == "" {
+			command.RangeEnd = prefixEnd(scopedKey(space, ""))
+		} else {
+			command.RangeEnd = scopedKey(space, command.RangeEnd)
+		}
+	}
+
+	if command.Cmd == "txn" {
+		compares := append([]raft.Compare(nil), command.Compares...)
+		for i := range compares {
+			compares[i].Key = scopedKey(space, compares[i].Key)
+		}
+		command.Compares = compares
+		command.Success = scopeOps(space, command.Success)
+		command.Failure = scopeOps(space, command.Failure)
+	}
+	return command
+}
+
+func scopeOps(space string, ops []raft.Command) []raft.Command {
+	scoped := append([]raft.Command(nil), ops...)
+	for i := range scoped {
+		scoped[i].Key = scopedKey(space, scoped[i].Key)
+	}
+	return scoped
+}
+
+//Check namespace of a client command exists and is within its rate
+func (store *kvStore) admit(command Command) string {
+	ns, ok := store.namespaces[command.Namespace]
+	if !ok {
+		return ERR_NAMESPACE_NOT_FOUND
+	}
+
+	ns.requests++
+	if ns.maxRate <= 0 {
+		return ""
+	}
+
+	if !takeToken(&ns.tokens, &ns.refilled, ns.maxRate, store.sessions.clock) {
+		ns.throttled++
+		return ERR_RATE_LIMITED
+	}
+	return ""
+}
+
+//Take one request out of a bucket holding up to a second of them at
+//rate per second, refilled for the time since last one. Tokens are
+//counted times a second in nanoseconds
+func takeToken(tokens, refilled *int64, rate, now int64) bool {
+	elapsed := now - *refilled
+	if elapsed > int64(time.Second) {
+		elapsed = int64(time.Second)
+	}
+	if elapsed < 0 {
+		elapsed = 0 //Clock went back
+	}
+	*refilled = now
+	*tokens += elapsed * rate
+	if *tokens > int64(time.Second)*rate {
+		*tokens = int64(time.Second) * rate
+	}
+
+	if *tokens < int64(time.Second) {
+		return false
+	}
+	*tokens -= int64(time.Second)
+	return true
+}
+
+//Rates of namespaces as applied, so that the leader can reject commands
+//over the rate before appending them, instead of filling the log with
+//commands which are only rejected when applied. Uses the leader's own
+//clock; admit still decides for the commands which get into the log
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*rateBucket //By namespace id, only those with a rate
+}
+
+type rateBucket struct {
+	rate, tokens, refilled int64
+}
+
+//Kept by kvstore as namespaces are applied, read by client connections
+var leaderRates = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+func (r *rateLimiter) set(id string, rate int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rate <= 0 {
+		delete(r.buckets, id)
+		return
+	}
+	r.buckets[id] = &rateBucket{rate: rate, tokens: int64(time.Second) * rate, refilled: time.Now().UnixNano()}
+}
+
+func (r *rateLimiter) allow(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b, ok := r.buckets[id]
+	return !ok || takeToken(&b.tokens, &b.refilled, b.rate, time.Now().UnixNano())
+}
+
+//ERR_RATE_LIMITED if this server is the leader and namespace of command
+//is over its rate. Checked before appending a client command
+func admitOnLeader(raftObj *raft.Raft, command Command) string {
+	if !namespacedCommands[command.Cmd] || !raftObj.IsLeader() {
+		return ""
+	}
+	if !leaderRates.allow(command.Namespace) {
+		return ERR_RATE_LIMITED
+	}
+	return ""
+}
+
+//False if storing val in key would take its namespace over quota
+func (store *kvStore) withinQuota(key string, val value) bool {
+	ns := store.namespaces[namespaceOf(key)]
+	if ns == nil || ns.maxKeys <= 0 && ns.maxBytes <= 0 {
+		return true
+	}
+
+	usage := store.data.usage[namespaceOf(key)]
+	grow := entrySize(key, val)
+	if old, ok := store.data.get(key); ok {
+		grow -= entrySize(key, old)
+	} else if ns.maxKeys > 0 && usage.keys >= ns.maxKeys {
+		return false
+	}
+	return ns.maxBytes <= 0 || grow <= 0 || usage.bytes+grow <= ns.maxBytes
+}
+
+//Like withinQuota, for all keys a transaction changes, with sizes they
+//will have after it (0 if deleted)
+func (store *kvStore) txnWithinQuota(sizes map[string]int64) bool {
+	grow := make(map[string]spaceUsage)
+	for key, size := range sizes {
+		g := grow[namespaceOf(key)]
+		if size > 0 {
+			g.keys++
+			g.bytes += size
+		}
+		if old, ok := store.data.get(key); ok {
+			g.keys--
+			g.bytes -= entrySize(key, old)
+		}
+		grow[namespaceOf(key)] = g
+	}
+
+	for space, g := range grow {
+		ns := store.namespaces[space]
+		if ns == nil {
+			continue
+		}
+		usage := store.data.usage[space]
+		if ns.maxKeys > 0 && g.keys > 0 && usage.keys+g.keys > ns.maxKeys {
+			return false
+		}
+		if ns.maxBytes > 0 && g.bytes > 0 && usage.bytes+g.bytes > ns.maxBytes {
+			return false
+		}
+	}
+	return true
+}
+
+func (store *kvStore) createNamespace(command Command) string {
+	id := namespaceID(command.Key)
+	if _, ok := store.namespaces[id]; ok {
+		return ERR_VERSION
+	}
+
+	store.namespaces[id] = &namespace{}
+	return store.setQuota(command)
+}
+
+func (store *kvStore) setQuota(command Command) string {
+	ns, ok := store.namespaces[namespaceID(command.Key)]
+	if !ok {
+		return ERR_NAMESPACE_NOT_FOUND
+	}
+
+	ns.maxKeys, ns.maxBytes, ns.maxRate = command.MaxKeys, command.MaxBytes, command.MaxRate
+	ns.tokens = int64(time.Second) * ns.maxRate //Start with a full second
+	ns.refilled = store.sessions.clock
+	leaderRates.set(namespaceID(command.Key), ns.maxRate)
+	return "OK"
+}
+
+//Delete namespace with all its keys and locks
+func (store *kvStore) deleteNamespace(command Command) string {
+	id := namespaceID(command.Key)
+	if id == "" {
+		return ERR_CMD_ERR //Default namespace always exists
+	}
+	if _, ok := store.namespaces[id]; !ok {
+		return ERR_NAMESPACE_NOT_FOUND
+	}
+	delete(store.namespaces, id)
+	leaderRates.set(id, 0)
+
+	prefix := scopedKey(id, "")
+	var keys []string
+	store.data.ascend(prefix, func(key string, val value) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+
+	for _, key := range keys {
+		val, _ := store.data.get(key)
+		store.data.delete(key)
+		store.attachKey(key, val.lease, 0)
+		hub.publish(watchEvent{kind: "delete", key: key, revision: store.revision})
+	}
+
+	//Leases of locks stay till they are revoked or expire
+	for name := range store.locks {
+		if strings.HasPrefix(name, prefix) {
+			delete(store.locks, name)
+		}
+	}
+
+	log.Print("Namespace " + id + " deleted with " + strconv.Itoa(len(keys)) + " keys")
+	return "DELETED"
+}
+
+//STATS <namespace> keys <n> bytes <n> requests <n> throttled <n> maxkeys <n> maxbytes <n> rate <n>
+func (store *kvStore) stats(command Command) string {
+	id := command.Namespace
+	if command.Key != "" {
+		id = namespaceID(command.Key)
+	}
+
+	ns, ok := store.namespaces[id]
+	if !ok {
+		return ERR_NAMESPACE_NOT_FOUND
+	}
+
+	usage := store.data.usage[id]
+	return fmt.Sprintf("STATS %s keys %d bytes %d requests %d throttled %d maxkeys %d maxbytes %d rate %d",
+		namespaceName(id), usage.keys, usage.bytes, ns.requests, ns.throttled, ns.maxKeys, ns.maxBytes, ns.maxRate)
+}
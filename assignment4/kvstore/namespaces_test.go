@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithinQuota(t *testing.T) {
+	store := newTestStore()
+	store.namespaces["team"] = &namespace{maxKeys: 1, maxBytes: 200}
+	a, b := scopedKey("team", "a"), scopedKey("team", "b")
+	store.data.set(a, value{val: []byte("1")})
+
+	if store.withinQuota(b, value{val: []byte("1")}) {
+		t.Error("new key allowed over maxkeys")
+	}
+	if !store.withinQuota(a, value{val: []byte("2")}) {
+		t.Error("overwrite refused within quota")
+	}
+	if store.withinQuota(a, value{val: []byte(strings.Repeat("x", 200))}) {
+		t.Error("overwrite allowed over maxbytes")
+	}
+	if !store.withinQuota(scopedKey("", "b"), value{val: []byte("1")}) {
+		t.Error("quota of team applied to default namespace")
+	}
+}
+
+func TestAdmitRate(t *testing.T) {
+	store := newTestStore()
+	store.namespaces["team"] = &namespace{}
+	store.setQuota(Command{Key: "team", MaxRate: 2})
+	command := Command{Cmd: "get", Namespace: "team"}
+
+	for i := 0; i < 2; i++ {
+		if response := store.admit(command); response != "" {
+			t.Fatalf("request %d: got %q", i, response)
+		}
+	}
+	if response := store.admit(command); response != ERR_RATE_LIMITED {
+		t.Errorf("got %q, want %q", response, ERR_RATE_LIMITED)
+	}
+
+	store.sessions.clock += int64(time.Second / 2) //Refills one request
+	if response := store.admit(command); response != "" {
+		t.Errorf("got %q after refill", response)
+	}
+	if response := store.admit(Command{Cmd: "get", Namespace: "none"}); response != ERR_NAMESPACE_NOT_FOUND {
+		t.Errorf("got %q, want %q", response, ERR_NAMESPACE_NOT_FOUND)
+	}
+}
+
+func TestLeaderRates(t *testing.T) {
+	limiter := &rateLimiter{buckets: make(map[string]*rateBucket)}
+	limiter.set("team", 2)
+
+	//A second of requests, then none till tokens are refilled
+	if !limiter.allow("team") || !limiter.allow("team") {
+		t.Fatal("requests within rate rejected")
+	}
+	if limiter.allow("team") {
+		t.Error("request over rate allowed")
+	}
+	if !limiter.allow("other") {
+		t.Error("namespace without rate limited")
+	}
+
+	limiter.set("team", 0)
+	if !limiter.allow("team") {
+		t.Error("request limited after rate was removed")
+	}
+}
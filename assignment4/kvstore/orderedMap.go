@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/rand"
+)
+
+//Keys of the kvstore in sorted order, so that ranges of keys can be
+//listed. It is a treap: a binary search tree on keys which is kept
+//balanced by random priorities (a heap on them). Priorities only shape
+//the tree, so replicas with different trees still hold the same keys.
+
+type treapNode struct {
+	key         string
+	val         value
+	priority    int64
+	left, right *treapNode
+}
+
+type orderedMap struct {
+	root  *treapNode
+	size  int
+	bytes int64                 //Memory used by keys and values, roughly
+	usage map[string]spaceUsage //Of each namespace which has keys
+}
+
+func newOrderedMap() *orderedMap {
+	return &orderedMap{usage: make(map[string]spaceUsage)}
+}
+
+func (m *orderedMap) len() int {
+	return m.size
+}
+
+func (m *orderedMap) get(key string) (value, bool) {
+	node := m.root
+	for node != nil {
+		switch {
+		case key < node.key:
+			node = node.left
+		case key > node.key:
+			node = node.right
+		default:
+			return node.val, true
+		}
+	}
+	return value{}, false
+}
+
+//Add key or replace its value
+func (m *orderedMap) set(key string, val value) {
+	if old, ok := m.get(key); ok {
+		m.account(key, -1, -entrySize(key, old))
+	}
+	m.account(key, 1, entrySize(key, val))
+
+	var added bool
+	m.root, added = insertNode(m.root, key, val)
+	if added {
+		m.size++
+	}
+}
+
+func (m *orderedMap) delete(key string) {
+	if old, ok := m.get(key); ok {
+		m.account(key, -1, -entrySize(key, old))
+	}
+
+	var removed bool
+	m.root, removed = deleteNode(m.root, key)
+	if removed {
+		m.size--
+	}
+}
+
+//Add to memory used, in all and by namespace of key
+func (m *orderedMap) account(key string, keys, bytes int64) {
+	m.bytes += bytes
+
+	space := namespaceOf(key)
+	usage := m.usage[space]
+	usage.keys += keys
+	usage.bytes += bytes
+	if usage.keys == 0 {
+		delete(m.usage, space)
+	} else {
+		m.usage[space] = usage
+	}
+}
+
+//Call fn for keys from start (inclusive) in order, till fn returns false
+func (m *orderedMap) ascend(start string, fn func(key string, val value) bool) {
+	ascendNode(m.root, start, fn)
+}
+
+func insertNode(node *treapNode, key string, val value) (*treapNode, bool) {
+	if node == nil {
+		return &treapNode{key: key, val: val, priority: rand.Int63()}, true
+	}
+
+	var added bool
+	switch {
+	case key < node.key:
+		node.left, added = insertNode(node.left, key, val)
+		if node.left.priority > node.priority {
+			node = rotateRight(node)
+		}
+	case key > node.key:
+		node.right, added = insertNode(node.right, key, val)
+		if node.right.priority > node.priority {
+			node = rotateLeft(node)
+		}
+	default:
+		node.val = val
+	}
+	return node, added
+}
+
+func deleteNode(node *treapNode, key string) (*treapNode, bool) {
+	if node == nil {
+		return nil, false
+	}
+
+	var removed bool
+	switch {
+	case key < node.key:
+		node.left, removed = deleteNode(node.left, key)
+	case key > node.key:
+		node.right, removed = deleteNode(node.right, key)
+	default:
+		return mergeNodes(node.left, node.right), true
+	}
+	return node, removed
+}
+
+//Join two trees, all keys of left being smaller than of right
+func mergeNodes(left, right *treapNode) *treapNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	case left.priority > right.priority:
+		left.right = mergeNodes(left.right, right)
+		return left
+	default:
+		right.left = mergeNodes(left, right.left)
+		return right
+	}
+}
+
+func rotateRight(node *treapNode) *treapNode {
+	left := node.left
+	node.left, left.right = left.right, node
+	return left
+}
+
+func rotateLeft(node *treapNode) *treapNode {
+	right := node.right
+	node.right, right.left = right.left, node
+	return right
+}
+
+//In order walk of keys >= start. False if fn stopped it
+func ascendNode(node *treapNode, start string, fn func(key string, val value) bool) bool {
+	if node == nil {
+		return true
+	}
+	if start <= node.key {
+		if !ascendNode(node.left, start, fn) {
+			return false
+		}
+		if !fn(node.key, node.val) {
+			return false
+		}
+	}
+	return ascendNode(node.right, start, fn)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+//Keys of m in the order ascend gives them, from start
+func keysFrom(m *orderedMap, start string) []string {
+	var keys []string
+	m.ascend(start, func(key string, val value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestOrderedMapOrder(t *testing.T) {
+	m := newOrderedMap()
+	var want []string
+	for _, i := range rand.Perm(500) {
+		key := scopedKey("", fmt.Sprintf("k%03d", i))
+		m.set(key, value{val: []byte("v")})
+		want = append(want, key)
+	}
+	m.set(scopedKey("", "k042"), value{val: []byte("new")}) //Replaced, not added
+	sort.Strings(want)
+
+	if got := keysFrom(m, ""); fmt.Sprint(got) != fmt.Sprint(want) || m.len() != 500 {
+		t.Fatalf("got %d keys out of order or missing, len %d", len(got), m.len())
+	}
+	if got := keysFrom(m, scopedKey("", "k2505")); len(got) != 249 || got[0] != scopedKey("", "k251") {
+		t.Errorf("from k2505: got %d keys starting %q", len(got), got[0])
+	}
+	if val, ok := m.get(scopedKey("", "k042")); !ok || string(val.val) != "new" {
+		t.Errorf("got %q %v for replaced key", val.val, ok)
+	}
+
+	//Stops when fn returns false
+	count := 0
+	m.ascend("", func(key string, val value) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("ascend went on for %d keys after stop", count)
+	}
+
+	for i := 0; i < 500; i += 2 {
+		m.delete(scopedKey("", fmt.Sprintf("k%03d", i)))
+	}
+	m.delete(scopedKey("", "missing"))
+	got := keysFrom(m, "")
+	if len(got) != 250 || m.len() != 250 || got[0] != scopedKey("", "k001") || got[249] != scopedKey("", "k499") {
+		t.Fatalf("after deletes: got %d keys, len %d", len(got), m.len())
+	}
+	if _, ok := m.get(scopedKey("", "k100")); ok {
+		t.Error("deleted key found")
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Error("keys out of order after deletes")
+	}
+}
+
+func TestOrderedMapUsage(t *testing.T) {
+	m := newOrderedMap()
+	a, b := scopedKey("", "a"), scopedKey("team", "b")
+	m.set(a, value{val: []byte("12345")})
+	m.set(b, value{val: []byte("1")})
+	m.set(b, value{val: []byte("123")}) //Replacing counts only the new value
+
+	if m.bytes != entrySize(a, value{val: make([]byte, 5)})+entrySize(b, value{val: make([]byte, 3)}) {
+		t.Errorf("got %d bytes", m.bytes)
+	}
+	if usage := m.usage["team"]; usage.keys != 1 || usage.bytes != int64(len(b))+3+ENTRY_OVERHEAD {
+		t.Errorf("got usage %+v of team", usage)
+	}
+
+	m.delete(b)
+	m.delete(b)
+	if _, ok := m.usage["team"]; ok {
+		t.Error("usage of namespace kept after its last key was deleted")
+	}
+	m.delete(a)
+	if m.bytes != 0 || m.len() != 0 || len(m.usage) != 0 {
+		t.Errorf("got %d bytes, %d keys, usage %v when empty", m.bytes, m.len(), m.usage)
+	}
+}
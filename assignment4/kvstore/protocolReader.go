@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//Longest command line accepted, data block is not counted
+const MAX_LINE_LENGTH = 4096
+
+//Reads commands of the text protocol from a client connection
+//Command line is read upto \r\n and data block of set/cas is read
+//in one shot, followed by its \r\n terminator. Lines of a txn are
+//read along with it
+type protocolReader struct {
+	reader       *bufio.Reader
+	maxValueSize int64
+	raw          []byte //Last command as it was sent, to forward it
+}
+
+func newProtocolReader(conn net.Conn, maxValueSize int64) *protocolReader {
+	return &protocolReader{reader: bufio.NewReaderSize(conn, MAX_LINE_LENGTH), maxValueSize: maxValueSize}
+}
+
+//Read one command along with its data
+//errStr is set if command is not valid, err if connection failed
+func (p *protocolReader) readCommand() (Command, string, error) {
+
+	line, errStr, err := p.readLine()
+	for err == nil && errStr == "" && line == "" {
+		line, errStr, err = p.readLine() //Skip blank lines
+	}
+	if err != nil || errStr != "" {
+		return Command{}, errStr, err
+	}
+
+	command, errStr := parseInput(line)
+	if errStr != "" {
+		return Command{}, errStr, p.skipData(line)
+	}
+
+	p.raw = []byte(line + "\r\n")
+
+	if command.Cmd == "set" || command.Cmd == "cas" {
+		data, errStr, err := p.readData(command.Length)
+		if err != nil || errStr != "" {
+			return Command{}, errStr, err
+		}
+		command.Value = string(data)
+
+		p.raw = append(p.raw, data...)
+		p.raw = append(p.raw, '\r', '\n')
+	}
+
+	if command.Cmd == "txn" {
+		errStr, err := p.readTxn(&command)
+		if err != nil || errStr != "" {
+			return Command{}, errStr, err
+		}
+	}
+
+	return command, "", nil
+}
+
+//Read a line without \r\n
+//Lines longer than MAX_LINE_LENGTH are skipped with ERR_CMD_ERR
+func (p *protocolReader) readLine() (string, string, error) {
+
+	line, err := p.reader.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		log.Print("Command line too long")
+		if err = p.skipLine(); err != nil {
+			return "", "", err
+		}
+		return "", ERR_CMD_ERR, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), "", nil
+}
+
+//Discard everything upto next \n
+func (p *protocolReader) skipLine() error {
+	for {
+		_, err := p.reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+//Throw away data block sent after a rejected set, cas or put line, if
+//its length can be made out, so that it isn't read as a command
+func (p *protocolReader) skipData(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) >= 4 && fields[0] == "session" {
+		fields = fields[3:]
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	index := 3
+	switch fields[0] {
+	case "set", "put":
+	case "cas":
+		index = 4
+	default:
+		return nil
+	}
+	if len(fields) <= index {
+		return nil
+	}
+
+	length, err := strconv.ParseInt(fields[index], 10, 64)
+	if err != nil || length < 1 {
+		return nil
+	}
+	_, err = io.CopyN(ioutil.Discard, p.reader, length+2)
+	return err
+}
+
+//Read data block of length bytes and its \r\n terminator
+func (p *protocolReader) readData(length int64) ([]byte, string, error) {
+
+	if length > p.maxValueSize {
+		log.Print("Value too large")
+		//Throw away data so that next command can be read
+		_, err := io.CopyN(ioutil.Discard, p.reader, length+2)
+		return nil, ERR_TOO_LARGE, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(p.reader, data); err != nil {
+		log.Print("Data Read Error")
+		return nil, "", err
+	}
+
+	terminator, err := p.reader.Peek(2)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if string(terminator) != "\r\n" {
+		//Length didn't match the data sent, skip to next line
+		log.Print("Data not terminated by \\r\\n")
+		return nil, ERR_CMD_ERR, p.skipLine()
+	}
+
+	p.reader.Discard(2)
+	return data, "", nil
+}
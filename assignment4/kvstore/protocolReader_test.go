@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRejectedHeaderSkipsData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("set k x 5\r\nget k\r\n" +
+		"cas k 0 bad 3\r\nabc\r\n" +
+		"txn 0 1 0\r\nput k x 6\r\ndelete\r\n" +
+		"get k\r\n"))
+
+	p := newProtocolReader(server, 1024)
+	want := []string{ERR_CMD_ERR, ERR_CMD_ERR, ERR_CMD_ERR, ""}
+	for i, wantErr := range want {
+		command, errStr, err := p.readCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errStr != wantErr {
+			t.Errorf("command %d: got %q, want %q", i, errStr, wantErr)
+		}
+		if i == len(want)-1 && (command.Cmd != "get" || command.Key != "k") {
+			t.Errorf("got %+v after rejected data, want get k", command)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Range queries list keys in sorted order. Like get they go through the
+//log, so they see every change committed before them.
+//
+//	range <start> <end> [limit <n>] [keys|count]\r\n
+//	prefix <prefix> [from <cursor>] [limit <n>] [keys|count]\r\n
+//
+//Range lists keys from start upto end (not included), end * meaning no
+//end. Prefix lists keys starting with prefix, from cursor if given.
+//Reply is "RANGE <n> [<next>]" followed by n items
+//
+//	KEY <key> <version> <exptime> <numbytes>\r\n<value>
+//
+//or "KEY <key>" for keys only. next is given if there are more keys, and
+//is the start (or cursor) of the next page. With count only the reply is
+//"COUNT <n>", the number of keys in the range.
+
+//Keys listed if no limit is given
+const DEFAULT_RANGE_LIMIT = 1000
+
+//Most keys listed in one reply
+const MAX_RANGE_LIMIT = 10000
+
+//range <start> <end> [options]
+func parseRange(fields []string) (Command, string) {
+	if len(fields) < 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Cmd: "range", Key: fields[1], RangeEnd: fields[2]}
+	if command.RangeEnd == "*" {
+		command.RangeEnd = ""
+	}
+	return parseRangeOptions(command, fields[3:], false)
+}
+
+//prefix <prefix> [from <cursor>] [options]
+func parsePrefix(fields []string) (Command, string) {
+	if len(fields) < 2 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Cmd: "range", Key: fields[1], RangeEnd: prefixEnd(fields[1])}
+	return parseRangeOptions(command, fields[2:], true)
+}
+
+func parseRangeOptions(command Command, options []string, cursor bool) (Command, string) {
+	command.Limit = DEFAULT_RANGE_LIMIT
+
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "keys":
+			command.KeysOnly = true
+		case "count":
+			command.CountOnly = true
+
+		case "limit":
+			if i++; i == len(options) {
+				return Command{}, ERR_CMD_ERR
+			}
+			limit, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil || limit < 1 || limit > MAX_RANGE_LIMIT {
+				return Command{}, ERR_CMD_ERR
+			}
+			command.Limit = limit
+
+		case "from":
+			if !cursor {
+				return Command{}, ERR_CMD_ERR
+			}
+			if i++; i == len(options) {
+				return Command{}, ERR_CMD_ERR
+			}
+			//Cursor outside the prefix would list other keys
+			if options[i] > command.Key {
+				command.Key = options[i]
+			}
+
+		default:
+			return Command{}, ERR_CMD_ERR
+		}
+	}
+
+	if command.KeysOnly && command.CountOnly {
+		return Command{}, ERR_CMD_ERR
+	}
+	return command, ""
+}
+
+//Smallest key greater than all keys with prefix, "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func (store *kvStore) rangeKeys(command Command) string {
+
+	inRange := func(key string) bool {
+		return command.RangeEnd == "" || key < command.RangeEnd
+	}
+
+	if command.CountOnly {
+		count := 0
+		store.data.ascend(command.Key, func(key string, val value) bool {
+			if !inRange(key) {
+				return false
+			}
+			count++
+			return true
+		})
+		return fmt.Sprintf("COUNT %d", count)
+	}
+
+	var items []string
+	next := ""
+	store.data.ascend(command.Key, func(key string, val value) bool {
+		if !inRange(key) {
+			return false
+		}
+		if int64(len(items)) == command.Limit {
+			next = unscopedKey(key)
+			return false
+		}
+
+		if command.KeysOnly {
+			items = append(items, "KEY "+unscopedKey(key))
+		} else {
+			items = append(items, fmt.Sprintf("KEY %s %d %d %d\r\n%s", unscopedKey(key), val.version, val.exptime, val.numbytes, val.val))
+		}
+		return true
+	})
+
+	header := fmt.Sprintf("RANGE %d", len(items))
+	if next != "" {
+		header += " " + next
+	}
+	return strings.Join(append([]string{header}, items...), "\r\n")
+}
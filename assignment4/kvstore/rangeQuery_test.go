@@ -0,0 +1,74 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//Run a range or prefix command line as a client of namespace space would
+func rangeLine(store *kvStore, space, line string) string {
+	command, errStr := parseInput(line)
+	if errStr != "" {
+		return errStr
+	}
+	command.Namespace = space
+	response, _ := store.apply(raft.LogItem{}, command)
+	return response
+}
+
+func TestRangePages(t *testing.T) {
+	store := newTestStore()
+	store.namespaces["team"] = &namespace{}
+	for i := 0; i < 25; i++ {
+		store.setCas(Command(putOp(fmt.Sprintf("k%02d", i), "v", 0)))
+	}
+	store.setCas(Command{Cmd: "put", Key: scopedKey("team", "k99"), Value: "v", Length: 1})
+	store.setCas(Command(putOp("l", "v", 0)))
+
+	//Pages of a prefix follow the cursor till there is no next
+	want := []string{"RANGE 10 k10", "RANGE 10 k20", "RANGE 5"}
+	cursor := ""
+	for _, header := range want {
+		line := "prefix k limit 10 keys"
+		if cursor != "" {
+			line = "prefix k from " + cursor + " limit 10 keys"
+		}
+		response := rangeLine(store, "", line)
+		lines := strings.Split(response, "\r\n")
+		if lines[0] != header {
+			t.Fatalf("%s: got %q, want %q", line, lines[0], header)
+		}
+		fields := strings.Fields(lines[0])
+		if cursor != "" && lines[1] != "KEY "+cursor {
+			t.Errorf("%s: page starts with %q", line, lines[1])
+		}
+		cursor = ""
+		if len(fields) == 3 {
+			cursor = fields[2]
+		}
+	}
+
+	if response := rangeLine(store, "", "range k05 k07"); response != "RANGE 2\r\nKEY k05 1 0 1\r\nv\r\nKEY k06 1 0 1\r\nv" {
+		t.Errorf("got %q", response)
+	}
+	if response := rangeLine(store, "", "range k20 * count"); response != "COUNT 6" {
+		t.Errorf("got %q, want keys of default namespace only", response)
+	}
+	if response := rangeLine(store, "team", "prefix k keys"); response != "RANGE 1\r\nKEY k99" {
+		t.Errorf("got %q in namespace team", response)
+	}
+
+	//Deleted keys are gone from pages
+	store.deleteKey(Command{Cmd: "delete", Key: scopedKey("", "k01")})
+	if response := rangeLine(store, "", "prefix k limit 2 keys"); response != "RANGE 2 k03\r\nKEY k00\r\nKEY k02" {
+		t.Errorf("got %q after delete", response)
+	}
+
+	for _, line := range []string{"range a", "range a b limit 0", "range a b from c", "prefix a keys count", "prefix a limit 10001"} {
+		if response := rangeLine(store, "", line); response != ERR_CMD_ERR {
+			t.Errorf("%q: got %q, want %q", line, response, ERR_CMD_ERR)
+		}
+	}
+}
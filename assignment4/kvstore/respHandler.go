@@ -0,0 +1,764 @@
+package main
+
+import (
+	"assignment4/raft"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Redis (RESP2/RESP3) frontend for the kvstore
+//Each redis command is translated to one or more raft commands
+
+//A connected redis client
+type respConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	raftObj   *raft.Raft
+	proto     int    //RESP version negotiated with HELLO
+	namespace string //Selected with SELECT, "" for default
+	user      string //Logged in with AUTH
+}
+
+var errRespProtocol = errors.New("Protocol error")
+
+//Most arguments of a command, and arguments space is made for up front
+const (
+	RESP_MAX_ARGS   = 1024 * 1024
+	RESP_ARGS_ALLOC = 64
+)
+
+//Listen for redis clients on address
+func startRespServer(raftObj *raft.Raft, address string) {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Print("Error listening to RESP port:" + err.Error())
+		return
+	}
+	listener = clientListener(listener)
+	addListener(listener) //Closed on shutdown
+
+	log.Print("RESP server started:", listener.Addr())
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			log.Print("Error accepting connection :" + err.Error())
+			continue
+		}
+		if !trackConn(client) {
+			client.Close()
+			return
+		}
+
+		c := &respConn{client, bufio.NewReaderSize(client, MAX_LINE_LENGTH), bufio.NewWriter(client), raftObj, 2, "", ""}
+		go c.serve()
+	}
+}
+
+//Serve commands one after another. Pipelined commands which are in
+//buffer are all appended to raft first, then their replies are written
+//in order as responses come, and flushed together
+func (c *respConn) serve() {
+	defer untrackConn(c.conn)
+	defer c.conn.Close()
+
+	var queued []respReply //Replies of commands appended, in order
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			c.writeReplies(queued)
+			if err == errRespProtocol {
+				c.writeError("ERR Protocol error")
+			}
+			c.writer.Flush()
+			return
+		}
+
+		if len(args) == 0 {
+			continue //Empty inline command
+		}
+
+		reply, open := c.execute(args)
+		queued = append(queued, reply)
+
+		if !open || c.reader.Buffered() == 0 || len(queued) >= MAX_INFLIGHT {
+			//No more pipelined commands, send replies
+			c.writeReplies(queued)
+			queued = queued[:0]
+			if c.writer.Flush() != nil {
+				log.Print("Client disconnected/broken pipe")
+				return
+			}
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+//Wait for responses and write replies, in order
+func (c *respConn) writeReplies(replies []respReply) {
+	for _, reply := range replies {
+		reply()
+	}
+}
+
+//Read an array of bulk strings or an inline command
+func (c *respConn) readCommand() ([]string, error) {
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		//Inline command
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > RESP_MAX_ARGS {
+		return nil, errRespProtocol
+	}
+
+	//Grows as arguments come, so a large count alone takes no memory
+	alloc := count
+	if alloc > RESP_ARGS_ALLOC {
+		alloc = RESP_ARGS_ALLOC
+	}
+	args := make([]string, 0, alloc)
+	for i := 0; i < count; i++ {
+		line, err = c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRespProtocol
+		}
+
+		length, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || length < 0 || length > maxValueSize() {
+			return nil, errRespProtocol
+		}
+
+		data := make([]byte, length+2) //Including \r\n
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		if string(data[length:]) != "\r\n" {
+			return nil, errRespProtocol
+		}
+		args = append(args, string(data[:length]))
+	}
+
+	return args, nil
+}
+
+//Read a line without \r\n. A line longer than MAX_LINE_LENGTH, like
+//an inline command with no end, is a protocol error
+func (c *respConn) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > MAX_LINE_LENGTH {
+		log.Print("RESP line too long")
+		return "", errRespProtocol
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+//Writes reply of a command, waiting for its responses from kvstore first
+type respReply func()
+
+//A command appended to raft, whose response comes later
+type respPending struct {
+	reply pendingReply
+	err   error //Couldn't be appended, eg: not the leader
+}
+
+//Append command of a redis command and return its reply
+//Returns false if connection should be closed after the reply
+func (c *respConn) execute(args []string) (respReply, bool) {
+
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			return c.bulkReply(args[0]), true
+		}
+		return c.simpleReply("PONG"), true
+	case "ECHO":
+		if len(args) != 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.bulkReply(args[0]), true
+	case "HELLO":
+		return c.hello(args), true
+	case "SELECT":
+		//Database 0 is the default namespace, others are selected by name
+		switch {
+		case len(args) != 1:
+			return c.wrongArgs(name), true
+		case args[0] == "0":
+			c.namespace = ""
+		case validNamespace(args[0]):
+			c.namespace = namespaceID(args[0])
+		default:
+			return c.errorReply("ERR invalid namespace"), true
+		}
+		return c.simpleReply("OK"), true
+	case "AUTH":
+		//AUTH <password> is for the user named default, as in redis
+		switch len(args) {
+		case 1:
+			args = append([]string{"default"}, args...)
+		case 2:
+		default:
+			return c.wrongArgs(name), true
+		}
+		if !acl.login(args[0], args[1]) {
+			return c.errorReply("WRONGPASS invalid username-password pair or user is disabled."), true
+		}
+		c.user = args[0]
+		return c.simpleReply("OK"), true
+	case "COMMAND":
+		return func() { c.writeArrayLen(0) }, true
+	case "QUIT":
+		return c.simpleReply("OK"), false
+	case "GET":
+		if len(args) != 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.get(args[0]), true
+	case "MGET":
+		if len(args) < 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.mget(args), true
+	case "SET":
+		if len(args) < 2 {
+			return c.wrongArgs(name), true
+		}
+		return c.set(args), true
+	case "MSET":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return c.wrongArgs(name), true
+		}
+		return c.mset(args), true
+	case "MSETNX":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return c.wrongArgs(name), true
+		}
+		return c.msetnx(args), true
+	case "DEL":
+		if len(args) < 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.countKeys("delete", args), true
+	case "EXISTS":
+		if len(args) < 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.countKeys("get", args), true
+	case "EXPIRE":
+		if len(args) != 2 {
+			return c.wrongArgs(name), true
+		}
+		return c.expire(args[0], args[1]), true
+	case "TTL":
+		if len(args) != 1 {
+			return c.wrongArgs(name), true
+		}
+		return c.ttl(args[0]), true
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		return c.incr(name, args), true
+	}
+	return c.errorReply(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name))), true
+}
+
+func (c *respConn) wrongArgs(name string) respReply {
+	return c.errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func (c *respConn) simpleReply(s string) respReply {
+	return func() { c.writeSimple(s) }
+}
+
+func (c *respConn) errorReply(s string) respReply {
+	return func() { c.writeError(s) }
+}
+
+func (c *respConn) bulkReply(s string) respReply {
+	return func() { c.writeBulk(s) }
+}
+
+//HELLO [protover] switches between RESP2 and RESP3
+func (c *respConn) hello(args []string) respReply {
+	proto := c.proto
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(args[0])
+		if err != nil || proto < 2 || proto > 3 {
+			return c.errorReply("NOPROTO unsupported protocol version")
+		}
+	}
+
+	role := "replica"
+	if c.raftObj.ServerID == c.raftObj.LeaderID {
+		role = "master"
+	}
+
+	return func() {
+		//Replies of commands before are written in old version
+		c.proto = proto
+		c.writeMapLen(5)
+		c.writeBulk("server")
+		c.writeBulk("kvstore")
+		c.writeBulk("proto")
+		c.writeInt(int64(c.proto))
+		c.writeBulk("id")
+		c.writeInt(int64(c.raftObj.ServerID))
+		c.writeBulk("mode")
+		c.writeBulk("cluster")
+		c.writeBulk("role")
+		c.writeBulk(role)
+	}
+}
+
+//Append command to raft without waiting for its response
+func (c *respConn) submit(command Command) respPending {
+	command.Namespace, command.User = c.namespace, c.user
+	if response := admitOnLeader(c.raftObj, command); response != "" {
+		return respPending{reply: immediateReply(response)}
+	}
+	logEntry, err := appendCommand(c.raftObj, command)
+	if err != nil {
+		log.Print(err.Error())
+		return respPending{err: err}
+	}
+	return respPending{reply: waitReply(logEntry.Lsn())}
+}
+
+//Response of a command appended, ERR_TIMEOUT if it doesn't come in time
+//If command couldn't be appended, redirect is written and ok is false
+func (c *respConn) wait(p respPending) (string, bool) {
+	if p.err != nil {
+		c.writeRedirect(p.err)
+		return "", false
+	}
+	if p.reply.lsn == 0 {
+		return (<-p.reply.ch).response, true //Answered without appending
+	}
+
+	timer := time.NewTimer(time.Until(p.reply.deadline))
+	defer timer.Stop()
+
+	select {
+	case resp := <-p.reply.ch:
+		return resp.response, true
+	case <-timer.C:
+		cancelWait(p.reply.lsn)
+		return timeoutResponse(), true
+	}
+}
+
+//Responses of commands appended together. On a redirect, responses of
+//the rest are not waited for
+func (c *respConn) waitAll(pending []respPending) ([]string, bool) {
+	responses := make([]string, len(pending))
+	for i, p := range pending {
+		response, ok := c.wait(p)
+		if !ok {
+			for _, rest := range pending[i+1:] {
+				if rest.err == nil && rest.reply.lsn > 0 {
+					cancelWait(rest.reply.lsn)
+				}
+			}
+			return nil, false
+		}
+		responses[i] = response
+	}
+	return responses, true
+}
+
+//Redirect to leader in the form REDIRECT <leader id> <host:port>, or
+//TRYAGAIN if there is no leader to redirect to
+func (c *respConn) writeRedirect(err error) {
+	leaderID, ok := err.(raft.ErrRedirect)
+	if !ok || leaderID < 0 {
+		c.writeError("TRYAGAIN " + ERR_NO_LEADER + " no leader elected, try again later")
+		return
+	}
+
+	leader, ok := serverConfig(int(leaderID))
+	if !ok || leader.RespPort <= 0 {
+		c.writeError(fmt.Sprintf("REDIRECT %d", leaderID))
+		return
+	}
+	address := net.JoinHostPort(leader.Hostname, strconv.Itoa(leader.RespPort))
+	c.writeError(fmt.Sprintf("REDIRECT %d %s", leader.Id, address))
+}
+
+//Write errors from kvstore other than the expected ones
+func (c *respConn) writeKVError(response string) {
+	switch response {
+	case ERR_NOT_NUMBER:
+		c.writeError("ERR value is not an integer or out of range")
+	case ERR_OUT_OF_RANGE:
+		c.writeError("ERR increment or decrement would overflow")
+	case ERR_OUT_OF_MEMORY:
+		c.writeError("OOM command not allowed when used memory > 'maxmemory'")
+	case ERR_QUOTA_EXCEEDED:
+		c.writeError("OOM command not allowed when namespace quota is used up")
+	case ERR_RATE_LIMITED:
+		c.writeError("ERR namespace rate limit reached, try again later")
+	case ERR_NAMESPACE_NOT_FOUND:
+		c.writeError("ERR namespace not found")
+	case ERR_AUTH_REQUIRED:
+		c.writeError("NOAUTH Authentication required.")
+	case ERR_PERMISSION_DENIED:
+		c.writeError("NOPERM this user has no permissions to access one of the keys used as arguments")
+	case ERR_CMD_ERR:
+		c.writeError("ERR syntax error")
+	case ERR_NOT_LEADER:
+		c.writeError(ERR_NOT_LEADER + " leader changed, command may or may not be applied")
+	default:
+		if strings.HasPrefix(response, ERR_TIMEOUT) {
+			c.writeError(response) //With retry hint
+			return
+		}
+		c.writeError("ERR " + response)
+	}
+}
+
+//Split "VALUE <meta>\r\n<data>" into data
+func valueData(response string) (string, bool) {
+	if !strings.HasPrefix(response, "VALUE ") {
+		return "", false
+	}
+	i := strings.Index(response, "\r\n")
+	if i < 0 {
+		return "", false
+	}
+	return response[i+2:], true
+}
+
+func (c *respConn) get(key string) respReply {
+	p := c.submit(Command{Cmd: "get", Key: key})
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+
+		if data, found := valueData(response); found {
+			c.writeBulk(data)
+		} else if response == ERR_NOT_FOUND {
+			c.writeNull()
+		} else {
+			c.writeKVError(response)
+		}
+	}
+}
+
+func (c *respConn) mget(keys []string) respReply {
+	pending := make([]respPending, len(keys))
+	for i, key := range keys {
+		pending[i] = c.submit(Command{Cmd: "get", Key: key})
+	}
+
+	return func() {
+		responses, ok := c.waitAll(pending)
+		if !ok {
+			return
+		}
+
+		c.writeArrayLen(len(keys))
+		for _, response := range responses {
+			if data, found := valueData(response); found {
+				c.writeBulk(data)
+			} else {
+				c.writeNull()
+			}
+		}
+	}
+}
+
+//SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (c *respConn) set(args []string) respReply {
+	command := Command{Cmd: "put", Key: args[0], Value: args[1], Length: int64(len(args[1]))}
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if command.Cmd == "replace" {
+				return c.errorReply("ERR syntax error")
+			}
+			command.Cmd = "set" //Fails if exists
+		case "XX":
+			if command.Cmd == "set" {
+				return c.errorReply("ERR syntax error")
+			}
+			command.Cmd = "replace" //Fails if not exists
+		case "EX", "PX":
+			if i+1 >= len(args) || command.ExpiryTime != 0 {
+				return c.errorReply("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return c.errorReply("ERR invalid expire time in 'set' command")
+			}
+			if strings.ToUpper(args[i]) == "PX" {
+				n = (n + 999) / 1000 //Expiry is in seconds, round up
+			}
+			command.ExpiryTime = n
+			i++
+		default:
+			return c.errorReply("ERR syntax error")
+		}
+	}
+
+	p := c.submit(command)
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+
+		if strings.HasPrefix(response, "OK") {
+			c.writeSimple("OK")
+		} else if response == ERR_VERSION || response == ERR_NOT_FOUND {
+			c.writeNull() //NX or XX condition not met
+		} else {
+			c.writeKVError(response)
+		}
+	}
+}
+
+func (c *respConn) mset(args []string) respReply {
+	command := Command{Cmd: "txn"}
+	for i := 0; i < len(args); i += 2 {
+		put := raft.Command{Cmd: "put", Key: args[i], Value: args[i+1], Length: int64(len(args[i+1]))}
+		command.Success = append(command.Success, put)
+	}
+
+	//All keys are set together in a transaction
+	p := c.submit(command)
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+		if !strings.HasPrefix(response, "TXN SUCCESS") {
+			c.writeKVError(response)
+			return
+		}
+		c.writeSimple("OK")
+	}
+}
+
+//Set keys only if none of them exist, reply 1 if set
+func (c *respConn) msetnx(args []string) respReply {
+	command := Command{Cmd: "txn"}
+	for i := 0; i < len(args); i += 2 {
+		command.Compares = append(command.Compares, raft.Compare{Target: "missing", Key: args[i]})
+		put := raft.Command{Cmd: "put", Key: args[i], Value: args[i+1], Length: int64(len(args[i+1]))}
+		command.Success = append(command.Success, put)
+	}
+
+	p := c.submit(command)
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+		switch {
+		case strings.HasPrefix(response, "TXN SUCCESS"):
+			c.writeInt(1)
+		case strings.HasPrefix(response, "TXN FAILURE"):
+			c.writeInt(0)
+		default:
+			c.writeKVError(response)
+		}
+	}
+}
+
+//Run cmd on every key and reply number of keys it succeeded for
+func (c *respConn) countKeys(cmd string, keys []string) respReply {
+	pending := make([]respPending, len(keys))
+	for i, key := range keys {
+		pending[i] = c.submit(Command{Cmd: cmd, Key: key})
+	}
+
+	return func() {
+		responses, ok := c.waitAll(pending)
+		if ok {
+			c.writeCount(responses)
+		}
+	}
+}
+
+//Number of keys deleted or found, or the first error other than
+//ERR_NOT_FOUND
+func (c *respConn) writeCount(responses []string) {
+	count := int64(0)
+	for _, response := range responses {
+		switch {
+		case response == "DELETED" || strings.HasPrefix(response, "VALUE "):
+			count++
+		case response != ERR_NOT_FOUND:
+			c.writeKVError(response)
+			return
+		}
+	}
+	c.writeInt(count)
+}
+
+func (c *respConn) expire(key string, secondsArg string) respReply {
+	seconds, err := strconv.ParseInt(secondsArg, 10, 64)
+	if err != nil {
+		return c.errorReply("ERR value is not an integer or out of range")
+	}
+
+	command := Command{Cmd: "touch", Key: key, ExpiryTime: seconds}
+	if seconds <= 0 {
+		command = Command{Cmd: "delete", Key: key} //Expire right away
+	}
+
+	p := c.submit(command)
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+
+		switch response {
+		case "TOUCHED", "DELETED":
+			c.writeInt(1)
+		case ERR_NOT_FOUND:
+			c.writeInt(0)
+		default:
+			c.writeKVError(response)
+		}
+	}
+}
+
+func (c *respConn) ttl(key string) respReply {
+	p := c.submit(Command{Cmd: "ttl", Key: key})
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+
+		if response == ERR_NOT_FOUND {
+			c.writeInt(-2)
+			return
+		}
+
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(response, "TTL "), 10, 64)
+		if err != nil {
+			c.writeKVError(response)
+			return
+		}
+		c.writeInt(seconds)
+	}
+}
+
+func (c *respConn) incr(name string, args []string) respReply {
+	delta := int64(1)
+
+	if name == "INCRBY" || name == "DECRBY" {
+		if len(args) != 2 {
+			return c.wrongArgs(name)
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return c.errorReply("ERR value is not an integer or out of range")
+		}
+		delta = n
+	} else if len(args) != 1 {
+		return c.wrongArgs(name)
+	}
+
+	if name == "DECR" || name == "DECRBY" {
+		delta = -delta
+	}
+
+	p := c.submit(newCounter(args[0], delta))
+
+	return func() {
+		response, ok := c.wait(p)
+		if !ok {
+			return
+		}
+
+		number, err := strconv.ParseInt(strings.TrimPrefix(response, "NUM "), 10, 64)
+		if err != nil {
+			c.writeKVError(response)
+			return
+		}
+		c.writeInt(number)
+	}
+}
+
+// --------------------------------------
+//RESP encoding
+
+func (c *respConn) writeSimple(s string) {
+	c.writer.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.writer.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) writeInt(n int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(s string) {
+	c.writer.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.proto == 3 {
+		c.writer.WriteString("_\r\n")
+	} else {
+		c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) writeArrayLen(n int) {
+	c.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+//Map of n pairs, sent as flat array in RESP2
+func (c *respConn) writeMapLen(n int) {
+	if c.proto == 3 {
+		c.writer.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.writeArrayLen(2 * n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+//Connection reading input, for parser tests
+func respInput(input string) *respConn {
+	return &respConn{reader: bufio.NewReader(strings.NewReader(input))}
+}
+
+func TestRespReadCommand(t *testing.T) {
+	tests := []struct {
+		input string
+		args  []string
+	}{
+		{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", []string{"GET", "key"}},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n", []string{"SET", "k", ""}},
+		{"*1\r\n$4\r\na\r\nb\r\n", []string{"a\r\nb"}}, //Bulk strings are binary safe
+		{"*0\r\n", []string{}},
+		{"PING hello\r\n", []string{"PING", "hello"}},
+		{"\r\n", []string{}},
+	}
+
+	for _, test := range tests {
+		args, err := respInput(test.input).readCommand()
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if strings.Join(args, "|") != strings.Join(test.args, "|") || len(args) != len(test.args) {
+			t.Errorf("%q: got %q, want %q", test.input, args, test.args)
+		}
+	}
+}
+
+func TestRespReadCommandMalformed(t *testing.T) {
+	tests := []string{
+		"*-1\r\n",
+		"*-2147483648\r\n",
+		"*99999999999\r\n",
+		"*x\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$-5\r\nabc\r\n",
+		"*1\r\n$99999999999999\r\n",
+		"*1\r\n$x\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$3\r\nabcde\r\n", //Length doesn't match data
+		strings.Repeat("x", MAX_LINE_LENGTH+1),
+		"*1\r\n$" + strings.Repeat("1", MAX_LINE_LENGTH) + "\r\n",
+	}
+
+	for _, input := range tests {
+		if _, err := respInput(input).readCommand(); err != errRespProtocol {
+			t.Errorf("%q: got %v, want protocol error", input, err)
+		}
+	}
+}
+
+func TestRespReadCommandTruncated(t *testing.T) {
+	//Count is allowed, but client goes away before sending arguments
+	if _, err := respInput("*1000000\r\n$3\r\nGET\r\n").readCommand(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+	if _, err := respInput("*1\r\n$10\r\nabc").readCommand(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want unexpected EOF", err)
+	}
+}
+
+func TestRespWriteCount(t *testing.T) {
+	tests := []struct {
+		responses []string
+		want      string
+	}{
+		{[]string{"DELETED", ERR_NOT_FOUND, "DELETED"}, ":2\r\n"},
+		{[]string{"VALUE 2 0 1\r\nv", ERR_NOT_FOUND}, ":1\r\n"},
+		{[]string{"DELETED", ERR_PERMISSION_DENIED, ERR_TIMEOUT}, "-NOPERM"},
+		{[]string{ERR_NOT_FOUND, ERR_NOT_LEADER}, "-" + ERR_NOT_LEADER},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		c := &respConn{writer: bufio.NewWriter(&out)}
+		c.writeCount(test.responses)
+		c.writer.Flush()
+		if !strings.HasPrefix(out.String(), test.want) {
+			t.Errorf("%q: got %q, want %q", test.responses, out.String(), test.want)
+		}
+	}
+}
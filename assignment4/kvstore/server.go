@@ -2,24 +2,52 @@ package main
 
 import (
 	"assignment4/raft"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-//Make it true if server should log to STDOUT
-const LOG_MESSAGES = true
-
 //Errors
 const (
-	ERR_INTERNAL  = "ERR_INTERNAL"
-	ERR_CMD_ERR   = "ERR_CMD_ERR"
-	ERR_NOT_FOUND = "ERR_NOT_FOUND"
-	ERR_VERSION   = "ERR_VERSION"
+	ERR_INTERNAL   = "ERR_INTERNAL"
+	ERR_CMD_ERR    = "ERR_CMD_ERR"
+	ERR_NOT_FOUND  = "ERR_NOT_FOUND"
+	ERR_VERSION    = "ERR_VERSION"
+	ERR_NOT_NUMBER = "ERR_NOT_NUMBER"
+	ERR_TOO_LARGE  = "ERR_TOO_LARGE"
+	ERR_NO_LEADER  = "ERR_NO_LEADER"
+	ERR_NOT_LEADER = "ERR_NOT_LEADER"
+	ERR_TIMEOUT    = "ERR_TIMEOUT"
+
+	ERR_SESSION_EXPIRED = "ERR_SESSION_EXPIRED"
+	ERR_STALE_SEQ       = "ERR_STALE_SEQ"
+	ERR_COMPACTED       = "ERR_COMPACTED"
+	ERR_WATCH_LAGGED    = "ERR_WATCH_LAGGED"
+	ERR_LEASE_NOT_FOUND = "ERR_LEASE_NOT_FOUND"
+	ERR_OUT_OF_RANGE    = "ERR_OUT_OF_RANGE"
+	ERR_OUT_OF_MEMORY   = "ERR_OUT_OF_MEMORY"
+
+	ERR_NAMESPACE_NOT_FOUND = "ERR_NAMESPACE_NOT_FOUND"
+	ERR_QUOTA_EXCEEDED      = "ERR_QUOTA_EXCEEDED"
+	ERR_RATE_LIMITED        = "ERR_RATE_LIMITED"
+
+	ERR_AUTH_REQUIRED     = "ERR_AUTH_REQUIRED"
+	ERR_AUTH_FAILED       = "ERR_AUTH_FAILED"
+	ERR_PERMISSION_DENIED = "ERR_PERMISSION_DENIED"
 )
 
+//Largest value accepted if not given in config
+const DEFAULT_MAX_VALUE_SIZE = 64 * 1024 * 1024
+
 type Command raft.Command //A command from client
 
 //Response bundle from kv store to connection handler
@@ -32,30 +60,82 @@ type KVResponse struct {
 type value struct {
 	val                        []byte
 	numbytes, version, exptime int64
+	expiresAt                  int64 //In log time (unix nanoseconds), 0 if never expires
+	lease                      int64 //Lease key is attached to, 0 if none
+	lastAccess, hits           int64 //Revision of last use and number of uses
 }
 
+//Timing flags, which override config
+var (
+	electionTimeoutMin = flag.Duration("election-timeout-min", 0, "least time to wait for leader before an election")
+	electionTimeoutMax = flag.Duration("election-timeout-max", 0, "most time to wait for leader before an election")
+	heartbeatInterval  = flag.Duration("heartbeat-interval", 0, "time between heartbeats of leader")
+	rpcTimeout         = flag.Duration("rpc-timeout", 0, "time to wait for a peer to answer")
+	maxBatchEntries    = flag.Int64("max-batch", 0, "log entries sent in one append")
+)
+
+//Other flags, which override config of this server or set up logging
+var (
+	configPath     = flag.String("config", "config.json", "cluster config file, .json, .yaml or .toml")
+	dataDir        = flag.String("data-dir", "", "directory for persistent state, Path of config if not given")
+	clientBind     = flag.String("client-bind", "", "address to listen for clients on, ClientBind of config if not given")
+	logBind        = flag.String("log-bind", "", "address to listen for peers on, LogBind of config if not given")
+	logLevel       = flag.String("log-level", "debug", "debug (raft state changes too), info or off")
+	validateConfig = flag.Bool("validate-config", false, "check config, print it as it would be used and exit")
+)
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, os.Args[0]+" [flags] <server id>")
+		fmt.Fprintln(os.Stderr, os.Args[0]+" -validate-config [flags] [server id]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	if !LOG_MESSAGES { //Disable debuging
+	switch *logLevel {
+	case "debug":
+	case "info":
+		raft.LogStates = false
+	case "off":
 		log.SetOutput(ioutil.Discard)
+		raft.LogStates = false
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown log level "+*logLevel)
+		os.Exit(2)
 	}
 
 	//Server should get server id as an argument
-	if len(os.Args) < 2 {
-		log.Print(os.Args[0] + " <server id>")
+	if flag.NArg() < 1 && !*validateConfig {
+		log.Print(os.Args[0] + " [flags] <server id>")
 		return
 	}
 
-	//Parse server id
-	serverID, err := strconv.ParseInt(os.Args[1], 10, 32)
-	if err != nil {
-		log.Print("Server ID not valid")
-		return
+	//Parse server id, -1 if only validating whole config
+	serverID := int64(-1)
+	if flag.NArg() > 0 {
+		var err error
+		if serverID, err = strconv.ParseInt(flag.Arg(0), 10, 32); err != nil {
+			log.Print("Server ID not valid")
+			return
+		}
 	}
 
 	//Read server config and populate ClusterInfo
-	err = raft.ReadConfig()
+	err := raft.ReadConfigFile(*configPath)
+	if err == nil {
+		overrideConfig(&raft.ClusterInfo, int(serverID))
+		err = checkConfig(int(serverID))
+	}
 
+	if *validateConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Config is not valid:\n"+err.Error())
+			os.Exit(1)
+		}
+		data, _ := json.MarshalIndent(raft.ClusterInfo, "", "\t")
+		fmt.Println(string(data))
+		return
+	}
 	if err != nil {
 		log.Print(err.Error())
 		return
@@ -64,12 +144,75 @@ func main() {
 	startServer(int(serverID))
 }
 
+//Set flags in config. Addresses are for server id only
+func overrideConfig(config *raft.ClusterConfig, id int) {
+	overrideTiming(config)
+	if *dataDir != "" {
+		config.Path = *dataDir
+	}
+	for i := range config.Servers {
+		if config.Servers[i].Id != id {
+			continue
+		}
+		if *clientBind != "" {
+			config.Servers[i].ClientBind = *clientBind
+		}
+		if *logBind != "" {
+			config.Servers[i].LogBind = *logBind
+		}
+	}
+}
+
+//Problems of ClusterInfo which would keep server id from running
+//id is -1 to check the whole config only
+func checkConfig(id int) error {
+	var problems []string
+	if err := raft.ClusterInfo.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if !validEvictionPolicy(raft.ClusterInfo.EvictionPolicy) {
+		problems = append(problems, "Unknown EvictionPolicy "+raft.ClusterInfo.EvictionPolicy)
+	}
+	if _, ok := serverConfig(id); id >= 0 && !ok {
+		problems = append(problems, "No config for server "+strconv.Itoa(id))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+//Set timing given as flags in config, in its milliseconds
+func overrideTiming(config *raft.ClusterConfig) {
+	flags := []struct {
+		value  time.Duration
+		config *int64
+	}{
+		{*electionTimeoutMin, &config.ElectionTimeoutMin},
+		{*electionTimeoutMax, &config.ElectionTimeoutMax},
+		{*heartbeatInterval, &config.HeartbeatInterval},
+		{*rpcTimeout, &config.RPCTimeout},
+	}
+	for _, f := range flags {
+		if f.value > 0 {
+			*f.config = int64(f.value / time.Millisecond)
+		}
+	}
+	if *maxBatchEntries > 0 {
+		config.MaxBatchEntries = *maxBatchEntries
+	}
+}
+
 func startServer(serverID int) {
 	log.Print("Starting server..")
+	signals := shutdownSignals() //Before anything which needs a clean stop
 
-	commitCh := make(chan raft.LogEntry, 10) //Commit channel from raft to kvstore
-	kvResponse := make(chan KVResponse, 10)  //Response channel from kvstore to clientManger
-	go kvStoreHandler(commitCh, kvResponse)  //Start kv store handler
+	commitCh := make(chan raft.LogEntry, 10)                 //Commit channel from raft to kvstore
+	kvResponse := make(chan KVResponse, 10)                  //Response channel from kvstore to clientManger
+	leases := newLeaseTable()                                //Shared with lease expirer
+	victims := make(chan []Command, 3)                       //Keys to evict or expire, from kvstore to evictor
+	go kvStoreHandler(commitCh, kvResponse, leases, victims) //Start kv store handler
 
 	//Create a new raft(s) and pass commit channel
 	raftObj, err := raft.NewRaft(&raft.ClusterInfo, serverID, commitCh)
@@ -79,45 +222,77 @@ func startServer(serverID int) {
 		return
 	}
 
+	config, _ := serverConfig(serverID)
+
 	//Listen to TCP connection on specified port
-	conn, err := net.Listen("tcp", ":"+strconv.FormatInt(int64(raftObj.ClientPort), 10))
+	conn, err := net.Listen("tcp", config.ClientListenAddress())
 	if err != nil {
 		log.Print("Error listening to port:" + err.Error())
 		return
 	}
+	conn = clientListener(conn)
+	addListener(conn) //Closed on shutdown
+
+	go clientConnManager(kvResponse, raftObj.LostEntries()) //Hand over responses to waiting clients
+	go leaseExpirer(raftObj, leases)                        //Expire leases when leader
+	go evictor(raftObj, commitCh, victims)                  //Evict and expire keys when leader
 
-	defer conn.Close() //Close connection when function exits
+	//Redis protocol frontend, if configured
+	if config.RespPort > 0 {
+		go startRespServer(raftObj, config.ListenAddress(config.RespPort))
+	}
 
-	clientMap := make(map[raft.Lsn]net.Conn)             //Create client map,Saves all client connections with their Lsn
-	go clientConnManager(raftObj, clientMap, kvResponse) //Manage client connections
+	//HTTP/JSON frontend, if configured
+	if config.HttpPort > 0 {
+		go startHttpServer(raftObj, config.ListenAddress(config.HttpPort))
+	}
 
 	log.Print("Server started..")
+	go serveClients(conn, raftObj)
+
+	shutdown(raftObj, <-signals)
+}
 
+//Accept clients till listener is closed on shutdown
+func serveClients(listener net.Listener, raftObj *raft.Raft) {
 	for {
 		//Wait for connections from clients
-		client, err := conn.Accept()
+		client, err := listener.Accept()
 
 		if err != nil {
+			if isStopping() {
+				return
+			}
 			log.Print("Error accepting connection :" + err.Error())
 			continue
 		}
 
-		//Handle one command for now
-		//Client manager will deal with more after one
-		go handleOneCommand(client, KVResponse{}, raftObj, clientMap) //No response if first time
+		go handleClient(client, raftObj)
 	}
 }
 
-func WriteTCP(clientConn net.Conn, data string) bool {
-	//Write to TCP connection
-	_, err := clientConn.Write([]byte(data))
-	if err != nil {
-		log.Print("Write Error:" + err.Error())
-		return false
+//Listener with TLS, if clients use it
+func clientListener(listener net.Listener) net.Listener {
+	if config := raft.ClientTLSConfig(); config != nil {
+		return tls.NewListener(listener, config)
+	}
+	return listener
+}
+
+//Config of server with given id
+func serverConfig(id int) (raft.ServerConfig, bool) {
+	for _, server := range raft.ClusterInfo.Servers {
+		if server.Id == id {
+			return server, true
+		}
 	}
-	return true
+	return raft.ServerConfig{}, false
 }
 
-func sendError(clientConn net.Conn, error string) bool {
-	return WriteTCP(clientConn, error+"\r\n")
+//Largest value a client can store
+func maxValueSize() int64 {
+	if raft.ClusterInfo.MaxValueSize > 0 {
+		return raft.ClusterInfo.MaxValueSize
+	}
+	return DEFAULT_MAX_VALUE_SIZE
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Client sessions make commands exactly-once. A client registers a
+//session and tags each command with the session id and a sequence
+//number. Response of the last command of each session is remembered,
+//so a command sent again (eg: after connection broke) gets the same
+//response instead of being applied twice.
+//
+//Everything here depends only on the log, including time which comes
+//from the leader's Timestamp in each command. So all replicas, and a
+//server replaying its log after a crash, end up with the same sessions.
+
+//Idle seconds after which a session expires, if not given in settings
+const DEFAULT_SESSION_TIMEOUT = 60 * 60
+
+type session struct {
+	lastSeq      int64  //Sequence number of last command applied
+	lastResponse string //Its response, sent again for duplicates
+	lastActive   int64  //Timestamp of last command
+	user         string //Who registered it, only they can use it
+}
+
+type sessionTable struct {
+	sessions  map[int64]*session //By session id
+	clock     int64              //Latest timestamp seen in log
+	nextSweep int64              //When to look for expired sessions
+	timeout   int64              //Seconds, as in settings from log
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[int64]*session)}
+}
+
+//Idle time after which a session expires, in nanoseconds
+func (t *sessionTable) timeoutNanos() int64 {
+	timeout := t.timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_SESSION_TIMEOUT
+	}
+	return timeout * int64(time.Second)
+}
+
+//Move clock forward to timestamp of the command being applied and
+//remove sessions which have been idle too long
+//Returns ids of removed sessions, in order
+func (t *sessionTable) tick(timestamp int64) []int64 {
+	if timestamp <= t.clock {
+		return nil //Clocks of leaders can differ, never go back
+	}
+	t.clock = timestamp
+
+	if t.clock < t.nextSweep {
+		return nil
+	}
+	timeout := t.timeoutNanos()
+	t.nextSweep = t.clock + timeout/10
+
+	var expired []int64
+	for id, s := range t.sessions {
+		if t.clock-s.lastActive > timeout {
+			log.Print("Session " + strconv.FormatInt(id, 10) + " expired")
+			delete(t.sessions, id)
+			expired = append(expired, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	return expired
+}
+
+//New session, its id is the lsn of register command
+func (t *sessionTable) register(lsn raft.Lsn, user string) string {
+	id := int64(lsn)
+	t.sessions[id] = &session{lastActive: t.clock, user: user}
+	return fmt.Sprintf("SESSION %d", id)
+}
+
+func (t *sessionTable) unregister(command Command) string {
+	if s, ok := t.sessions[command.ClientID]; !ok || s.user != command.User {
+		return ERR_SESSION_EXPIRED
+	}
+	delete(t.sessions, command.ClientID)
+	return "OK"
+}
+
+//Response to send without applying command, if it is not new
+func (t *sessionTable) duplicate(command Command) (string, bool) {
+	if command.ClientID == 0 || command.Cmd == "unregister" {
+		return "", false //Not in a session
+	}
+
+	s, ok := t.sessions[command.ClientID]
+	switch {
+	case !ok || s.user != command.User:
+		return ERR_SESSION_EXPIRED, true
+	case command.Seq == s.lastSeq:
+		log.Print("Duplicate command, sending old response")
+		s.lastActive = t.clock
+		return s.lastResponse, true
+	case command.Seq < s.lastSeq:
+		//Response is not kept anymore
+		return ERR_STALE_SEQ, true
+	}
+	return "", false
+}
+
+//Keep session from expiring, without a command in it
+func (t *sessionTable) touch(id int64) {
+	if s, ok := t.sessions[id]; ok {
+		s.lastActive = t.clock
+	}
+}
+
+//Remember response of a command applied in a session
+func (t *sessionTable) record(command Command, response string) {
+	s, ok := t.sessions[command.ClientID]
+	if !ok {
+		return
+	}
+	s.lastSeq = command.Seq
+	s.lastResponse = response
+	s.lastActive = t.clock
+}
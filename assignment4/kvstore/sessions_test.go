@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionDuplicate(t *testing.T) {
+	table := newSessionTable()
+	if response := table.register(5, "bob"); response != "SESSION 5" {
+		t.Fatalf("got %q", response)
+	}
+	command := Command{Cmd: "incr", ClientID: 5, Seq: 1, User: "bob"}
+
+	if _, dup := table.duplicate(command); dup {
+		t.Fatal("new command taken as duplicate")
+	}
+	table.record(command, "NUM 1")
+
+	//Sent again, gets the same response without being applied
+	if response, dup := table.duplicate(command); !dup || response != "NUM 1" {
+		t.Errorf("got %q %v, want old response", response, dup)
+	}
+
+	command.Seq = 2
+	if _, dup := table.duplicate(command); dup {
+		t.Error("next command taken as duplicate")
+	}
+	table.record(command, "NUM 2")
+
+	command.Seq = 1
+	if response, dup := table.duplicate(command); !dup || response != ERR_STALE_SEQ {
+		t.Errorf("got %q %v, want %q", response, dup, ERR_STALE_SEQ)
+	}
+
+	//Only the user who registered can use the session
+	other := Command{Cmd: "incr", ClientID: 5, Seq: 3, User: "eve"}
+	if response, dup := table.duplicate(other); !dup || response != ERR_SESSION_EXPIRED {
+		t.Errorf("got %q %v, want %q", response, dup, ERR_SESSION_EXPIRED)
+	}
+	if response := table.unregister(other); response != ERR_SESSION_EXPIRED {
+		t.Errorf("unregister by other user: got %q", response)
+	}
+
+	//Commands outside sessions are never duplicates
+	if _, dup := table.duplicate(Command{Cmd: "incr"}); dup {
+		t.Error("command without session taken as duplicate")
+	}
+
+	if response := table.unregister(Command{ClientID: 5, User: "bob"}); response != "OK" {
+		t.Errorf("unregister: got %q", response)
+	}
+	command.Seq = 3
+	if response, _ := table.duplicate(command); response != ERR_SESSION_EXPIRED {
+		t.Errorf("after unregister: got %q, want %q", response, ERR_SESSION_EXPIRED)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	table := newSessionTable()
+	table.timeout = 10 //As applied from settings
+	start := time.Now().UnixNano()
+	table.tick(start)
+	table.register(1, "")
+	table.register(2, "")
+
+	//Session 2 stays active, 1 goes idle
+	table.tick(start + int64(8*time.Second))
+	table.touch(2)
+
+	if expired := table.tick(start + int64(5*time.Second)); expired != nil {
+		t.Errorf("clock went back and expired %v", expired)
+	}
+	expired := table.tick(start + int64(11*time.Second))
+	if len(expired) != 1 || expired[0] != 1 {
+		t.Errorf("got expired %v, want [1]", expired)
+	}
+	if _, ok := table.sessions[2]; !ok {
+		t.Error("active session expired")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"assignment4/raft"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//On SIGTERM or SIGINT the server shuts down gracefully. Listeners are
+//closed so that no new clients come, connections stop reading commands,
+//and raft hands over leadership and stops. Requests still waiting for
+//their entries then get ERR_NOT_LEADER, since the new leader may or may
+//not commit them. Replies are written before connections are closed.
+//Whatever isn't done in SHUTDOWN_TIMEOUT is cut off.
+
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+var stopping = make(chan struct{}) //Closed when shutdown starts
+
+//Listeners and client connections to close on shutdown
+var clients = struct {
+	sync.Mutex
+	listeners []net.Listener
+	http      *http.Server
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup //Connections not closed yet
+}{conns: make(map[net.Conn]bool)}
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+//Close listener on shutdown, or now if shutting down already
+func addListener(listener net.Listener) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if isStopping() {
+		listener.Close()
+		return
+	}
+	clients.listeners = append(clients.listeners, listener)
+}
+
+//Shut down HTTP server on shutdown. False if shutting down already
+func addHttpServer(server *http.Server) bool {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if isStopping() {
+		return false
+	}
+	clients.http = server
+	return true
+}
+
+//Register a client connection, false if server is shutting down
+func trackConn(conn net.Conn) bool {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if isStopping() {
+		return false
+	}
+	clients.conns[conn] = true
+	clients.wg.Add(1)
+	return true
+}
+
+//Connection is closed
+func untrackConn(conn net.Conn) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.conns[conn] {
+		delete(clients.conns, conn)
+		clients.wg.Done()
+	}
+}
+
+//Channel of shutdown signals
+func shutdownSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	return signals
+}
+
+//Stop serving clients and stop raft
+func shutdown(raftObj *raft.Raft, sig os.Signal) {
+	log.Print("Shutting down on " + sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	clients.Lock()
+	close(stopping)
+	for _, listener := range clients.listeners {
+		listener.Close()
+	}
+	for conn := range clients.conns {
+		conn.SetReadDeadline(time.Now()) //Stop reading, replies are still written
+	}
+	httpServer := clients.http
+	clients.Unlock()
+
+	//Entries committed while handing over leadership are answered as usual
+	if err := raftObj.Shutdown(ctx); err != nil {
+		log.Print("Raft shutdown: " + err.Error())
+	}
+	failPending(1)
+
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Print("HTTP shutdown: " + err.Error())
+		}
+	}
+
+	//Wait for replies to be written
+	done := make(chan struct{})
+	go func() {
+		clients.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Print("Closing connections not done in time")
+		clients.Lock()
+		for conn := range clients.conns {
+			conn.Close()
+		}
+		clients.Unlock()
+	}
+
+	log.Print("Server stopped")
+}
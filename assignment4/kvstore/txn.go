@@ -0,0 +1,259 @@
+package main
+
+import (
+	"assignment4/raft"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+//Transactions update many keys at once. A transaction has conditions on
+//keys and two lists of operations. If all conditions hold the success
+//operations are applied, otherwise the failure ones. The whole thing is
+//a single log entry, so it is applied atomically on every replica.
+//
+//	txn <num_compares> <num_success_ops> <num_failure_ops>\r\n
+//	<compare>\r\n ...
+//	<operation>\r\n ...
+//
+//Compares are "version <key> <=|!=|<|>> <version>", "exists <key>" and
+//"missing <key>". Operations are "put <key> <exptime> <numbytes>" followed
+//by the value, "delete <key>" and "get <key>".
+//Response is "TXN SUCCESS|FAILURE <n>" followed by responses of the n
+//operations applied, one after another. If an operation of the branch
+//can't be applied (its lease is gone, say) none is, and the response is
+//just the error.
+
+//Most compares or operations a transaction can have in each list
+const MAX_TXN_OPS = 128
+
+//Header of a transaction, compares and operations are read later
+func parseTxn(fields []string) (Command, string) {
+	var counts [3]int
+	for i := range counts {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil || n < 0 || n > MAX_TXN_OPS {
+			return Command{}, ERR_CMD_ERR
+		}
+		counts[i] = n
+	}
+
+	return Command{
+		Cmd:      "txn",
+		Compares: make([]raft.Compare, counts[0]),
+		Success:  make([]raft.Command, counts[1]),
+		Failure:  make([]raft.Command, counts[2]),
+	}, ""
+}
+
+func parseCompare(line string) (raft.Compare, string) {
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) == 2 && (fields[0] == "exists" || fields[0] == "missing"):
+		return raft.Compare{Target: fields[0], Key: fields[1]}, ""
+
+	case len(fields) == 4 && fields[0] == "version":
+		switch fields[2] {
+		case "=", "!=", "<", ">":
+		default:
+			return raft.Compare{}, ERR_CMD_ERR
+		}
+		version, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return raft.Compare{}, ERR_CMD_ERR
+		}
+		return raft.Compare{Target: "version", Key: fields[1], Op: fields[2], Version: version}, ""
+	}
+
+	return raft.Compare{}, ERR_CMD_ERR
+}
+
+//Operation line of a transaction. Value of put is read later
+func parseTxnOp(line string) (raft.Command, string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return raft.Command{}, ERR_CMD_ERR
+	}
+
+	switch fields[0] {
+	case "put":
+		fields[0] = "set" //Same arguments as set
+	case "delete", "get":
+	default:
+		return raft.Command{}, ERR_CMD_ERR
+	}
+
+	op, errStr := parseInput(strings.Join(fields, " "))
+	if errStr != "" {
+		return raft.Command{}, errStr
+	}
+
+	switch op.Cmd {
+	case "set":
+		op.Cmd = "put" //Overwrites
+	case "get":
+		op.Cmd = "getm" //Version is useful in a transaction
+	}
+	return raft.Command(op), ""
+}
+
+//Read compares and operations of a transaction after its header
+//All lines are read even if one is wrong, so that next command can be read
+func (p *protocolReader) readTxn(command *Command) (string, error) {
+
+	errStr := ""
+	setErr := func(e string) {
+		if errStr == "" {
+			errStr = e
+		}
+	}
+
+	for i := range command.Compares {
+		line, lineErr, err := p.readLine()
+		if err != nil {
+			return "", err
+		}
+		p.raw = append(p.raw, line+"\r\n"...)
+		setErr(lineErr)
+
+		compare, cmpErr := parseCompare(line)
+		setErr(cmpErr)
+		command.Compares[i] = compare
+	}
+
+	for _, ops := range [][]raft.Command{command.Success, command.Failure} {
+		for i := range ops {
+			line, lineErr, err := p.readLine()
+			if err != nil {
+				return "", err
+			}
+			p.raw = append(p.raw, line+"\r\n"...)
+			setErr(lineErr)
+
+			op, opErr := parseTxnOp(line)
+			if opErr == "" && op.Cmd == "put" {
+				data, dataErr, err := p.readData(op.Length)
+				if err != nil {
+					return "", err
+				}
+				p.raw = append(p.raw, data...)
+				p.raw = append(p.raw, '\r', '\n')
+				op.Value = string(data)
+				opErr = dataErr
+			} else if opErr != "" {
+				if err := p.skipData(line); err != nil {
+					return "", err
+				}
+			}
+			setErr(opErr)
+			ops[i] = op
+		}
+	}
+
+	return errStr, nil
+}
+
+//Check compares and apply operations of one branch
+func (store *kvStore) applyTxn(command Command) string {
+
+	ops, result := command.Success, "SUCCESS"
+	for _, compare := range command.Compares {
+		if !store.compareHolds(compare) {
+			ops, result = command.Failure, "FAILURE"
+			break
+		}
+	}
+
+	if errStr := store.checkTxn(ops); errStr != "" {
+		return errStr
+	}
+
+	responses := []string{fmt.Sprintf("TXN %s %d", result, len(ops))}
+	for _, op := range ops {
+		response := ERR_CMD_ERR
+		switch op.Cmd {
+		case "put":
+			response = store.txnPut(op)
+		case "delete":
+			response = store.deleteKey(Command(op))
+		case "getm":
+			response = store.getValueMeta(Command(op))
+		}
+		responses = append(responses, response)
+	}
+
+	return strings.Join(responses, "\r\n")
+}
+
+//Error of the first operation which can't be applied, "" if all can
+//Checked before any is applied, so a transaction is never half done
+func (store *kvStore) checkTxn(ops []raft.Command) string {
+	for _, op := range ops {
+		if op.Cmd == "put" && !store.leaseExists(op.Lease) {
+			log.Print("Lease not found")
+			return ERR_LEASE_NOT_FOUND
+		}
+	}
+
+	//Memory and quota are checked for the whole transaction, as a key
+	//it deletes can make room for one it puts
+	sizes := txnSizes(ops)
+	if !store.txnFits(sizes) {
+		log.Print("Out of memory")
+		return ERR_OUT_OF_MEMORY
+	}
+	if !store.txnWithinQuota(sizes) {
+		log.Print("Quota exceeded")
+		return ERR_QUOTA_EXCEEDED
+	}
+	return ""
+}
+
+//Size of each key ops change, once they are applied. 0 if deleted
+func txnSizes(ops []raft.Command) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, op := range ops {
+		switch op.Cmd {
+		case "put":
+			sizes[op.Key] = entrySize(op.Key, value{val: []byte(op.Value)})
+		case "delete":
+			sizes[op.Key] = 0
+		}
+	}
+	return sizes
+}
+
+//Put of a transaction, checkTxn has done its checks
+func (store *kvStore) txnPut(op raft.Command) string {
+	data, _ := store.data.get(op.Key)
+	return store.storeValue(op.Key, store.newValue(Command(op), data), data.lease)
+}
+
+func (store *kvStore) compareHolds(compare raft.Compare) bool {
+	val, ok := store.data.get(compare.Key)
+
+	switch compare.Target {
+	case "exists":
+		return ok
+	case "missing":
+		return !ok
+	}
+
+	if !ok {
+		return false //Version of a missing key doesn't compare
+	}
+
+	switch compare.Op {
+	case "=":
+		return val.version == compare.Version
+	case "!=":
+		return val.version != compare.Version
+	case "<":
+		return val.version < compare.Version
+	case ">":
+		return val.version > compare.Version
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"assignment4/raft"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Empty kvstore, for applying commands in tests
+func newTestStore() *kvStore {
+	return &kvStore{
+		data:       newOrderedMap(),
+		sessions:   newSessionTable(),
+		leases:     newLeaseTable(),
+		locks:      make(map[string]*lockState),
+		namespaces: map[string]*namespace{"": {}},
+		evicting:   make(map[string]time.Time),
+		expiring:   make(map[string]time.Time),
+		victims:    make(chan []Command, 3),
+		revision:   1,
+		settings:   defaultSettings(),
+	}
+}
+
+//Put in the default namespace, keys are scoped as by apply
+func putOp(key, val string, lease int64) raft.Command {
+	return raft.Command{Cmd: "put", Key: scopedKey("", key), Value: val, Length: int64(len(val)), Lease: lease}
+}
+
+func TestTxnApplies(t *testing.T) {
+	store := newTestStore()
+	store.setCas(Command(putOp("b", "old", 0)))
+
+	response := store.applyTxn(Command{Cmd: "txn",
+		Compares: []raft.Compare{{Target: "missing", Key: scopedKey("", "a")}},
+		Success:  []raft.Command{putOp("a", "1", 0), {Cmd: "delete", Key: scopedKey("", "b")}},
+	})
+	if !strings.HasPrefix(response, "TXN SUCCESS 2") {
+		t.Errorf("got %q", response)
+	}
+	if _, ok := store.data.get(scopedKey("", "a")); !ok {
+		t.Error("a not stored")
+	}
+	if _, ok := store.data.get(scopedKey("", "b")); ok {
+		t.Error("b not deleted")
+	}
+}
+
+func TestTxnUnknownLease(t *testing.T) {
+	store := newTestStore()
+	store.setCas(Command(putOp("b", "old", 0)))
+
+	response := store.applyTxn(Command{Cmd: "txn",
+		Success: []raft.Command{putOp("a", "1", 0), {Cmd: "delete", Key: scopedKey("", "b")}, putOp("c", "1", 42)},
+	})
+	if response != ERR_LEASE_NOT_FOUND {
+		t.Errorf("got %q, want %q", response, ERR_LEASE_NOT_FOUND)
+	}
+	if _, ok := store.data.get(scopedKey("", "a")); ok {
+		t.Error("a stored by a rejected txn")
+	}
+	if _, ok := store.data.get(scopedKey("", "b")); !ok {
+		t.Error("b deleted by a rejected txn")
+	}
+}
+
+func TestTxnMemory(t *testing.T) {
+	store := newTestStore()
+	store.applySettings(Command{Cmd: "settings", Length: 200, Value: "reject"})
+	big := strings.Repeat("x", 60) //126 bytes with key and overhead
+	store.setCas(Command(putOp("b", big, 0)))
+
+	response := store.applyTxn(Command{Cmd: "txn",
+		Success: []raft.Command{putOp("c", "1", 0), putOp("a", big, 0)},
+	})
+	if response != ERR_OUT_OF_MEMORY {
+		t.Errorf("got %q, want %q", response, ERR_OUT_OF_MEMORY)
+	}
+	if _, ok := store.data.get(scopedKey("", "c")); ok {
+		t.Error("c stored by a rejected txn")
+	}
+
+	//Deleting b makes room for a, even though a is put first
+	response = store.applyTxn(Command{Cmd: "txn",
+		Success: []raft.Command{putOp("a", big, 0), {Cmd: "delete", Key: scopedKey("", "b")}},
+	})
+	if !strings.HasPrefix(response, "TXN SUCCESS 2\r\nOK") {
+		t.Errorf("got %q", response)
+	}
+}
+
+func TestTxnQuota(t *testing.T) {
+	store := newTestStore()
+	store.namespaces["team"] = &namespace{maxKeys: 2}
+	put := func(key string) raft.Command {
+		op := putOp(key, "1", 0)
+		op.Key = scopedKey("team", key)
+		return op
+	}
+	store.setCas(Command(put("a")))
+
+	//Two new keys take team over its quota, first one alone would not
+	response := store.applyTxn(Command{Cmd: "txn", Success: []raft.Command{put("b"), put("c")}})
+	if response != ERR_QUOTA_EXCEEDED {
+		t.Errorf("got %q, want %q", response, ERR_QUOTA_EXCEEDED)
+	}
+	if usage := store.data.usage["team"]; usage.keys != 1 {
+		t.Errorf("team has %d keys after a rejected txn, want 1", usage.keys)
+	}
+
+	//Deleting a makes room
+	response = store.applyTxn(Command{Cmd: "txn",
+		Success: []raft.Command{put("b"), put("c"), {Cmd: "delete", Key: scopedKey("team", "a")}},
+	})
+	if !strings.HasPrefix(response, "TXN SUCCESS 3") {
+		t.Errorf("got %q", response)
+	}
+	if usage := store.data.usage["team"]; usage.keys != 2 {
+		t.Errorf("team has %d keys, want 2", usage.keys)
+	}
+}
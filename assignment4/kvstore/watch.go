@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Watches stream changes of a key, or of all keys with a prefix, as
+//kvStoreHandler applies them. Recent events are kept so that a client
+//can reconnect and resume from the revision it saw last.
+//
+//	watch <key> [<from_revision>]\r\n
+//
+//A key ending with * watches all keys starting with the rest of it.
+//Reply is "WATCHING <revision>" with the current revision, followed by
+//events as they happen:
+//
+//	EVENT put <key> <revision> <exptime> <numbytes>\r\n<value>
+//	EVENT delete <key> <revision>
+//	EVENT expire <key> <revision>
+//	EVENT evict <key> <revision>
+//
+//Revision of an event is the lsn of the entry which caused it, which is
+//also the version of key after a put.
+
+//Events kept to resume watches from
+const WATCH_HISTORY = 1024
+
+//Events a watcher can be behind before it is dropped
+const WATCH_BUFFER = 256
+
+//Events of the kvstore, shared by kvStoreHandler and client connections
+var hub = newWatchHub()
+
+type watchEvent struct {
+	kind     string //put, delete, expire or evict
+	key      string
+	revision int64
+	val      value //New value for put
+}
+
+type watcher struct {
+	key    string
+	prefix bool        //key is a prefix
+	user   string      //Who watches, "" if not logged in
+	events chan string //Events as sent to client, closed when dropped
+	lagged int64       //Revision to resume from if dropped for being slow
+	denied string      //Error if dropped as user can't read key anymore
+}
+
+type watchHub struct {
+	lock      sync.Mutex
+	watchers  map[*watcher]bool
+	history   []watchEvent //Latest events, oldest first
+	compacted int64        //Latest revision not in history anymore
+	revision  int64        //Latest revision applied
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]bool)}
+}
+
+//watch <key> [<from_revision>]
+func parseWatch(fields []string) (Command, string) {
+	if len(fields) != 2 && len(fields) != 3 {
+		return Command{}, ERR_CMD_ERR
+	}
+
+	command := Command{Cmd: "watch", Key: fields[1]}
+	if len(fields) == 3 {
+		from, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || from < 0 {
+			return Command{}, ERR_CMD_ERR
+		}
+		command.Version = from
+	}
+	return command, ""
+}
+
+func (e watchEvent) String() string {
+	if e.kind != "put" {
+		return fmt.Sprintf("EVENT %s %s %d", e.kind, unscopedKey(e.key), e.revision)
+	}
+	return fmt.Sprintf("EVENT put %s %d %d %d\r\n%s", unscopedKey(e.key), e.revision, e.val.exptime, e.val.numbytes, e.val.val)
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+//Revision of log entry being applied
+func (h *watchHub) applied(revision int64) {
+	h.lock.Lock()
+	h.revision = revision
+	h.lock.Unlock()
+}
+
+//Record event and send it to watchers of its key
+//Never blocks, a watcher which is too far behind is dropped
+func (h *watchHub) publish(e watchEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.history = append(h.history, e)
+	if len(h.history) > WATCH_HISTORY {
+		//Drop whole revisions, a txn or revoke can have many events with
+		//one revision and resuming from it must give all of them
+		h.compacted = h.history[0].revision
+		drop := 1
+		for drop < len(h.history) && h.history[drop].revision == h.compacted {
+			drop++
+		}
+		h.history = h.history[drop:]
+	}
+
+	var event string
+	for w := range h.watchers {
+		if !w.matches(e.key) {
+			continue
+		}
+		if event == "" {
+			event = e.String()
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			//Client can resume from this event
+			w.lagged = e.revision
+			h.remove(w)
+		}
+	}
+}
+
+//Start watching key for user. Events from revision from onwards are
+//sent, or only new ones if from is 0. Returns current revision
+func (h *watchHub) watch(key, user string, from int64) (*watcher, int64, string) {
+	w := &watcher{key: key, user: user}
+	if strings.HasSuffix(key, "*") {
+		w.key, w.prefix = strings.TrimSuffix(key, "*"), true
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if from > 0 && from <= h.compacted {
+		return nil, 0, fmt.Sprintf("%s %d", ERR_COMPACTED, h.compacted+1)
+	}
+
+	var old []string
+	if from > 0 {
+		for _, e := range h.history {
+			if e.revision >= from && w.matches(e.key) {
+				old = append(old, e.String())
+			}
+		}
+	}
+
+	w.events = make(chan string, len(old)+WATCH_BUFFER)
+	for _, event := range old {
+		w.events <- event
+	}
+
+	h.watchers[w] = true
+	return w, h.revision, ""
+}
+
+//Stop watching
+func (h *watchHub) cancel(w *watcher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.watchers[w] {
+		h.remove(w)
+	}
+}
+
+//Drop watchers whose users can't read their keys anymore, after
+//users or roles change
+func (h *watchHub) recheck() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		key := w.key
+		if w.prefix {
+			key += "*"
+		}
+		if errStr := acl.canRead(w.user, key); errStr != "" {
+			w.denied = errStr
+			h.remove(w)
+		}
+	}
+}
+
+//Must hold lock
+func (h *watchHub) remove(w *watcher) {
+	delete(h.watchers, w)
+	close(w.events)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestWatchHistoryTrimsRevisions(t *testing.T) {
+	h := newWatchHub()
+	for i := 0; i < WATCH_HISTORY; i++ {
+		h.publish(watchEvent{kind: "delete", key: scopedKey("", "a"), revision: int64(i/2 + 1)})
+	}
+	//Second event of the last revision pushes out the first one
+	h.publish(watchEvent{kind: "delete", key: scopedKey("", "b"), revision: WATCH_HISTORY/2 + 1})
+
+	if h.compacted != 1 || h.history[0].revision != 2 {
+		t.Fatalf("compacted %d, oldest %d, want 1 and 2", h.compacted, h.history[0].revision)
+	}
+	if _, _, errStr := h.watch(scopedKey("", "a"), "", 1); errStr != ERR_COMPACTED+" 2" {
+		t.Errorf("got %q resuming from trimmed revision", errStr)
+	}
+
+	w, _, errStr := h.watch(scopedKey("", "a"), "", 2)
+	if errStr != "" || len(w.events) != WATCH_HISTORY-2 {
+		t.Errorf("got %q and %d events from revision 2, want %d", errStr, len(w.events), WATCH_HISTORY-2)
+	}
+}
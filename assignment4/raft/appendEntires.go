@@ -9,6 +9,7 @@ type AppendRPCArgs struct {
 	PrevLogTerm  uint64
 	Log          []LogItem
 	LeaderCommit uint64
+	ClusterID    string //Of leader
 }
 
 type AppendRPCResults struct {
@@ -19,23 +20,52 @@ type AppendRPCResults struct {
 //Append call from client
 func (r *Raft) Append(data Command) (LogEntry, error) {
 
+	if r.stopped() {
+		return LogItem{}, ErrShutdown
+	}
+
 	//Check if leader. If not, send redirect
-	if r.ServerID != r.LeaderID {
-		return LogItem{}, ErrRedirect(r.LeaderID)
+	if !r.IsLeader() {
+		return LogItem{}, r.redirectError()
 	}
 
-	responseCh := make(chan LogEntry)           //Response channel
-	r.eventCh <- ClientAppend{data, responseCh} //Send a clientAppend event
-	logItem := <-responseCh                     //Get back response logentry
+	responseCh := make(chan LogEntry, 1) //Response channel
+	var logItem LogEntry
+
+	//Send a clientAppend event and get back response logentry
+	select {
+	case r.eventCh <- ClientAppend{data, responseCh}:
+	case <-r.done:
+		return LogItem{}, ErrShutdown
+	}
+	select {
+	case logItem = <-responseCh:
+	case <-r.done:
+		return LogItem{}, ErrShutdown
+	}
 
 	if logItem.Lsn() == 0 {
 		//Append was to a follower
-		return LogItem{}, ErrRedirect(r.LeaderID)
+		return LogItem{}, r.redirectError()
 	}
 
 	return logItem, nil
 }
 
+//True if this server is the leader as far as it knows
+func (r *Raft) IsLeader() bool {
+	return r.ServerID == r.LeaderID
+}
+
+//ErrRedirect to leader, or ErrNoLeader if leader is not known
+func (r *Raft) redirectError() error {
+	leaderID := r.LeaderID
+	if leaderID < 0 {
+		return ErrNoLeader
+	}
+	return ErrRedirect(leaderID)
+}
+
 //Append from leader
 func (raft *Raft) appendEntries(args AppendRPCArgs) bool {
 
@@ -51,6 +81,11 @@ func (raft *Raft) appendEntries(args AppendRPCArgs) bool {
 		//Update Leader ID
 		raft.LeaderID = args.LeaderId
 
+		//New server joins cluster of its first leader
+		if raft.clusterID() == "" && args.ClusterID != "" {
+			checkError(raft.setClusterID(args.ClusterID))
+		}
+
 		if len(args.Log) > 0 {
 			//It is an appendEnties, not a heartBeat
 
@@ -64,14 +99,32 @@ func (raft *Raft) appendEntries(args AppendRPCArgs) bool {
 				// prevLogTerm
 
 				//Remove that entry and everything after it
+				raft.Lock.Lock()
 				raft.Log = raft.Log[:args.PrevLogIndex]
+				raft.Lock.Unlock()
+				raft.notifyLost(args.PrevLogIndex)
 
 				return false
 			}
 
 			//If everything is alright, append the entries
+			//Entries already present are skipped, and a conflicting
+			//entry is removed with everything after it
 			raft.Lock.Lock()
-			raft.Log = append(raft.Log, args.Log...)
+			newEntries := args.Log
+			for len(newEntries) > 0 {
+				index := newEntries[0].Lsn()
+				if int(index) >= len(raft.Log) {
+					break
+				}
+				if raft.Log[index].Term != newEntries[0].Term {
+					raft.Log = raft.Log[:index]
+					raft.notifyLost(index)
+					break
+				}
+				newEntries = newEntries[1:]
+			}
+			raft.Log = append(raft.Log, newEntries...)
 			raft.Lock.Unlock()
 		}
 
@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+)
+
+//Cluster id keeps servers of different clusters apart, say two test
+//clusters started with overlapping ports. It is ClusterID of config, or
+//if that is not given, a random id made by the first leader of a new
+//cluster. A server which has none yet takes it from the first leader
+//which appends to it. Either way it is kept with the state, so it never
+//changes with the servers in config. A server rejects RPCs which carry
+//another id or none, and refuses to start if config gives an id other
+//than the saved one.
+
+//Random cluster id, for first leader of a cluster without one in config
+func newClusterID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Couldn't make cluster id: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+//Cluster id of this server
+func (raft *Raft) clusterID() string {
+	raft.Lock.Lock()
+	defer raft.Lock.Unlock()
+	return raft.ClusterID
+}
+
+//Fix cluster id at start from config, if restored state has none.
+//Error if state is of another cluster than config
+func (raft *Raft) checkConfigCluster(config *ClusterConfig) error {
+	id := config.ClusterID
+	if id == "" || raft.ClusterID == id {
+		return nil //Saved one, or learnt later
+	}
+
+	if raft.ClusterID != "" {
+		return errors.New("State of server " + strconv.Itoa(raft.ServerID) + " is of cluster " +
+			raft.ClusterID + ", not " + id + " of config")
+	}
+	return raft.setClusterID(id)
+}
+
+//Fix cluster id, if not fixed yet, and save it
+func (raft *Raft) setClusterID(id string) error {
+	raft.Lock.Lock()
+	if raft.ClusterID != "" {
+		raft.Lock.Unlock()
+		return nil
+	}
+	raft.ClusterID = id
+	raft.Lock.Unlock()
+
+	log.Print("Server " + strconv.Itoa(raft.ServerID) + " is in cluster " + id)
+	return raft.SyncStateToFile(raft.stateFile)
+}
+
+//Error if an RPC with cluster id is from another cluster, or has no id.
+//Any is taken till this server has an id
+func (raft *Raft) checkCluster(id string, from int) error {
+	own := raft.clusterID()
+	if id != "" && id == own {
+		return nil
+	}
+	if own == "" {
+		return nil //New server, learns id from leader
+	}
+	log.Print("Rejected RPC of server " + strconv.Itoa(from) + " from cluster \"" + id + "\", this is " + own)
+	return errors.New("Server " + strconv.Itoa(raft.ServerID) + " is in another cluster")
+}
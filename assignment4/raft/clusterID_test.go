@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testServers() []ServerConfig {
+	return []ServerConfig{
+		{Id: 0, Hostname: "localhost", ClientPort: 9000, LogPort: 9100},
+		{Id: 1, Hostname: "localhost", ClientPort: 9001, LogPort: 9101},
+		{Id: 2, Hostname: "localhost", ClientPort: 9002, LogPort: 9102},
+	}
+}
+
+func TestCheckCluster(t *testing.T) {
+	r := &Raft{ServerID: 1, ClusterID: "abc"}
+
+	if err := r.checkCluster("abc", 0); err != nil {
+		t.Errorf("RPC of own cluster rejected: %v", err)
+	}
+	if err := r.checkCluster("xyz", 0); err == nil {
+		t.Error("RPC of another cluster accepted")
+	}
+	if err := r.checkCluster("", 0); err == nil {
+		t.Error("RPC without cluster id accepted")
+	}
+}
+
+func TestNewClusterLearnsID(t *testing.T) {
+	dir := t.TempDir()
+	leader := &Raft{ServerID: 0, Log: []LogItem{{}}, stateFile: filepath.Join(dir, "0"+FILENAME)}
+	follower := &Raft{ServerID: 1, Log: []LogItem{{}}, stateFile: filepath.Join(dir, "1"+FILENAME)}
+
+	//Without ClusterID in config, ids are not derived from servers
+	config := &ClusterConfig{Servers: testServers()}
+	for _, r := range []*Raft{leader, follower} {
+		if err := r.checkConfigCluster(config); err != nil || r.ClusterID != "" {
+			t.Fatalf("got cluster %q %v, want none till a leader", r.ClusterID, err)
+		}
+	}
+
+	//First leader makes a random id, new servers take it from its RPCs
+	if err := leader.setClusterID(newClusterID()); err != nil {
+		t.Fatal(err)
+	}
+	if leader.ClusterID == newClusterID() || len(leader.ClusterID) != 32 {
+		t.Errorf("cluster id %q is not random", leader.ClusterID)
+	}
+	if err := follower.checkCluster(leader.ClusterID, 0); err != nil {
+		t.Errorf("new server rejected leader: %v", err)
+	}
+	follower.appendEntries(AppendRPCArgs{Term: 1, LeaderId: 0, ClusterID: leader.ClusterID})
+	if follower.ClusterID != leader.ClusterID {
+		t.Fatalf("got cluster %q, want %q of leader", follower.ClusterID, leader.ClusterID)
+	}
+
+	restored := &Raft{ServerID: 1}
+	if err := restored.ReadStateFromFile(follower.stateFile); err != nil || restored.ClusterID != leader.ClusterID {
+		t.Errorf("cluster id not saved: %q %v", restored.ClusterID, err)
+	}
+	if err := follower.checkCluster("xyz", 2); err == nil {
+		t.Error("RPC of another cluster accepted once id is known")
+	}
+}
+
+func TestCheckConfigCluster(t *testing.T) {
+	config := &ClusterConfig{Servers: testServers(), ClusterID: "given"}
+	r := &Raft{ServerID: 1, Log: []LogItem{{}}, stateFile: filepath.Join(t.TempDir(), FILENAME)}
+
+	//New server takes id of config and saves it
+	if err := r.checkConfigCluster(config); err != nil {
+		t.Fatal(err)
+	}
+	if r.ClusterID != "given" {
+		t.Errorf("got cluster %q, want %q", r.ClusterID, "given")
+	}
+	restored := &Raft{ServerID: 1}
+	if err := restored.ReadStateFromFile(r.stateFile); err != nil || restored.ClusterID != r.ClusterID {
+		t.Errorf("cluster id not saved: %q %v", restored.ClusterID, err)
+	}
+
+	if err := r.checkConfigCluster(config); err != nil {
+		t.Errorf("restart with same config: %v", err)
+	}
+	config.ClusterID = ""
+	if err := r.checkConfigCluster(config); err != nil || r.ClusterID != "given" {
+		t.Errorf("restart without ClusterID: %q %v", r.ClusterID, err)
+	}
+	config.ClusterID = "other"
+	if err := r.checkConfigCluster(config); err == nil {
+		t.Error("server of another cluster started")
+	}
+}
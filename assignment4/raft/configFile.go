@@ -0,0 +1,324 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//Cluster config is read from a JSON, YAML or TOML file, by its extension
+//(.json, .yaml or .yml, .toml). Settings of the cluster can then be
+//overridden by environment variables named KVSTORE_ and the setting in
+//upper case, eg: KVSTORE_MAXMEMORY=1000000.
+//
+//Only the subset of YAML and TOML which config needs is understood: a
+//setting per line, comments with #, and servers as a list,
+//
+//	Path: data                       Path = "data"
+//	Servers:                         [[Servers]]
+//	  - Id: 0                        Id = 0
+//	    Hostname: localhost          Hostname = "localhost"
+//	  - {Id: 1, Hostname: host1}     [[Servers]]
+//	                                 Id = 1
+//
+//Strings can be quoted, and must be if they have a # or a comma in a
+//{...} server. Double quoted strings take escapes like \" and \\.
+
+const ENV_PREFIX = "KVSTORE_"
+
+//One setting as read from a file, before it is converted to its type
+type setting struct {
+	name, value string
+	line        int
+}
+
+//Read config from path into ClusterInfo
+func ReadConfigFile(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	ClusterInfo = config
+	if nServers == 0 {
+		nServers = len(ClusterInfo.Servers)
+	}
+	return nil
+}
+
+//Config in file at path, with environment overrides
+func LoadConfig(path string) (ClusterConfig, error) {
+	var config ClusterConfig
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, errors.New("Couldn't open config file from :" + path)
+	}
+
+	var cluster []setting
+	var servers [][]setting
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		cluster, servers, err = parseYAML(string(data))
+	case ".toml":
+		cluster, servers, err = parseTOML(string(data))
+	default:
+		if json.Unmarshal(data, &config) != nil {
+			err = errors.New("Wrong format of config file")
+		}
+	}
+	if err != nil {
+		return config, errors.New(path + ": " + err.Error())
+	}
+
+	//Settings of YAML and TOML
+	if err = applySettings(reflect.ValueOf(&config).Elem(), cluster); err != nil {
+		return config, errors.New(path + ": " + err.Error())
+	}
+	for _, settings := range servers {
+		var server ServerConfig
+		if err = applySettings(reflect.ValueOf(&server).Elem(), settings); err != nil {
+			return config, errors.New(path + ": " + err.Error())
+		}
+		config.Servers = append(config.Servers, server)
+	}
+
+	return config, applyEnv(&config)
+}
+
+//Settings of the cluster given in environment
+func applyEnv(config *ClusterConfig) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(name))
+		if !ok || v.Field(i).Kind() == reflect.Slice {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return errors.New(ENV_PREFIX + strings.ToUpper(name) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func applySettings(v reflect.Value, settings []setting) error {
+	for _, s := range settings {
+		field := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, s.name) })
+		if !field.IsValid() || field.Kind() == reflect.Slice {
+			return errors.New("Unknown setting " + s.name + " at line " + strconv.Itoa(s.line))
+		}
+		if err := setField(field, s.value); err != nil {
+			return errors.New(s.name + " at line " + strconv.Itoa(s.line) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+//Set field from its value as text
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not true or false")
+		}
+		field.SetBool(b)
+	default:
+		return errors.New("can't be set")
+	}
+	return nil
+}
+
+//Line without comment and surrounding space
+func stripComment(line string) string {
+	quote := rune(0)
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+//Value without quotes. Escapes like \" and \\ are understood in double
+// quotes, and ” stands for ' in single quotes, as in YAML
+func unquote(value string, line int) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return value, nil
+	}
+	if len(value) < 2 || value[len(value)-1] != value[0] {
+		return "", errors.New("Bad string " + value + " at line " + strconv.Itoa(line))
+	}
+	if value[0] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", errors.New("Bad string " + value + " at line " + strconv.Itoa(line))
+	}
+	return unquoted, nil
+}
+
+//name: value, where value is empty for a list to follow
+//The colon is followed by space, so values can have colons (eg: ::1)
+func yamlSetting(text string, line int) (setting, error) {
+	i := -1
+	for j := 0; j < len(text) && i < 0; j++ {
+		if text[j] == ':' && (j+1 == len(text) || text[j+1] == ' ' || text[j+1] == '\t') {
+			i = j
+		}
+	}
+	if i <= 0 {
+		return setting{}, errors.New("Expected name: value at line " + strconv.Itoa(line))
+	}
+	value, err := unquote(text[i+1:], line)
+	if err != nil {
+		return setting{}, err
+	}
+	return setting{strings.TrimSpace(text[:i]), value, line}, nil
+}
+
+func parseYAML(data string) ([]setting, [][]setting, error) {
+	var cluster []setting
+	var servers [][]setting
+	inServers := false
+
+	for n, raw := range strings.Split(data, "\n") {
+		line := n + 1
+		text := stripComment(raw)
+		if text == "" || text == "---" {
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+		item := inServers && strings.HasPrefix(text, "- ")
+
+		switch {
+		case item && strings.HasPrefix(text, "- {") && strings.HasSuffix(text, "}"):
+			var server []setting
+			for _, part := range splitOutsideQuotes(text[3 : len(text)-1]) {
+				s, err := yamlSetting(strings.TrimSpace(part), line)
+				if err != nil {
+					return nil, nil, err
+				}
+				server = append(server, s)
+			}
+			servers = append(servers, server)
+
+		case item:
+			s, err := yamlSetting(strings.TrimSpace(text[2:]), line)
+			if err != nil {
+				return nil, nil, err
+			}
+			servers = append(servers, []setting{s})
+
+		case indented && inServers && len(servers) > 0:
+			//More settings of the last server
+			s, err := yamlSetting(text, line)
+			if err != nil {
+				return nil, nil, err
+			}
+			servers[len(servers)-1] = append(servers[len(servers)-1], s)
+
+		case indented:
+			return nil, nil, errors.New("Unexpected indent at line " + strconv.Itoa(line))
+
+		default:
+			s, err := yamlSetting(text, line)
+			if err != nil {
+				return nil, nil, err
+			}
+			inServers = strings.EqualFold(s.name, "Servers") && s.value == ""
+			if !inServers {
+				cluster = append(cluster, s)
+			}
+		}
+	}
+	return cluster, servers, nil
+}
+
+//Parts of text between commas which are not in quotes
+func splitOutsideQuotes(text string) []string {
+	var parts []string
+	quote := rune(0)
+	escaped := false
+	start := 0
+	for i, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+func parseTOML(data string) ([]setting, [][]setting, error) {
+	var cluster []setting
+	var servers [][]setting
+
+	for n, raw := range strings.Split(data, "\n") {
+		line := n + 1
+		text := stripComment(raw)
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if strings.ReplaceAll(text, " ", "") != "[[Servers]]" {
+				return nil, nil, errors.New("Unknown table " + text + " at line " + strconv.Itoa(line))
+			}
+			servers = append(servers, []setting{})
+			continue
+		}
+
+		i := strings.Index(text, "=")
+		if i <= 0 {
+			return nil, nil, errors.New("Expected name = value at line " + strconv.Itoa(line))
+		}
+		value, err := unquote(text[i+1:], line)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := setting{strings.TrimSpace(text[:i]), value, line}
+		if len(servers) > 0 {
+			servers[len(servers)-1] = append(servers[len(servers)-1], s)
+		} else {
+			cluster = append(cluster, s)
+		}
+	}
+	return cluster, servers, nil
+}
@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Config of a file with name and data
+func loadTestConfig(t *testing.T, name, data string) (ClusterConfig, error) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+const testYAML = `# cluster
+Path: data
+MaxMemory: 1000   # bytes
+ForwardToLeader: true
+Servers:
+  - Id: 0
+    Hostname: "host#0"
+    ClientPort: 9000
+    LogPort: 9100
+  - {Id: 1, Hostname: '::1', ClientPort: 9001, LogPort: 9101}
+`
+
+const testTOML = `Path = "data"
+MaxMemory = 1000 # bytes
+ForwardToLeader = true
+
+[[Servers]]
+Id = 0
+Hostname = "host#0"
+ClientPort = 9000
+LogPort = 9100
+
+[[ Servers ]]
+Id = 1
+Hostname = '::1'
+ClientPort = 9001
+LogPort = 9101
+`
+
+const testJSON = `{"Path": "data", "MaxMemory": 1000, "ForwardToLeader": true, "Servers": [
+	{"Id": 0, "Hostname": "host#0", "ClientPort": 9000, "LogPort": 9100},
+	{"Id": 1, "Hostname": "::1", "ClientPort": 9001, "LogPort": 9101}]}`
+
+func TestLoadConfig(t *testing.T) {
+	for name, data := range map[string]string{"c.yaml": testYAML, "c.yml": testYAML, "c.toml": testTOML, "c.json": testJSON} {
+		config, err := loadTestConfig(t, name, data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Path != "data" || config.MaxMemory != 1000 || !config.ForwardToLeader {
+			t.Errorf("%s: wrong settings %+v", name, config)
+		}
+		if len(config.Servers) != 2 {
+			t.Errorf("%s: got %d servers, want 2", name, len(config.Servers))
+			continue
+		}
+		if s := config.Servers[0]; s.Id != 0 || s.Hostname != "host#0" || s.ClientPort != 9000 || s.LogPort != 9100 {
+			t.Errorf("%s: wrong server 0 %+v", name, s)
+		}
+		if s := config.Servers[1]; s.Id != 1 || s.Hostname != "::1" || s.ClientPort != 9001 || s.LogPort != 9101 {
+			t.Errorf("%s: wrong server 1 %+v", name, s)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"c.yaml", "Unknown: 1\n", "Unknown setting"},
+		{"c.yaml", "MaxMemory: lots\n", "not a number"},
+		{"c.yaml", "ForwardToLeader: maybe\n", "not true or false"},
+		{"c.yaml", "Path data\n", "Expected name: value at line 1"},
+		{"c.yaml", "Path: data\n  Id: 0\n", "Unexpected indent at line 2"},
+		{"c.yaml", "Servers:\n  - Port: 1\n", "Unknown setting Port"},
+		{"c.toml", "[Servers]\n", "Unknown table"},
+		{"c.toml", "Path\n", "Expected name = value at line 1"},
+		{"c.toml", "Path = \"a\\qb\"\n", "Bad string \"a\\qb\" at line 1"},
+		{"c.yaml", "Servers:\n  - {Id: \"0\\\", Hostname: h}\n", "Bad string"},
+		{"c.json", "{", "Wrong format"},
+	}
+
+	for _, test := range tests {
+		_, err := loadTestConfig(t, test.name, test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s %q: got %v, want %q", test.name, test.data, err, test.want)
+		}
+	}
+}
+
+func TestLoadConfigEscapes(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"c.toml", `Path = "C:\\data \"x\" # y" # comment`, `C:\data "x" # y`},
+		{"c.toml", `Path = 'C:\data'`, `C:\data`},
+		{"c.yaml", `Path: "a\tb" # comment`, "a\tb"},
+		{"c.yaml", `Path: 'it''s'`, "it's"},
+		{"c.yaml", `Path: C:\data`, `C:\data`},
+	}
+
+	for _, test := range tests {
+		config, err := loadTestConfig(t, test.name, test.data+"\n")
+		if err != nil || config.Path != test.want {
+			t.Errorf("%s %s: got %q %v, want %q", test.name, test.data, config.Path, err, test.want)
+		}
+	}
+
+	//Escaped quote doesn't end the string, so the comma is in it
+	config, err := loadTestConfig(t, "c.yaml", "Servers:\n  - {Id: 0, Hostname: \"a\\\",b\"}\n")
+	if err != nil || len(config.Servers) != 1 || config.Servers[0].Hostname != `a",b` {
+		t.Errorf("got %+v %v", config.Servers, err)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	os.Setenv("KVSTORE_MAXMEMORY", "5000")
+	os.Setenv("KVSTORE_EVICTIONPOLICY", "lru")
+	defer os.Unsetenv("KVSTORE_MAXMEMORY")
+	defer os.Unsetenv("KVSTORE_EVICTIONPOLICY")
+
+	config, err := loadTestConfig(t, "c.yaml", testYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxMemory != 5000 || config.EvictionPolicy != "lru" {
+		t.Errorf("environment not applied: %d %q", config.MaxMemory, config.EvictionPolicy)
+	}
+
+	os.Setenv("KVSTORE_MAXMEMORY", "lots")
+	if _, err := loadTestConfig(t, "c.yaml", testYAML); err == nil {
+		t.Error("bad environment value accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *ClusterConfig {
+		return &ClusterConfig{Servers: testServers()}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	tests := []struct {
+		change func(*ClusterConfig)
+		want   string
+	}{
+		{func(c *ClusterConfig) { c.Servers = nil }, "No servers"},
+		{func(c *ClusterConfig) { c.Servers[2].Id = 1 }, "Server id 1 is used twice"},
+		{func(c *ClusterConfig) { c.Servers[2].Id = 3 }, "Server id 3 is not between 0 and 2"},
+		{func(c *ClusterConfig) { c.Servers[0].Id = -1 }, "Server id -1 is not between 0 and 2"},
+		{func(c *ClusterConfig) { c.Servers[1].LogPort = 0 }, "needs ClientPort and LogPort"},
+		{func(c *ClusterConfig) { c.Servers[1].RespPort = 9000 }, "Address localhost:9000 is used by servers 0 and 1"},
+		{func(c *ClusterConfig) { c.Servers[1].LogBind = "localhost:9100" }, "Address localhost:9100 is used by servers 0 and 1"},
+		{func(c *ClusterConfig) { c.Servers[0].ClientBind, c.Servers[1].LogBind = ":7000", ":7000" }, "Address :7000 is used by servers 0 and 1"},
+		{func(c *ClusterConfig) {
+			c.Servers[0].ClientBind, c.Servers[0].RespPort, c.Servers[1].LogBind = "10.0.0.1:7000", 7001, "10.0.0.1:7001"
+		}, "Address 10.0.0.1:7001 is used by servers 0 and 1"},
+		{func(c *ClusterConfig) { c.Servers[2].ClientBind = "7000" }, "Server 2 has bad bind address 7000"},
+		{func(c *ClusterConfig) { c.ClientTLS = true }, "ClientTLS needs CAFile"},
+		{func(c *ClusterConfig) { c.CAFile = "ca.pem" }, "needs CertFile and KeyFile"},
+		{func(c *ClusterConfig) { c.ElectionTimeoutMin, c.ElectionTimeoutMax = 1500, 1400 }, "ElectionTimeoutMax is less than ElectionTimeoutMin"},
+		{func(c *ClusterConfig) { c.HeartbeatInterval = 1000 }, "HeartbeatInterval must be less than ElectionTimeoutMin"},
+		{func(c *ClusterConfig) { c.RPCTimeout = 800 }, "RPCTimeout is more than HeartbeatInterval"},
+	}
+
+	for i, test := range tests {
+		config := valid()
+		test.change(config)
+		err := config.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("case %d: got %v, want %q", i, err, test.want)
+		}
+	}
+}
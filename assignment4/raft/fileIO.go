@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 )
@@ -32,10 +34,16 @@ func (raft *Raft) StateToBytes() []byte {
 		log.Println(err)
 	}
 
+	//Write cluster id
+	err = enc.Encode(raft.ClusterID)
+	if err != nil {
+		log.Println(err)
+	}
+
 	return w.Bytes()
 }
 
-func (raft *Raft) BytesToState(b []byte) (uint64, int, []LogItem) {
+func (raft *Raft) BytesToState(b []byte) (uint64, int, []LogItem, string) {
 
 	//Initialize decoder
 	r := bytes.Buffer{}
@@ -63,7 +71,14 @@ func (raft *Raft) BytesToState(b []byte) (uint64, int, []LogItem) {
 		log.Println(err)
 	}
 
-	return uint64(term), votedFor, logArray
+	//Read cluster id, not there in state of older versions
+	var clusterID string
+	err = dec.Decode(&clusterID)
+	if err != nil && err != io.EOF {
+		log.Println(err)
+	}
+
+	return uint64(term), votedFor, logArray, clusterID
 }
 
 func (raft *Raft) WriteStateToFile(filePath string) error {
@@ -96,6 +111,23 @@ func (raft *Raft) WriteStateToFile(filePath string) error {
 	return nil
 }
 
+//Write state and wait till it is on disk
+func (raft *Raft) SyncStateToFile(filePath string) error {
+	if err := raft.WriteStateToFile(filePath); err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%s_S%d.state", filePath, raft.ServerID)
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0666)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
 func (raft *Raft) FileExist(filePath string) bool {
 	fileName := fmt.Sprintf("%s_S%d.state", filePath, raft.ServerID)
 	file, err := os.OpenFile(fileName, os.O_RDONLY, 0666)
@@ -126,26 +158,24 @@ func (raft *Raft) ReadStateFromFile(filePath string) error {
 	}
 
 	//Read bytes from file
-	data := make([]byte, 1024)
-	n, err := file.Read(data)
+	data, err := ioutil.ReadAll(file)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	data = data[:n] //Trim data
-
 	//Decode data
-	Term, VotedFor, Log := raft.BytesToState(data)
+	Term, VotedFor, Log, ClusterID := raft.BytesToState(data)
 
 	//Restore persistant raft state
 	raft.Lock.Lock()
 	raft.Term = Term
 	raft.VotedFor = VotedFor
 	raft.Log = Log
+	raft.ClusterID = ClusterID
 	raft.Lock.Unlock()
 
-	log.Println("Restored state: Term:", Term, "Voted for:", VotedFor /*, "Log:", Log*/)
+	log.Println("Restored state: Term:", Term, "Voted for:", VotedFor, "Cluster:", ClusterID /*, "Log:", Log*/)
 
 	return nil
 }
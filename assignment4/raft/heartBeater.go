@@ -11,13 +11,16 @@ func (raft *Raft) sendHeartBeat(server ServerConfig, ackChannel chan bool) {
 		//Followers log needs to be filled up
 		nextIndex := raft.NextIndex[server.Id]
 		logSlice = raft.Log[nextIndex:]
+		if maxBatchEntries > 0 && len(logSlice) > maxBatchEntries {
+			logSlice = logSlice[:maxBatchEntries] //Rest in next rounds
+		}
 	}
 
 	prevLogIndex := raft.NextIndex[server.Id] - 1
 	prevLogTerm := raft.Log[prevLogIndex].Term
 
 	args := AppendRPCArgs{raft.Term, raft.LeaderID,
-		prevLogIndex, prevLogTerm, logSlice, uint64(raft.CommitIndex)} //Send slice with new entires
+		prevLogIndex, prevLogTerm, logSlice, uint64(raft.CommitIndex), raft.clusterID()} //Send slice with new entires
 
 	var reply AppendRPCResults                         //reply from RPC
 	err := raft.appendEntiresRPC(server, args, &reply) //Make RPC
@@ -36,6 +39,7 @@ func (raft *Raft) sendHeartBeat(server ServerConfig, ackChannel chan bool) {
 		raft.State = Follower
 		raft.Term = reply.Term
 		raft.VotedFor = -1
+		raft.LeaderID = -1
 
 		ackChannel <- false //Ack for heartBeat()
 		raft.Lock.Unlock()
@@ -43,11 +47,11 @@ func (raft *Raft) sendHeartBeat(server ServerConfig, ackChannel chan bool) {
 	}
 
 	if reply.Success {
-		lastIndex := len(raft.Log) - 1
-		lastLsn := raft.Log[lastIndex].Lsn()
-		//Update nextIndex and matchIndex
-		raft.NextIndex[server.Id] = lastLsn + 1
-		raft.MatchIndex[server.Id] = lastLsn + 1
+		//Update nextIndex and matchIndex upto what was sent, since
+		//more may have been appended meanwhile or left for next batch
+		sent := prevLogIndex + Lsn(len(logSlice))
+		raft.NextIndex[server.Id] = sent + 1
+		raft.MatchIndex[server.Id] = sent
 	} else {
 		//Log inconsistency
 		//Decrement nextIndex and retry
@@ -85,27 +89,36 @@ func (raft *Raft) heartBeat() {
 		<-ackChannel
 	}
 
-	//If majority of servers are with matching log , commit till that point
+	//Latest entry of this term which majority of servers have. It and
+	//all entries before it, of any term, are committed
+	commitTo := raft.CommitIndex
 	for i := raft.CommitIndex + 1; i <= uint64(raft.LastLsn()); i++ {
+		if raft.Log[i].Term != raft.Term {
+			continue
+		}
 		votes := 1 //Self vote as we dont maintain our own match index as leader
 		for j := 0; j < nServers; j++ {
-			if uint64(raft.MatchIndex[j]) >= i && raft.Log[i].Term == raft.Term {
+			if uint64(raft.MatchIndex[j]) >= i {
 				votes++
 			}
 		}
 
 		if votes > nServers/2 {
-			//Got majority for that entry, so commit
-			raft.kvChan <- raft.Log[i]
+			commitTo = i
+		}
+	}
 
-			//Update status as commited
-			raft.Lock.Lock()
-			raft.Log[i].COMMITTED = true
-			raft.Lock.Unlock()
+	for i := raft.CommitIndex + 1; i <= commitTo; i++ {
+		raft.kvChan <- raft.Log[i]
 
-			//Update commit index
-			raft.CommitIndex = i
-		}
+		//Update status as commited
+		raft.Lock.Lock()
+		raft.Log[i].COMMITTED = true
+		raft.Lock.Unlock()
+
+		//Update commit index
+		raft.CommitIndex = i
+		raft.LastApplied = i
 	}
 
 }
@@ -1,27 +1,47 @@
 package raft
 
 import (
-	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 type Lsn uint64      //Log sequence number, unique for all time.
 type ErrRedirect int // Implements Error interface.
 
+//Returned by Append when there is no leader (eg: election going on)
+var ErrNoLeader = errors.New("No leader elected")
+
 var raft Raft //Raft object
 
 const FILENAME = "saved"
 
+//Log state changes as they happen, for debugging
+var LogStates = true
+
+const LOST_BUFFER = 16 //Notifications of lost entries kept if kvstore is slow
+
 type LogEntry interface {
 	Lsn() Lsn
 	Data() Command
 	Committed() bool
+	Kind() EntryKind
 }
 
+//What a log entry is for. Only command entries carry a client command
+type EntryKind int
+
+const (
+	CommandEntry EntryKind = iota //Client command, applied by kvstore
+	NoOpEntry                     //Appended by a new leader, so that entries of earlier terms commit with it
+	ConfigEntry                   //Change of cluster config. Not made yet, servers come from config file
+)
+
 //A command from client
 type Command struct {
 	Cmd        string
@@ -30,6 +50,55 @@ type Command struct {
 	Length     int64
 	Version    int64
 	Value      string
+	Delta      int64 //Amount to add for incr
+
+	//Counter: missing key is taken as Initial, and if the result is
+	//not within Min and Max, Overflow tells to fail, clamp or wrap
+	Initial  int64
+	Min, Max int64
+	Overflow string
+
+	//Session of client, 0 if none. Command with same ClientID and
+	//Seq is applied only once even if appended again
+	ClientID, Seq int64
+
+	//Leader's clock (unix nanoseconds) when appended, so that all
+	//replicas see the same time for this command
+	Timestamp int64
+
+	//Transaction: if all Compares hold, Success commands are
+	//applied, otherwise Failure commands. All in one go
+	Compares         []Compare
+	Success, Failure []Command
+
+	//Range query of keys from Key upto RangeEnd (not included, "" for
+	//no end), at most Limit of them
+	RangeEnd  string
+	Limit     int64
+	KeysOnly  bool //Only names of keys
+	CountOnly bool //Only number of keys
+
+	//Lease a key is attached to, or lease of a lease command
+	Lease int64
+
+	//Namespace keys of command are in, "" for the default one
+	Namespace string
+
+	//Quotas of a namespace command, 0 for no limit: number of keys,
+	//bytes of keys and values, and requests per second
+	MaxKeys, MaxBytes, MaxRate int64
+
+	//User who sent command, set by server once client authenticated.
+	//Role and Permission are for user and role commands
+	User, Role, Permission string
+}
+
+//A condition on a key checked by a transaction
+type Compare struct {
+	Target  string //version, exists or missing
+	Key     string
+	Op      string //=, !=, < or > for version
+	Version int64
 }
 
 type LogItem struct {
@@ -37,6 +106,7 @@ type LogItem struct {
 	DATA      Command
 	COMMITTED bool
 	Term      uint64
+	KIND      EntryKind //CommandEntry in logs saved before kinds
 }
 
 func (l LogItem) Lsn() Lsn {
@@ -48,11 +118,14 @@ func (l LogItem) Data() Command {
 func (l LogItem) Committed() bool {
 	return l.COMMITTED
 }
+func (l LogItem) Kind() EntryKind {
+	return l.KIND
+}
 
 type SharedLog interface {
 	// Each data item is wrapped in a LogEntry with a unique
-	// lsn. The only error that will be returned is ErrRedirect,
-	// to indicate the server id of the leader. Append initiates
+	// lsn. The only errors that will be returned are ErrRedirect,
+	// to indicate the server id of the leader, and ErrNoLeader. Append initiates
 	// a local disk write and a broadcast to the other replicas,
 	// and returns without waiting for the result.
 	Append(data Command) (LogEntry, error)
@@ -62,14 +135,96 @@ type SharedLog interface {
 // Raft setup
 type ServerConfig struct {
 	Id         int    //Id of server. Must be unique
-	Hostname   string //name or ip of host
+	Hostname   string //name or ip of host, at which clients and peers reach it
 	ClientPort int    //port at which server listens to client messages.
 	LogPort    int    // tcp port for inter-replica protocol messages.
+	RespPort   int    //port for redis protocol clients, 0 to disable
+	HttpPort   int    //port for HTTP/JSON clients, 0 to disable
+	CertFile   string //TLS certificate, for server-<id> and hostname
+	KeyFile    string //Private key of certificate
+
+	//Addresses (host:port) to listen on for clients and peers, if other
+	//than ClientPort and LogPort on all interfaces. Eg: when Hostname is
+	//of a NAT, or to use only one interface
+	ClientBind string
+	LogBind    string
+}
+
+//Address at which clients reach the server
+func (s ServerConfig) ClientAddress() string {
+	return s.Address(s.ClientPort)
+}
+
+//Address at which peers reach the server
+func (s ServerConfig) LogAddress() string {
+	return s.Address(s.LogPort)
+}
+
+//Address at which port of the server is reached
+func (s ServerConfig) Address(port int) string {
+	return net.JoinHostPort(s.Hostname, strconv.Itoa(port))
+}
+
+func (s ServerConfig) ClientListenAddress() string {
+	if s.ClientBind != "" {
+		return s.ClientBind
+	}
+	return s.ListenAddress(s.ClientPort)
+}
+
+func (s ServerConfig) LogListenAddress() string {
+	if s.LogBind != "" {
+		return s.LogBind
+	}
+	return net.JoinHostPort("", strconv.Itoa(s.LogPort))
+}
+
+//Address to listen on for other client ports (RESP and HTTP), on the
+//host of ClientBind
+func (s ServerConfig) ListenAddress(port int) string {
+	host := ""
+	if s.ClientBind != "" {
+		host, _, _ = net.SplitHostPort(s.ClientBind)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
 type ClusterConfig struct {
-	Path    string         // Directory for persistent log
-	Servers []ServerConfig // All servers in this cluster
+	Path         string         // Directory for persistent log, current one if not given
+	Servers      []ServerConfig // All servers in this cluster
+	MaxValueSize int64          //Largest value in bytes a client can store, 0 for default
+
+	//Followers send client commands to leader instead of REDIRECT
+	ForwardToLeader bool
+
+	//Seconds a client session can stay idle before it expires, 0 for default
+	SessionTimeout int64
+
+	//Milliseconds a client command can wait to be committed, 0 for default
+	RequestTimeout int64
+
+	//Bytes of keys and values the kvstore can hold, 0 for no limit, and
+	//what to do when it is full: lru, lfu, ttl or reject (default)
+	MaxMemory      int64
+	EvictionPolicy string
+
+	//Milliseconds a follower waits for the leader before an election,
+	//picked at random between min and max, between heartbeats of the
+	//leader and for an RPC to be answered, 0 for defaults (see timing.go)
+	ElectionTimeoutMin, ElectionTimeoutMax int64
+	HeartbeatInterval                      int64
+	RPCTimeout                             int64
+
+	//Log entries sent in one append to a follower, 0 for no limit
+	MaxBatchEntries int64
+
+	//Id of the cluster, made by its first leader if not given (see clusterID.go)
+	ClusterID string
+
+	//CA which signs certificates of servers. When given, raft peers
+	//talk mutual TLS, and clients connect with TLS if ClientTLS is set
+	CAFile    string
+	ClientTLS bool
 }
 
 var ClusterInfo ClusterConfig //Struct with all raft configs
@@ -81,10 +236,15 @@ var raftMapLock sync.Mutex    //For accessing global raft map
 type Raft struct {
 	ServerID, LeaderID  int
 	ClientPort, LogPort int
+	config              ServerConfig //Of this server
+	stateFile           string       //Persistent state, without server suffix
 	State               string
 	Lock                sync.Mutex
 	kvChan              chan LogEntry //Commit channel to kvStore
 	eventCh             chan interface{}
+	lostCh              chan Lsn      //Entries from this lsn may never commit
+	done                chan struct{} //Closed when shut down
+	listener            net.Listener  //Of RPCs, closed when shut down
 
 	//Raft specific
 	Log                      []LogItem
@@ -92,7 +252,8 @@ type Raft struct {
 	CommitIndex, LastApplied uint64
 	NextIndex                []Lsn
 	MatchIndex               []Lsn
-	VotedFor                 int //Voted for whom in this term
+	VotedFor                 int    //Voted for whom in this term
+	ClusterID                string //Cluster this server is in, fixed at start
 }
 
 // Creates a raft object. This implements the SharedLog interface.
@@ -102,16 +263,33 @@ type Raft struct {
 func NewRaft(config *ClusterConfig, thisServerId int, commitCh chan LogEntry) (*Raft, error) {
 
 	raft = Raft{} // empty raft object
+	if err := setTiming(config); err != nil {
+		return nil, err
+	}
+	if err := loadCertificates(config, thisServerId); err != nil {
+		return nil, err
+	}
+
 	for _, server := range config.Servers {
 
 		if server.Id == thisServerId { //Config for this server
 			raft.ServerID = thisServerId
 			raft.ClientPort = server.ClientPort
 			raft.LogPort = server.LogPort
+			raft.config = server
 			break
 		}
 	}
 
+	dir := config.Path
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.New("Couldn't make data directory " + dir)
+	}
+	raft.stateFile = filepath.Join(dir, FILENAME)
+
 	raft.Log = append(raft.Log, LogItem{}) //Dummy item to make log start from index 1
 
 	//Log indices
@@ -122,24 +300,30 @@ func NewRaft(config *ClusterConfig, thisServerId int, commitCh chan LogEntry) (*
 	raft.State = Follower
 	raft.Term = 0
 	raft.VotedFor = -1
+	raft.LeaderID = -1 //Not known till first heartbeat
 
 	raft.kvChan = commitCh                          //Store commit channel to KV-Store
 	raft.eventCh = make(chan interface{}, nServers) //Event channel for state loop
+	raft.lostCh = make(chan Lsn, LOST_BUFFER)
+	raft.done = make(chan struct{})
 
 	//Restore state if state file exists
-	if raft.FileExist(FILENAME) {
+	if raft.FileExist(raft.stateFile) {
 		//Server crashed last time
-		raft.ReadStateFromFile(FILENAME)
+		raft.ReadStateFromFile(raft.stateFile)
+	}
+	if err := raft.checkConfigCluster(config); err != nil {
+		return nil, err
+	}
 
-		//Add changes to state machine
-		for i := 1; i < len(raft.Log); i++ {
-			if raft.Log[i].Committed() {
-				//Add if already commited
-				raft.kvChan <- raft.Log[i]
+	//Add restored changes to state machine
+	for i := 1; i < len(raft.Log); i++ {
+		if raft.Log[i].Committed() {
+			//Add if already commited
+			raft.kvChan <- raft.Log[i]
 
-				raft.LastApplied = uint64(i)
-				raft.CommitIndex = uint64(i)
-			}
+			raft.LastApplied = uint64(i)
+			raft.CommitIndex = uint64(i)
 		}
 	}
 
@@ -155,26 +339,104 @@ func NewRaft(config *ClusterConfig, thisServerId int, commitCh chan LogEntry) (*
 	return &raft, nil
 }
 
+//Read config.json of current working dir into ClusterInfo
 func ReadConfig() error {
-	//Get config.json file current working dir
-	filePath := "config.json"
-	file, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return errors.New("Couldn't open config file from :" + filePath)
+	return ReadConfigFile("config.json")
+}
+
+//Problems in config which would keep the cluster from working: servers
+//with the same id or address, ids not from 0 to number of servers - 1,
+//bad timing or TLS settings
+func (config *ClusterConfig) Validate() error {
+	var problems []string
+	if len(config.Servers) == 0 {
+		problems = append(problems, "No servers")
 	}
 
-	err = json.Unmarshal(file, &ClusterInfo)
-	if err != nil {
-		return errors.New("Wrong format of config file")
+	ids := make(map[int]bool)
+	used := make(map[string]int) //Address to id of server using it
+	for _, server := range config.Servers {
+		if ids[server.Id] {
+			problems = append(problems, "Server id "+strconv.Itoa(server.Id)+" is used twice")
+		}
+		ids[server.Id] = true
+		if server.Id < 0 || server.Id >= len(config.Servers) {
+			//Ids index per server state of leader
+			problems = append(problems, "Server id "+strconv.Itoa(server.Id)+" is not between 0 and "+strconv.Itoa(len(config.Servers)-1))
+		}
+
+		if server.ClientPort <= 0 || server.LogPort <= 0 {
+			problems = append(problems, "Server "+strconv.Itoa(server.Id)+" needs ClientPort and LogPort")
+		}
+		if config.CAFile != "" && (server.CertFile == "" || server.KeyFile == "") {
+			problems = append(problems, "Server "+strconv.Itoa(server.Id)+" needs CertFile and KeyFile for TLS")
+		}
+
+		for _, port := range []int{server.ClientPort, server.LogPort, server.RespPort, server.HttpPort} {
+			if port <= 0 {
+				continue
+			}
+			address := server.Address(port)
+			if id, ok := used[address]; ok {
+				problems = append(problems, "Address "+address+" is used by servers "+strconv.Itoa(id)+" and "+strconv.Itoa(server.Id))
+			}
+			used[address] = server.Id
+		}
+
+		//Addresses listened on which differ from the ones above
+		var binds []string
+		if server.ClientBind != "" {
+			binds = append(binds, server.ClientBind)
+			for _, port := range []int{server.RespPort, server.HttpPort} {
+				if port > 0 {
+					binds = append(binds, server.ListenAddress(port))
+				}
+			}
+		}
+		if server.LogBind != "" {
+			binds = append(binds, server.LogBind)
+		}
+		for _, address := range binds {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				problems = append(problems, "Server "+strconv.Itoa(server.Id)+" has bad bind address "+address)
+				continue
+			}
+			if id, ok := used[address]; ok {
+				problems = append(problems, "Address "+address+" is used by servers "+strconv.Itoa(id)+" and "+strconv.Itoa(server.Id))
+			}
+			used[address] = server.Id
+		}
 	}
 
-	if nServers == 0 {
-		nServers = len(ClusterInfo.Servers)
+	if err := checkTiming(config); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if config.ClientTLS && config.CAFile == "" {
+		problems = append(problems, "ClientTLS needs CAFile")
 	}
 
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
 	return nil
 }
 
+//Lsn from which appended entries may never be committed, sent when this
+//server stops being the leader or removes entries from its log.
+//Clients waiting for those entries can be told instead of waiting forever
+func (raft *Raft) LostEntries() <-chan Lsn {
+	return raft.lostCh
+}
+
+//Tell kvstore entries from lsn may be lost. Never blocks raft
+func (raft *Raft) notifyLost(lsn Lsn) {
+	select {
+	case raft.lostCh <- lsn:
+	default:
+		log.Print("Lost entries notification dropped")
+	}
+}
+
 func (raft *Raft) LastLsn() Lsn {
 
 	raft.Lock.Lock()
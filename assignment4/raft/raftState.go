@@ -12,11 +12,6 @@ const (
 	Candidate = "Candidate"
 )
 
-const (
-	followerTimeout  = /*3 * time.Second // */ 1000 * time.Millisecond
-	heartbeatTimeout = /*2 * time.Second // */ 750 * time.Millisecond
-)
-
 type ClientAppend struct {
 	command    Command
 	responseCh chan LogEntry
@@ -37,7 +32,8 @@ type Timeout struct {
 
 func (raft *Raft) loop() {
 
-	rand.Seed(time.Now().Unix())
+	//Servers started together must not time out together
+	rand.Seed(time.Now().UnixNano() + int64(raft.ServerID))
 
 	for {
 		switch raft.State {
@@ -51,10 +47,17 @@ func (raft *Raft) loop() {
 		case Leader:
 			raft.Leader()
 
+			//Not leader anymore, uncommitted entries may never commit
+			raft.notifyLost(Lsn(raft.CommitIndex + 1))
+
 		default:
 			raft.LogState("Unknown state")
 			break
 		}
+
+		if raft.State == Stopped {
+			return
+		}
 	}
 }
 
@@ -64,8 +67,7 @@ func (raft *Raft) Follower() {
 	timeoutFunc := func() {
 		raft.eventCh <- Timeout{}
 	}
-	r := time.Duration(rand.Intn(100)) * time.Millisecond
-	timer := time.AfterFunc(followerTimeout+r, timeoutFunc) //debug: 3 seconds + some millis
+	timer := time.AfterFunc(electionTimeout(), timeoutFunc)
 
 	for {
 
@@ -78,7 +80,7 @@ func (raft *Raft) Follower() {
 
 			//Sent false to make it redirect
 			ev := event.(ClientAppend)
-			logItem := LogItem{0, ev.command, false, raft.Term}
+			logItem := LogItem{0, ev.command, false, raft.Term, CommandEntry}
 			ev.responseCh <- logItem
 
 		case AppendRPC:
@@ -94,7 +96,7 @@ func (raft *Raft) Follower() {
 
 			if success && len(ev.args.Log) > 0 {
 				//Disk write if log was updated
-				err := raft.WriteStateToFile(FILENAME)
+				err := raft.WriteStateToFile(raft.stateFile)
 				checkError(err)
 			}
 
@@ -102,8 +104,7 @@ func (raft *Raft) Follower() {
 			reply := AppendRPCResults{raft.Term, success}
 			ev.responseCh <- reply
 
-			r := time.Duration(rand.Intn(100)) * time.Millisecond
-			timer.Reset(followerTimeout + r)
+			timer.Reset(electionTimeout())
 
 		case VoteRequest:
 			// raft.LogState("Vote request received")
@@ -115,15 +116,15 @@ func (raft *Raft) Follower() {
 			if voted {
 				raft.Term = ev.args.Term
 				raft.VotedFor = int(ev.args.CandidateID)
+				raft.LeaderID = -1 //Not known till someone wins
 				raft.LogState("Voted ")
 
 				//Disk write
-				err := raft.WriteStateToFile(FILENAME)
+				err := raft.WriteStateToFile(raft.stateFile)
 				checkError(err)
 
 				//Again wait since someone is a candidate
-				r := time.Duration(rand.Intn(100)) * time.Millisecond
-				timer.Reset(followerTimeout + r)
+				timer.Reset(electionTimeout())
 
 			} else {
 				raft.LogState("Vote request rejected")
@@ -131,6 +132,24 @@ func (raft *Raft) Follower() {
 
 			ev.responseCh <- RequestVoteResult{raft.Term, voted} //Actual vote
 
+		case TimeoutNow:
+			ev := event.(TimeoutNow)
+
+			ok := raft.shouldTimeoutNow(ev.args)
+			ev.responseCh <- TimeoutNowResult{raft.Term, ok}
+
+			if ok {
+				raft.LogState("Leadership handed over")
+				raft.State = Candidate
+				timer.Stop()
+				return
+			}
+
+		case Stop:
+			timer.Stop()
+			raft.stop(event.(Stop))
+			return
+
 		case Timeout:
 			raft.LogState("Time out received")
 			raft.State = Candidate
@@ -146,6 +165,11 @@ func (raft *Raft) Leader() {
 
 	raft.LogState("")
 
+	//First leader of a new cluster gives it an id, voters had none either
+	if raft.clusterID() == "" {
+		checkError(raft.setClusterID(newClusterID()))
+	}
+
 	//Start timer
 	timeoutFunc := func() {
 		raft.eventCh <- Timeout{}
@@ -158,6 +182,14 @@ func (raft *Raft) Leader() {
 		raft.MatchIndex[i] = 0
 	}
 
+	//Only entries of its own term are committed by counting followers,
+	//so start the term with one. Entries of earlier terms left by the
+	//old leader commit with it, without waiting for a client to write
+	noOp := LogItem{raft.LastLsn() + 1, Command{}, false, raft.Term, NoOpEntry}
+	raft.Lock.Lock()
+	raft.Log = append(raft.Log, noOp)
+	raft.Lock.Unlock()
+
 	for {
 
 		event := <-raft.eventCh
@@ -169,7 +201,7 @@ func (raft *Raft) Leader() {
 
 			ev := event.(ClientAppend)
 
-			logItem := LogItem{raft.LastLsn() + 1, ev.command, false, raft.Term}
+			logItem := LogItem{raft.LastLsn() + 1, ev.command, false, raft.Term, CommandEntry}
 			raft.Log = append(raft.Log, logItem)
 			// raft.LastLsn++
 
@@ -186,6 +218,7 @@ func (raft *Raft) Leader() {
 				raft.State = Follower
 				raft.Term = ev.args.Term
 				raft.VotedFor = -1
+				raft.LeaderID = ev.args.LeaderId
 
 				ev.responseCh <- AppendRPCResults{raft.Term, true}
 
@@ -208,10 +241,11 @@ func (raft *Raft) Leader() {
 				raft.State = Follower
 				raft.Term = ev.args.Term
 				raft.VotedFor = int(ev.args.CandidateID)
+				raft.LeaderID = -1
 				raft.LogState("Voted ")
 
 				//Disk write
-				err := raft.WriteStateToFile(FILENAME)
+				err := raft.WriteStateToFile(raft.stateFile)
 				checkError(err)
 
 			} else {
@@ -225,6 +259,15 @@ func (raft *Raft) Leader() {
 				return // Since state changed
 			}
 
+		case TimeoutNow:
+			//Only a follower can be asked to take over
+			event.(TimeoutNow).responseCh <- TimeoutNowResult{raft.Term, false}
+
+		case Stop:
+			timer.Stop()
+			raft.stop(event.(Stop))
+			return
+
 		case Timeout:
 			raft.LogState("Heartbeat time out")
 			//Send append RPCs
@@ -249,6 +292,7 @@ func (raft *Raft) Candidate() {
 	//Increment term and Request votes
 	raft.Term++
 	raft.VotedFor = -1
+	raft.LeaderID = -1 //No leader while election is going on
 
 	raft.LogState("")
 
@@ -292,9 +336,7 @@ func (raft *Raft) Candidate() {
 		raft.eventCh <- Timeout{}
 	}
 
-	timeoutDelta := int(0.2 * float32(followerTimeout)) //20% of follower timeout
-	randDelta := time.Duration(rand.Intn(timeoutDelta))
-	timer := time.AfterFunc(followerTimeout+randDelta, timeoutFunc)
+	timer := time.AfterFunc(electionTimeout(), timeoutFunc)
 
 	for {
 
@@ -312,7 +354,7 @@ func (raft *Raft) Candidate() {
 			resendEvent := func() {
 				raft.eventCh <- event
 			}
-			time.AfterFunc(followerTimeout, resendEvent)
+			time.AfterFunc(electionTimeoutMin, resendEvent)
 
 		case AppendRPC:
 			raft.LogState("AppendRPC received")
@@ -320,18 +362,23 @@ func (raft *Raft) Candidate() {
 			//Verfiy his term and respond
 			ev := event.(AppendRPC)
 
-			if ev.args.Term > raft.Term {
-				//He is a leader
+			if ev.args.Term >= raft.Term {
+				//He is a leader, elected in this term or a later one
 				//Change to follower state and resend this
 				//to event channel so that this will be
 				//handled while being a follower
 
-				raft.Term = ev.args.Term
-				raft.VotedFor = -1
+				if ev.args.Term > raft.Term {
+					raft.Term = ev.args.Term
+					raft.VotedFor = -1
+				}
 				raft.State = Follower
 
-				//Resend
-				raft.eventCh <- event
+				//Resend. From another go routine, since event
+				//channel could be full and only we read from it
+				go func() {
+					raft.eventCh <- event
+				}()
 
 				timer.Stop()
 				return //return as follower
@@ -350,10 +397,11 @@ func (raft *Raft) Candidate() {
 			if voted {
 				raft.Term = ev.args.Term
 				raft.VotedFor = int(ev.args.CandidateID)
+				raft.LeaderID = -1
 				raft.LogState("Voted ")
 
 				//Disk write
-				err := raft.WriteStateToFile(FILENAME)
+				err := raft.WriteStateToFile(raft.stateFile)
 				checkError(err)
 
 			} else {
@@ -369,6 +417,14 @@ func (raft *Raft) Candidate() {
 				return
 			}
 
+		case TimeoutNow:
+			event.(TimeoutNow).responseCh <- TimeoutNowResult{raft.Term, false}
+
+		case Stop:
+			timer.Stop()
+			raft.stop(event.(Stop))
+			return
+
 		case Timeout:
 			raft.LogState("Time out received")
 			//Stand again as candidate
@@ -391,6 +447,9 @@ func (raft *Raft) Candidate() {
 }
 
 func (raft *Raft) LogState(msg string) {
+	if !LogStates {
+		return
+	}
 
 	if raft.State == Leader {
 		//A line to distinguish rounds of new leaders in log
@@ -9,6 +9,7 @@ type RequestVoteArgs struct {
 	CandidateID  uint64
 	LastLogIndex Lsn
 	LastLogTerm  uint64
+	ClusterID    string //Of candidate
 }
 
 type RequestVoteResult struct {
@@ -54,7 +55,7 @@ func (raft *Raft) shouldIVote(args RequestVoteArgs) bool {
 func (raft *Raft) sendVoteRequest(server ServerConfig, ackChannel chan bool) {
 	//Create args and reply
 	lastLogTerm := raft.Log[raft.LastLsn()].Term
-	args := RequestVoteArgs{raft.Term, uint64(raft.ServerID), raft.LastLsn(), lastLogTerm}
+	args := RequestVoteArgs{raft.Term, uint64(raft.ServerID), raft.LastLsn(), lastLogTerm, raft.clusterID()}
 	reply := RequestVoteResult{}
 
 	//Request vote by RPC
@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
@@ -10,41 +11,100 @@ import (
 )
 
 //Actual RPC code
-type RPC struct{}
+type RPC struct {
+	peer int //Server on the other end as per its certificate, -1 without TLS
+}
 
 //RPC listening server on every server
 func (raft *Raft) RPCListener() {
-	rpcObj := new(RPC)
-	err := rpc.Register(rpcObj)
-
+	listener, err := net.Listen("tcp", raft.config.LogListenAddress())
 	if err != nil {
-		log.Print("RCP register error : " + err.Error())
+		log.Print("RCP error : " + err.Error())
 		return
 	}
+	if certs != nil {
+		listener = tls.NewListener(listener, listenTLSConfig(true))
+	}
 
-	listener, err := net.Listen("tcp", ":"+strconv.FormatInt(int64(raft.LogPort), 10))
-	if err != nil {
-		log.Print("RCP error : " + err.Error())
+	raft.Lock.Lock()
+	if raft.stopped() {
+		raft.Lock.Unlock()
+		listener.Close()
 		return
 	}
-	log.Println("RPC listner started:", raft.LogPort)
+	raft.listener = listener //Closed by shutdown
+	raft.Lock.Unlock()
+	log.Println("RPC listner started:", listener.Addr())
 
 	for {
 		if conn, err := listener.Accept(); err != nil {
+			if raft.stopped() {
+				return
+			}
 			log.Print("Accept error : " + err.Error())
 		} else {
-			go rpc.ServeConn(conn)
+			go servePeer(conn)
+		}
+	}
+}
+
+//Serve RPCs from a connection, each connection with its own RPC object
+//so that it knows the peer
+func servePeer(conn net.Conn) {
+	rpcObj := &RPC{peer: -1}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		id, err := acceptPeer(tlsConn)
+		if err != nil {
+			log.Print("Peer " + conn.RemoteAddr().String() + " refused: " + err.Error())
+			conn.Close()
+			return
 		}
+		rpcObj.peer = id
+	}
+
+	server := rpc.NewServer()
+	if err := server.Register(rpcObj); err != nil {
+		log.Print("RCP register error : " + err.Error())
+		conn.Close()
+		return
 	}
+	server.ServeConn(conn)
+}
+
+//Connect to RPC server of a peer
+func dialRPC(server ServerConfig, deadline time.Time) (*rpc.Client, error) {
+	conn, err := dialPeer(server, deadline)
+	if err != nil {
+		if _, ok := err.(net.Error); !ok && certs != nil {
+			//Not down, but refused by TLS
+			return nil, errors.New("Server " + strconv.Itoa(server.Id) + " TLS error: " + err.Error())
+		}
+		return nil, errors.New("Server " + strconv.Itoa(server.Id) + " down")
+	}
+	return rpc.NewClient(conn), nil
 }
 
 //Function being called in follower when leader issues append
 func (r *RPC) AppendEntriesRPC(args AppendRPCArgs, reply *AppendRPCResults) error {
+	if err := raft.checkCluster(args.ClusterID, args.LeaderId); err != nil {
+		return err
+	}
+	if r.peer >= 0 && args.LeaderId != r.peer {
+		return errors.New("Server " + strconv.Itoa(r.peer) + " can't append as " + strconv.Itoa(args.LeaderId))
+	}
 
 	//Send to event channel of this server
 	responseCh := make(chan AppendRPCResults, 5)
-	raft.eventCh <- AppendRPC{args, responseCh}
-	*reply = <-responseCh
+	select {
+	case raft.eventCh <- AppendRPC{args, responseCh}:
+	case <-raft.done:
+		return ErrShutdown
+	}
+	select {
+	case *reply = <-responseCh:
+	case <-raft.done:
+		return ErrShutdown
+	}
 
 	return nil
 }
@@ -52,18 +112,20 @@ func (r *RPC) AppendEntriesRPC(args AppendRPCArgs, reply *AppendRPCResults) erro
 //Function called by leader
 func (raft *Raft) appendEntiresRPC(server ServerConfig, args AppendRPCArgs, reply *AppendRPCResults) error {
 
-	client, err := rpc.Dial("tcp", ":"+strconv.Itoa(server.LogPort))
+	deadline := time.Now().Add(rpcTimeout)
+	client, err := dialRPC(server, deadline)
 	if err != nil {
 		// log.Print("AppendRPC Dial error on port:" + strconv.Itoa(server.LogPort))
 		// log.Print("Server ", server.Id, " down")
-		return errors.New("Server " + strconv.Itoa(server.Id) + " down")
+		return err
 	}
+	defer client.Close()
 
 	// err = client.Call("RPC.AppendEntriesRPC", args, reply) //Blocking RPC
 
 	//Create a timeout timer so that we will not wait for ever
-	timerChan := make(chan bool)
-	timer := time.AfterFunc(heartbeatTimeout/2, func() { timerChan <- true })
+	timerChan := make(chan bool, 1)
+	timer := time.AfterFunc(time.Until(deadline), func() { timerChan <- true })
 
 	//Done channel for async rpc.Go()
 	done := make(chan *rpc.Call, nServers)
@@ -91,11 +153,25 @@ func (raft *Raft) appendEntiresRPC(server ServerConfig, args AppendRPCArgs, repl
 
 //Function being called in follower when candidate issues vote request
 func (r *RPC) VoteRequestRPC(args RequestVoteArgs, reply *RequestVoteResult) error {
+	if err := raft.checkCluster(args.ClusterID, int(args.CandidateID)); err != nil {
+		return err
+	}
+	if r.peer >= 0 && int(args.CandidateID) != r.peer {
+		return errors.New("Server " + strconv.Itoa(r.peer) + " can't ask votes for " + strconv.Itoa(int(args.CandidateID)))
+	}
 
 	//Send to event channel of this server
 	responseCh := make(chan RequestVoteResult, 5)
-	raft.eventCh <- VoteRequest{args, responseCh}
-	*reply = <-responseCh
+	select {
+	case raft.eventCh <- VoteRequest{args, responseCh}:
+	case <-raft.done:
+		return ErrShutdown
+	}
+	select {
+	case *reply = <-responseCh:
+	case <-raft.done:
+		return ErrShutdown
+	}
 
 	return nil
 }
@@ -103,20 +179,22 @@ func (r *RPC) VoteRequestRPC(args RequestVoteArgs, reply *RequestVoteResult) err
 //Function called by candidate
 func (raft *Raft) voteRequestRPC(server ServerConfig, args RequestVoteArgs, reply *RequestVoteResult) error {
 
-	client, err := rpc.Dial("tcp", ":"+strconv.Itoa(server.LogPort))
+	deadline := time.Now().Add(rpcTimeout)
+	client, err := dialRPC(server, deadline)
 	if err != nil {
 		// log.Print("VoteRPC Dial error on port:" + strconv.Itoa(server.LogPort))
 		// log.Print("Server ", server.Id, " down")
-		return errors.New("Server " + strconv.Itoa(server.Id) + " down")
+		return err
 	}
+	defer client.Close()
 
 	// err = client.Call("RPC.VoteRequestRPC", args, reply) //Blocking RPC
 
 	//Async RPC
 
 	//Create a timeout timer so that we will not wait for ever
-	timerChan := make(chan bool)
-	timer := time.AfterFunc(heartbeatTimeout/2, func() { timerChan <- true })
+	timerChan := make(chan bool, 1)
+	timer := time.AfterFunc(time.Until(deadline), func() { timerChan <- true })
 
 	//Done channel for async rpc.Go()
 	done := make(chan *rpc.Call, nServers)
@@ -141,3 +219,55 @@ func (raft *Raft) voteRequestRPC(server ServerConfig, args RequestVoteArgs, repl
 
 	return nil
 }
+
+//Function being called in follower when leader hands over leadership
+func (r *RPC) TimeoutNowRPC(args TimeoutNowArgs, reply *TimeoutNowResult) error {
+	if err := raft.checkCluster(args.ClusterID, args.LeaderId); err != nil {
+		return err
+	}
+	if r.peer >= 0 && args.LeaderId != r.peer {
+		return errors.New("Server " + strconv.Itoa(r.peer) + " can't hand over as " + strconv.Itoa(args.LeaderId))
+	}
+
+	//Send to event channel of this server
+	responseCh := make(chan TimeoutNowResult, 1)
+	select {
+	case raft.eventCh <- TimeoutNow{args, responseCh}:
+	case <-raft.done:
+		return ErrShutdown
+	}
+	select {
+	case *reply = <-responseCh:
+	case <-raft.done:
+		return ErrShutdown
+	}
+
+	return nil
+}
+
+//Function called by leader handing over leadership
+func (raft *Raft) timeoutNowRPC(server ServerConfig, args TimeoutNowArgs, reply *TimeoutNowResult) error {
+
+	deadline := time.Now().Add(rpcTimeout)
+	client, err := dialRPC(server, deadline)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	//Done channel for async rpc.Go()
+	done := make(chan *rpc.Call, 1)
+	client.Go("RPC.TimeoutNowRPC", args, reply, done) //Non blocking RPC
+
+	select {
+	case <-time.After(time.Until(deadline)):
+		return errors.New("Server " + strconv.Itoa(server.Id) + " down (timeout)")
+
+	case response := <-done:
+		if response.Error != nil {
+			return errors.New("RPC fail :" + response.Error.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+//Shutdown stops a server so that it can exit without harm. A leader first
+//hands over leadership: it sends appends till a follower has all of its
+//log, then tells that follower to start an election at once (TimeoutNow),
+//so the cluster has a new leader without waiting for election timeout.
+//Then the state loop stops, state is written to disk, the RPC listener is
+//closed, and RPCs and appends are refused from then on.
+
+const Stopped = "Stopped"
+
+//Time between append rounds while a follower catches up for handover
+const TRANSFER_RETRY = 50 * time.Millisecond
+
+//Returned by Append and RPCs once raft is shut down
+var ErrShutdown = errors.New("Raft is shut down")
+
+type TimeoutNowArgs struct {
+	Term      uint64
+	LeaderId  int
+	ClusterID string
+}
+
+type TimeoutNowResult struct {
+	Term    uint64
+	Success bool
+}
+
+type TimeoutNow struct {
+	args       TimeoutNowArgs
+	responseCh chan TimeoutNowResult
+}
+
+type Stop struct {
+	ctx        context.Context
+	responseCh chan error
+}
+
+//Stop raft, handing over leadership first if leader. ctx limits the
+//handover; raft is stopped and state written even if it fails
+func (raft *Raft) Shutdown(ctx context.Context) error {
+	responseCh := make(chan error, 1)
+	select {
+	case raft.eventCh <- Stop{ctx, responseCh}:
+	case <-raft.done:
+		return nil //Already stopped
+	}
+	return <-responseCh
+}
+
+//True once raft is shut down
+func (raft *Raft) stopped() bool {
+	select {
+	case <-raft.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Stop the state loop, from the state loop
+func (raft *Raft) stop(ev Stop) {
+	var err error
+	if raft.State == Leader {
+		err = raft.transferLeadership(ev.ctx)
+	}
+
+	raft.State = Stopped
+	raft.LeaderID = -1
+	close(raft.done)
+
+	raft.Lock.Lock()
+	if raft.listener != nil {
+		raft.listener.Close()
+	}
+	raft.Lock.Unlock()
+
+	if werr := raft.SyncStateToFile(raft.stateFile); werr != nil && err == nil {
+		err = werr
+	}
+	log.Print("Raft of server " + strconv.Itoa(raft.ServerID) + " shut down")
+	ev.responseCh <- err
+}
+
+//Bring a follower up to date and make it start an election
+func (raft *Raft) transferLeadership(ctx context.Context) error {
+	if len(ClusterInfo.Servers) < 2 {
+		return nil //Nobody to hand over to
+	}
+
+	target := -1
+	for {
+		raft.heartBeat()
+		if raft.State != Leader {
+			return nil //Another leader came up meanwhile
+		}
+		if target = raft.upToDateFollower(); target >= 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.New("No follower caught up to hand over leadership")
+		case <-time.After(TRANSFER_RETRY):
+		}
+	}
+
+	var server ServerConfig
+	for _, s := range ClusterInfo.Servers {
+		if s.Id == target {
+			server = s
+		}
+	}
+
+	args := TimeoutNowArgs{raft.Term, raft.ServerID, raft.clusterID()}
+	var reply TimeoutNowResult
+	if err := raft.timeoutNowRPC(server, args, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return errors.New("Server " + strconv.Itoa(target) + " refused leadership")
+	}
+
+	log.Print("Leadership handed over to server " + strconv.Itoa(target))
+	return nil
+}
+
+//A follower with all entries of leader's log, -1 if none
+func (raft *Raft) upToDateFollower() int {
+	last := raft.LastLsn()
+	raft.Lock.Lock()
+	defer raft.Lock.Unlock()
+
+	for _, server := range ClusterInfo.Servers {
+		if server.Id != raft.ServerID && raft.MatchIndex[server.Id] == last {
+			return server.Id
+		}
+	}
+	return -1
+}
+
+//Whether to start an election on leader's request. Only the current
+//leader can ask, so an old one can't disturb the cluster
+func (raft *Raft) shouldTimeoutNow(args TimeoutNowArgs) bool {
+	return args.Term == raft.Term && args.LeaderId == raft.LeaderID
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+//Timing of raft, from config or defaults. A follower which hears nothing
+//from a leader for a random time between ElectionTimeoutMin and
+//ElectionTimeoutMax starts an election, and a candidate which doesn't
+//win waits as long again before the next one. The leader sends appends
+//every HeartbeatInterval, which must be less than the election timeout,
+//or followers would start elections under a live leader. RPCTimeout is
+//at most HeartbeatInterval, so a peer which doesn't answer holds up a
+//round for no longer than a heartbeat.
+
+//Defaults, in milliseconds, as they were before timing was configurable
+const (
+	DEFAULT_ELECTION_TIMEOUT_MIN = 1000
+	DEFAULT_ELECTION_TIMEOUT_MAX = 1200
+	DEFAULT_HEARTBEAT_INTERVAL   = 750
+	DEFAULT_RPC_TIMEOUT          = 375
+)
+
+var (
+	electionTimeoutMin = DEFAULT_ELECTION_TIMEOUT_MIN * time.Millisecond
+	electionTimeoutMax = DEFAULT_ELECTION_TIMEOUT_MAX * time.Millisecond
+	heartbeatTimeout   = DEFAULT_HEARTBEAT_INTERVAL * time.Millisecond
+	rpcTimeout         = DEFAULT_RPC_TIMEOUT * time.Millisecond //For dialing and answer together
+	maxBatchEntries    = 0                                      //Entries in one append, 0 for no limit
+)
+
+//Config value in milliseconds, or default if not given
+func millis(value, defaultValue int64) time.Duration {
+	if value == 0 {
+		value = defaultValue
+	}
+	return time.Duration(value) * time.Millisecond
+}
+
+//Check timing in config and use it
+func setTiming(config *ClusterConfig) error {
+	if err := checkTiming(config); err != nil {
+		return err
+	}
+
+	electionTimeoutMin, electionTimeoutMax = timingOf(config)
+	heartbeatTimeout = millis(config.HeartbeatInterval, DEFAULT_HEARTBEAT_INTERVAL)
+	rpcTimeout = millis(config.RPCTimeout, DEFAULT_RPC_TIMEOUT)
+	maxBatchEntries = int(config.MaxBatchEntries)
+	return nil
+}
+
+//Election timeout range of config
+func timingOf(config *ClusterConfig) (time.Duration, time.Duration) {
+	min := millis(config.ElectionTimeoutMin, DEFAULT_ELECTION_TIMEOUT_MIN)
+	max := millis(config.ElectionTimeoutMax, DEFAULT_ELECTION_TIMEOUT_MAX)
+	if config.ElectionTimeoutMax == 0 && max < min {
+		max = min + min/5 //Only min given
+	}
+	return min, max
+}
+
+//Check that timing in config is sane
+func checkTiming(config *ClusterConfig) error {
+	if config.ElectionTimeoutMin < 0 || config.ElectionTimeoutMax < 0 || config.HeartbeatInterval < 0 ||
+		config.RPCTimeout < 0 || config.MaxBatchEntries < 0 {
+		return errors.New("Timing in config can't be negative")
+	}
+
+	min, max := timingOf(config)
+	heartbeat := millis(config.HeartbeatInterval, DEFAULT_HEARTBEAT_INTERVAL)
+	timeout := millis(config.RPCTimeout, DEFAULT_RPC_TIMEOUT)
+
+	switch {
+	case max < min:
+		return errors.New("ElectionTimeoutMax is less than ElectionTimeoutMin")
+	case timeout > heartbeat:
+		return errors.New("RPCTimeout is more than HeartbeatInterval")
+	case heartbeat >= min:
+		return errors.New("HeartbeatInterval must be less than ElectionTimeoutMin")
+	}
+	return nil
+}
+
+//Random time to wait for a leader before an election
+func electionTimeout() time.Duration {
+	spread := int64(electionTimeoutMax - electionTimeoutMin)
+	if spread <= 0 {
+		return electionTimeoutMin
+	}
+	return electionTimeoutMin + time.Duration(rand.Int63n(spread))
+}
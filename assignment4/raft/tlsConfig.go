@@ -0,0 +1,208 @@
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//TLS between raft peers, and for clients if ClientTLS is set in config.
+//Every server has a certificate (CertFile and KeyFile of its config)
+//signed by the CA of CAFile, with server-<id> among its DNS names. Peers
+//show their certificates both ways, and a peer is only taken to be the
+//server its certificate is for.
+//
+//Files are checked for changes before handshakes, at most once per
+//CERT_CHECK_INTERVAL, so renewed certificates are used without restart.
+//Connections made before keep the old ones.
+
+const CERT_CHECK_INTERVAL = 5 * time.Second
+
+//Certificate of this server and CA pool, reloaded when files change
+type certStore struct {
+	lock                      sync.Mutex
+	certFile, keyFile, caFile string
+	cert                      *tls.Certificate
+	pool                      *x509.CertPool
+	loaded                    time.Time //Latest change of files when loaded
+	checked                   time.Time //When files were last looked at
+}
+
+var certs *certStore //nil when TLS is not configured
+
+//Name a server's certificate must have
+func peerName(id int) string {
+	return "server-" + strconv.Itoa(id)
+}
+
+//Load certificates of server id, if TLS is configured
+func loadCertificates(config *ClusterConfig, id int) error {
+	certs = nil
+	if config.CAFile == "" {
+		if config.ClientTLS {
+			return errors.New("ClientTLS needs CAFile in config")
+		}
+		return nil
+	}
+
+	for _, server := range config.Servers {
+		if server.Id == id {
+			certs = &certStore{certFile: server.CertFile, keyFile: server.KeyFile, caFile: config.CAFile}
+		}
+	}
+	if certs == nil {
+		return errors.New("No config for server " + strconv.Itoa(id))
+	}
+
+	if err := certs.load(); err != nil {
+		certs = nil
+		return err
+	}
+	if err := certs.cert.Leaf.VerifyHostname(peerName(id)); err != nil {
+		certs = nil
+		return errors.New("Certificate of server " + strconv.Itoa(id) + " is not for " + peerName(id))
+	}
+	return nil
+}
+
+//Read files. Must hold lock, or be the only user
+func (s *certStore) load() error {
+	changed := latestChange(s.certFile, s.keyFile, s.caFile)
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return errors.New("Couldn't load certificate: " + err.Error())
+	}
+	if cert.Leaf == nil {
+		//Go before 1.23 doesn't parse it
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return errors.New("Couldn't parse certificate: " + err.Error())
+		}
+	}
+
+	ca, err := ioutil.ReadFile(s.caFile)
+	if err != nil {
+		return errors.New("Couldn't open CA file from :" + s.caFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.New("No certificates in CA file " + s.caFile)
+	}
+
+	s.cert, s.pool, s.loaded = &cert, pool, changed
+	return nil
+}
+
+//Latest modification time of files
+func latestChange(files ...string) time.Time {
+	var latest time.Time
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+//Certificate and CA pool, reloaded first if files changed
+//Old ones are kept if new files can't be loaded, say when half written
+func (s *certStore) get() (*tls.Certificate, *x509.CertPool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if time.Since(s.checked) >= CERT_CHECK_INTERVAL {
+		s.checked = time.Now()
+		if latestChange(s.certFile, s.keyFile, s.caFile).After(s.loaded) {
+			if err := s.load(); err != nil {
+				log.Print("Keeping old certificates: " + err.Error())
+			} else {
+				log.Print("Certificates reloaded")
+			}
+		}
+	}
+	return s.cert, s.pool
+}
+
+//Config for listening with the certificate of this server. If peers is
+//true, the other end must show a certificate of the CA
+func listenTLSConfig(peers bool) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := certs.get()
+			config := &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}
+			if peers {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}
+}
+
+//Config for client listeners, nil if clients don't use TLS
+func ClientTLSConfig() *tls.Config {
+	if certs == nil || !ClusterInfo.ClientTLS {
+		return nil
+	}
+	return listenTLSConfig(false)
+}
+
+//Config for connecting to server id, which must show its certificate
+//This server shows its own. nil if TLS is not configured
+func DialTLSConfig(id int) *tls.Config {
+	if certs == nil {
+		return nil
+	}
+	cert, pool := certs.get()
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+		ServerName:   peerName(id),
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+//Id of the server a verified certificate is for, -1 if none in config
+func peerID(state tls.ConnectionState) int {
+	if len(state.PeerCertificates) == 0 {
+		return -1
+	}
+	for _, server := range ClusterInfo.Servers {
+		if state.PeerCertificates[0].VerifyHostname(peerName(server.Id)) == nil {
+			return server.Id
+		}
+	}
+	return -1
+}
+
+//Finish handshake of a peer and find which server it is
+func acceptPeer(conn *tls.Conn) (int, error) {
+	conn.SetDeadline(time.Now().Add(rpcTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := conn.Handshake(); err != nil {
+		return -1, err
+	}
+	id := peerID(conn.ConnectionState())
+	if id < 0 {
+		return -1, errors.New("Certificate is not of a server in config")
+	}
+	return id, nil
+}
+
+//Connect to a peer by deadline, with mutual TLS if configured
+func dialPeer(server ServerConfig, deadline time.Time) (net.Conn, error) {
+	address := server.LogAddress()
+	dialer := &net.Dialer{Deadline: deadline}
+	if certs == nil {
+		return dialer.Dial("tcp", address)
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, DialTLSConfig(server.Id))
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"assignment4/raft"
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -15,7 +20,7 @@ const (
 	STATE_FILENAME = "saved"
 	SERVER_NAME    = "./kvstore"
 	NUM_SERVERS    = 5
-	START_PORT     = 9000
+	LOOPBACK_DIR   = "loopback"
 	LOG_TEST       = true
 	LOG_TEST_LABEL = true
 	LOG_MSG        = true
@@ -27,9 +32,30 @@ var liveServers []*exec.Cmd
 var ERROR_HAPPENED = false
 var waitSec = 2 * time.Second //Time to wait for leader election
 
+var servers []raft.ServerConfig //From config.json
+var serverDir = "."             //Where servers run and keep state
+
+//Run every server on its own loopback address (127.0.0.<id+1>), all with
+//the ports of server 0, to test that servers reach each other by host
+var loopback = flag.Bool("loopback", false, "run servers on 127.0.0.<id+1> with the same ports")
+
 func main() {
+	flag.Parse()
 	LogVerbose("Tester starting..")
 
+	if err := raft.ReadConfig(); err != nil || len(raft.ClusterInfo.Servers) < NUM_SERVERS {
+		fmt.Println("Need config.json with", NUM_SERVERS, "servers")
+		os.Exit(1)
+	}
+	servers = raft.ClusterInfo.Servers
+
+	if *loopback {
+		if err := setupLoopback(); err != nil {
+			fmt.Println("Couldn't write config for loopback: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
 	liveServers = make([]*exec.Cmd, NUM_SERVERS)
 
 	ResetServerState()
@@ -52,8 +78,47 @@ func main() {
 func ResetServerState() {
 	//Remove any state recovery files
 	for i := 0; i < NUM_SERVERS; i++ {
-		os.Remove(fmt.Sprintf("%s_S%d.state", STATE_FILENAME, i))
+		os.Remove(filepath.Join(stateDir(), fmt.Sprintf("%s_S%d.state", STATE_FILENAME, i)))
+	}
+}
+
+//Where servers keep state, Path of config relative to where they run
+func stateDir() string {
+	if filepath.IsAbs(raft.ClusterInfo.Path) {
+		return raft.ClusterInfo.Path
+	}
+	return filepath.Join(serverDir, raft.ClusterInfo.Path)
+}
+
+//Config with server i on 127.0.0.<i+1>, written to LOOPBACK_DIR for
+//servers run from there
+func setupLoopback() error {
+	config := raft.ClusterInfo
+	config.Servers = nil
+	for i, server := range servers {
+		host := fmt.Sprintf("127.0.0.%d", i+1)
+		server.Hostname = host
+		server.ClientPort, server.LogPort = servers[0].ClientPort, servers[0].LogPort
+		server.RespPort, server.HttpPort = servers[0].RespPort, servers[0].HttpPort
+		server.ClientBind = net.JoinHostPort(host, strconv.Itoa(server.ClientPort))
+		server.LogBind = net.JoinHostPort(host, strconv.Itoa(server.LogPort))
+		config.Servers = append(config.Servers, server)
+	}
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(LOOPBACK_DIR, 0755); err != nil {
+		return err
 	}
+	if err := ioutil.WriteFile(filepath.Join(LOOPBACK_DIR, "config.json"), data, 0644); err != nil {
+		return err
+	}
+
+	servers, serverDir = config.Servers, LOOPBACK_DIR
+	LogVerbose("Servers run in", LOOPBACK_DIR, "on loopback addresses")
+	return nil
 }
 
 //At least majority server should be up for getting any response to client
@@ -129,7 +194,6 @@ func TestElectionAndReplication() {
 	killAllServers()
 }
 
-//
 func TestStress() {
 	Log("Stress test")
 	startAllServers()
@@ -226,7 +290,10 @@ func connectToLeader(startId int) (net.Conn, int) {
 		redirect, sid := parseServerResponse(response)
 
 		if redirect {
-			startId = sid
+			conn.Close()
+			if sid >= 0 {
+				startId = sid
+			}
 			time.Sleep(250 * time.Millisecond)
 			LogVerbose("Redirected to server ", sid)
 			continue
@@ -239,8 +306,16 @@ func connectToLeader(startId int) (net.Conn, int) {
 //Tries to parse the message if redirect and return port number
 func parseServerResponse(response string) (redirect bool, serverId int) {
 
-	if response[:8] == "REDIRECT" {
-		serverId, err := strconv.ParseInt(response[9:], 10, 64)
+	if strings.HasPrefix(response, "ERR_NO_LEADER") ||
+		strings.HasPrefix(response, "ERR_NOT_LEADER") ||
+		strings.HasPrefix(response, "ERR_TIMEOUT") {
+		//Election going on, try same server again
+		return true, -1
+	}
+
+	if strings.HasPrefix(response, "REDIRECT") {
+		//REDIRECT <leader id> <host:port>
+		serverId, err := strconv.ParseInt(strings.Fields(response)[1], 10, 64)
 
 		if err != nil {
 			PrintError("Couldn't parse server REDIRECT")
@@ -255,19 +330,21 @@ func parseServerResponse(response string) (redirect bool, serverId int) {
 
 //Connect to server with serverId as id
 func startClient(id int) net.Conn {
-	port := fmt.Sprintf("%d", START_PORT+id)
+	address := servers[id].ClientAddress()
 
-	conn, err := net.Dial("tcp", "localhost:"+port)
+	conn, err := net.Dial("tcp", address)
 
 	if err != nil {
-		fmt.Println("Cannot connect to server.. Port:" + port)
+		fmt.Println("Cannot connect to server.. Address:" + address)
 		return nil
 	}
 	return conn
 }
 
 func startSingleServer(id int) {
-	liveServers[id] = exec.Command(SERVER_NAME, strconv.Itoa(id))
+	path, _ := filepath.Abs(SERVER_NAME)
+	liveServers[id] = exec.Command(path, strconv.Itoa(id))
+	liveServers[id].Dir = serverDir
 	// liveServers[id].Stdout = os.Stdout
 	// liveServers[id].Stderr = os.Stderr
 	err := liveServers[id].Start()